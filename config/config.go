@@ -2,6 +2,10 @@
 package config
 
 // 导入必要的包
+import (
+	"encoding/json"
+	"time"
+)
 
 // 用于格式化输出
 // 用于操作系统相关的操作，如文件操作
@@ -12,15 +16,53 @@ type MalvusCfg struct {
 	collectionName string // Milvus中用于存储数据的集合名称
 }
 
+// ToolPolicy 助手的工具权限规则，工具名支持path.Match的通配符，例如"seat_*"
+// 优先级：Deny > Confirm > Allow > 按工具风险等级的默认规则
+type ToolPolicy struct {
+	Allow              []string // 直接允许的工具
+	Confirm            []string // 执行前需要确认的工具
+	Deny               []string // 禁止调用的工具
+	ConfirmSideEffects bool     // 有副作用的工具默认也需要确认，危险工具总是默认需要确认
+}
+
+// CommandSandbox command插件的沙箱配置，Enabled为false时命令直接交给bash执行
+// 沙箱模式下命令不经过shell，按参数拆分后只允许执行AllowedCommands中的程序，
+// env、xargs、解释器等能执行其他程序的程序不能加入AllowedCommands，参数中不能使用绝对路径和..；
+// 零值字段使用插件的默认值
+type CommandSandbox struct {
+	Enabled         bool          // 是否启用沙箱模式
+	AllowedCommands []string      // 允许执行的程序名，为空时使用插件内置的只读命令列表
+	WorkDir         string        // 命令的工作目录，为空时每次启动创建一个临时目录，卸载插件时删除
+	Timeout         time.Duration // 单条命令的最长执行时间，后台任务同样在超时后被终止
+	CPUSeconds      uint64        // CPU时间上限（秒）
+	MemoryBytes     uint64        // 虚拟内存上限（字节）
+	MaxOutputBytes  int           // 返回给模型的最大输出长度，超出部分截断；非沙箱模式同样生效
+	AllowNetwork    bool          // 为false时在系统支持的情况下（Linux）把命令放进独立的网络命名空间
+}
+
 // 定义主配置结构体
 type Cfg struct {
-	openAiAPIKey         string    // OpenAI API的密钥
-	openAibaseURL        string    // OpenAI 中转地址
-	openWeatherMapAPIKey string    // OpenWeatherMap API的密钥
-	malvusCfg            MalvusCfg // Milvus数据库的配置
-	mqttBrokerURL        string    // MQTT 代理服务器地址
-	mqttUsername         string    // MQTT 用户名
-	mqttPassword         string    // MQTT 密码
+	openAiAPIKey         string                // OpenAI API的密钥
+	openAibaseURL        string                // OpenAI 中转地址
+	openWeatherMapAPIKey string                // OpenWeatherMap API的密钥
+	malvusCfg            MalvusCfg             // Milvus数据库的配置
+	mqttBrokerURL        string                // MQTT 代理服务器地址
+	mqttUsername         string                // MQTT 用户名
+	mqttPassword         string                // MQTT 密码
+	mqttClientID         string                // MQTT 客户端ID前缀，连接时追加随机后缀保证唯一
+	mqttQoS              byte                  // MQTT 默认的QoS等级
+	mqttRetain           bool                  // MQTT 发布消息时是否默认保留
+	mqttTopicPrefix      string                // MQTT 主题前缀，区分同一代理上的多个机器人
+	maxToolRounds        int                   // 每条用户消息最多允许的工具调用轮数
+	maxIdenticalToolCall int                   // 每条用户消息中同一工具以相同参数最多被调用的次数
+	shortTermMemorySize  int                   // 每个会话短期记忆保留的最大条数
+	contextTokenBudget   int                   // 每次请求发送给模型的上下文token预算
+	contextSummarize     bool                  // 超出预算时是否用模型总结较早的对话，否则直接丢弃
+	agentPlugins         map[string][]string   // 每个助手（按插件目录名区分）加载的编译期注册插件ID
+	requiredPlugins      []string              // 必需插件的ID，加载失败时单独报告
+	agentToolPolicies    map[string]ToolPolicy // 每个助手（按插件目录名区分）的工具权限规则
+	commandSandbox       CommandSandbox        // command插件的沙箱配置
+	qaStorePath          string                // qa_store插件保存问题和解决方法的JSON文件路径
 }
 
 // New函数用于创建并初始化Cfg配置实例
@@ -40,6 +82,12 @@ func New() Cfg {
 		mqttBrokerURL:        "your:1883", // MQTT 代理服务器地址
 		mqttUsername:         "your",      // MQTT 用户名
 		mqttPassword:         "your",      // MQTT 密码
+		mqttClientID:         "agi",       // MQTT 客户端ID前缀
+		maxToolRounds:        8,           // 工具调用轮数上限
+		maxIdenticalToolCall: 2,           // 相同工具调用次数上限
+		shortTermMemorySize:  20,          // 短期记忆条数上限
+		contextTokenBudget:   16000,       // 上下文token预算
+		contextSummarize:     true,        // 超出预算时总结较早的对话
 	}
 
 	return cfg // 返回配置实例
@@ -119,3 +167,243 @@ func (c Cfg) SetMQTTPassword(password string) Cfg {
 func (c Cfg) MQTTPassword() string {
 	return c.mqttPassword
 }
+
+// 设置和获取工具调用轮数上限的方法
+func (c Cfg) SetMaxToolRounds(rounds int) Cfg {
+	c.maxToolRounds = rounds
+	return c
+}
+
+func (c Cfg) MaxToolRounds() int {
+	return c.maxToolRounds
+}
+
+// 设置和获取相同工具调用次数上限的方法
+func (c Cfg) SetMaxIdenticalToolCall(times int) Cfg {
+	c.maxIdenticalToolCall = times
+	return c
+}
+
+func (c Cfg) MaxIdenticalToolCall() int {
+	return c.maxIdenticalToolCall
+}
+
+// 设置和获取短期记忆条数上限的方法
+func (c Cfg) SetShortTermMemorySize(size int) Cfg {
+	c.shortTermMemorySize = size
+	return c
+}
+
+func (c Cfg) ShortTermMemorySize() int {
+	return c.shortTermMemorySize
+}
+
+// 设置和获取上下文token预算的方法
+func (c Cfg) SetContextTokenBudget(tokens int) Cfg {
+	c.contextTokenBudget = tokens
+	return c
+}
+
+func (c Cfg) ContextTokenBudget() int {
+	return c.contextTokenBudget
+}
+
+// 设置和获取是否总结较早对话的方法
+func (c Cfg) SetContextSummarize(summarize bool) Cfg {
+	c.contextSummarize = summarize
+	return c
+}
+
+func (c Cfg) ContextSummarize() bool {
+	return c.contextSummarize
+}
+
+// 设置和获取助手加载的编译期注册插件的方法
+// agent为助手的插件目录名，例如"for_chat"、"for_before_chat"
+func (c Cfg) SetAgentPlugins(agent string, ids []string) Cfg {
+	agentPlugins := make(map[string][]string, len(c.agentPlugins)+1)
+	for k, v := range c.agentPlugins {
+		agentPlugins[k] = v
+	}
+	agentPlugins[agent] = append([]string(nil), ids...)
+	c.agentPlugins = agentPlugins
+	return c
+}
+
+func (c Cfg) AgentPlugins(agent string) []string {
+	return append([]string(nil), c.agentPlugins[agent]...)
+}
+
+// 设置和获取必需插件的方法，未列出的插件都是可选插件
+func (c Cfg) SetRequiredPlugins(ids []string) Cfg {
+	c.requiredPlugins = append([]string(nil), ids...)
+	return c
+}
+
+func (c Cfg) RequiredPlugins() []string {
+	return append([]string(nil), c.requiredPlugins...)
+}
+
+// 设置和获取助手工具权限规则的方法
+// agent为助手的插件目录名，例如"for_chat"、"for_before_chat"
+func (c Cfg) SetAgentToolPolicy(agent string, policy ToolPolicy) Cfg {
+	policies := make(map[string]ToolPolicy, len(c.agentToolPolicies)+1)
+	for k, v := range c.agentToolPolicies {
+		policies[k] = v
+	}
+	policies[agent] = policy
+	c.agentToolPolicies = policies
+	return c
+}
+
+func (c Cfg) AgentToolPolicy(agent string) ToolPolicy {
+	return c.agentToolPolicies[agent]
+}
+
+// 设置和获取MQTT客户端ID前缀的方法
+func (c Cfg) SetMQTTClientID(prefix string) Cfg {
+	c.mqttClientID = prefix
+	return c
+}
+
+func (c Cfg) MQTTClientID() string {
+	return c.mqttClientID
+}
+
+// 设置和获取MQTT默认QoS等级的方法，有效值为0、1、2
+func (c Cfg) SetMQTTQoS(qos byte) Cfg {
+	c.mqttQoS = qos
+	return c
+}
+
+func (c Cfg) MQTTQoS() byte {
+	return c.mqttQoS
+}
+
+// 设置和获取MQTT发布消息时是否默认保留的方法
+func (c Cfg) SetMQTTRetain(retain bool) Cfg {
+	c.mqttRetain = retain
+	return c
+}
+
+func (c Cfg) MQTTRetain() bool {
+	return c.mqttRetain
+}
+
+// 设置和获取MQTT主题前缀的方法，例如"robot1"会把"motor/control"变为"robot1/motor/control"
+func (c Cfg) SetMQTTTopicPrefix(prefix string) Cfg {
+	c.mqttTopicPrefix = prefix
+	return c
+}
+
+func (c Cfg) MQTTTopicPrefix() string {
+	return c.mqttTopicPrefix
+}
+
+// 设置和获取command插件沙箱配置的方法
+func (c Cfg) SetCommandSandbox(sandbox CommandSandbox) Cfg {
+	sandbox.AllowedCommands = append([]string(nil), sandbox.AllowedCommands...)
+	c.commandSandbox = sandbox
+	return c
+}
+
+func (c Cfg) CommandSandbox() CommandSandbox {
+	return c.commandSandbox
+}
+
+// 设置和获取qa_store插件JSON文件路径的方法，为空时使用用户配置目录（os.UserConfigDir）下的agi_modules_for_go/qa_data.json
+func (c Cfg) SetQAStorePath(path string) Cfg {
+	c.qaStorePath = path
+	return c
+}
+
+func (c Cfg) QAStorePath() string {
+	return c.qaStorePath
+}
+
+// cfgJSON Cfg的JSON形式，用于把宿主的配置传给子进程插件
+type cfgJSON struct {
+	OpenAiAPIKey         string                `json:"openai_api_key"`
+	OpenAibaseURL        string                `json:"openai_base_url"`
+	OpenWeatherMapAPIKey string                `json:"openweathermap_api_key"`
+	MalvusAPIEndpoint    string                `json:"malvus_api_endpoint"`
+	MalvusCollectionName string                `json:"malvus_collection_name"`
+	MQTTBrokerURL        string                `json:"mqtt_broker_url"`
+	MQTTUsername         string                `json:"mqtt_username"`
+	MQTTPassword         string                `json:"mqtt_password"`
+	MQTTClientID         string                `json:"mqtt_client_id"`
+	MQTTQoS              byte                  `json:"mqtt_qos"`
+	MQTTRetain           bool                  `json:"mqtt_retain"`
+	MQTTTopicPrefix      string                `json:"mqtt_topic_prefix"`
+	MaxToolRounds        int                   `json:"max_tool_rounds"`
+	MaxIdenticalToolCall int                   `json:"max_identical_tool_call"`
+	ShortTermMemorySize  int                   `json:"short_term_memory_size"`
+	ContextTokenBudget   int                   `json:"context_token_budget"`
+	ContextSummarize     bool                  `json:"context_summarize"`
+	AgentPlugins         map[string][]string   `json:"agent_plugins,omitempty"`
+	RequiredPlugins      []string              `json:"required_plugins,omitempty"`
+	AgentToolPolicies    map[string]ToolPolicy `json:"agent_tool_policies,omitempty"`
+	CommandSandbox       CommandSandbox        `json:"command_sandbox"`
+	QAStorePath          string                `json:"qa_store_path,omitempty"`
+}
+
+// MarshalJSON方法把配置编码为JSON，用于把宿主的配置传给子进程插件
+// 结果中包含API密钥和密码，不要写入日志
+func (c Cfg) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cfgJSON{
+		OpenAiAPIKey:         c.openAiAPIKey,
+		OpenAibaseURL:        c.openAibaseURL,
+		OpenWeatherMapAPIKey: c.openWeatherMapAPIKey,
+		MalvusAPIEndpoint:    c.malvusCfg.apiEndpoint,
+		MalvusCollectionName: c.malvusCfg.collectionName,
+		MQTTBrokerURL:        c.mqttBrokerURL,
+		MQTTUsername:         c.mqttUsername,
+		MQTTPassword:         c.mqttPassword,
+		MQTTClientID:         c.mqttClientID,
+		MQTTQoS:              c.mqttQoS,
+		MQTTRetain:           c.mqttRetain,
+		MQTTTopicPrefix:      c.mqttTopicPrefix,
+		MaxToolRounds:        c.maxToolRounds,
+		MaxIdenticalToolCall: c.maxIdenticalToolCall,
+		ShortTermMemorySize:  c.shortTermMemorySize,
+		ContextTokenBudget:   c.contextTokenBudget,
+		ContextSummarize:     c.contextSummarize,
+		AgentPlugins:         c.agentPlugins,
+		RequiredPlugins:      c.requiredPlugins,
+		AgentToolPolicies:    c.agentToolPolicies,
+		CommandSandbox:       c.commandSandbox,
+		QAStorePath:          c.qaStorePath,
+	})
+}
+
+// UnmarshalJSON方法从MarshalJSON的结果恢复配置
+func (c *Cfg) UnmarshalJSON(data []byte) error {
+	var v cfgJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = Cfg{
+		openAiAPIKey:         v.OpenAiAPIKey,
+		openAibaseURL:        v.OpenAibaseURL,
+		openWeatherMapAPIKey: v.OpenWeatherMapAPIKey,
+		malvusCfg:            MalvusCfg{apiEndpoint: v.MalvusAPIEndpoint, collectionName: v.MalvusCollectionName},
+		mqttBrokerURL:        v.MQTTBrokerURL,
+		mqttUsername:         v.MQTTUsername,
+		mqttPassword:         v.MQTTPassword,
+		mqttClientID:         v.MQTTClientID,
+		mqttQoS:              v.MQTTQoS,
+		mqttRetain:           v.MQTTRetain,
+		mqttTopicPrefix:      v.MQTTTopicPrefix,
+		maxToolRounds:        v.MaxToolRounds,
+		maxIdenticalToolCall: v.MaxIdenticalToolCall,
+		shortTermMemorySize:  v.ShortTermMemorySize,
+		contextTokenBudget:   v.ContextTokenBudget,
+		contextSummarize:     v.ContextSummarize,
+		agentPlugins:         v.AgentPlugins,
+		requiredPlugins:      v.RequiredPlugins,
+		agentToolPolicies:    v.AgentToolPolicies,
+		commandSandbox:       v.CommandSandbox,
+		qaStorePath:          v.QAStorePath,
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package mqttbus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// 首次连接MQTT代理的最长等待时间
+const connectTimeout = 10 * time.Second
+
+// ErrNotConnected 表示MQTT连接当前不可用，连接断开期间会自动重连
+var ErrNotConnected = errors.New("mqtt bus not connected")
+
+// Handler 处理订阅到的消息，topic是去掉主题前缀后的主题
+type Handler func(topic string, payload []byte)
+
+// Bus 进程内共享的MQTT连接
+// 断线后自动重连，重连成功后重新订阅所有主题；发布和订阅的主题都会加上配置的主题前缀
+type Bus struct {
+	client    mqtt.Client
+	prefix    string
+	qos       byte
+	retain    bool
+	sharedKey string // Shared返回的Bus在缓存中的键，由sharedMu保护
+
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[string]map[uint64]Handler // 带前缀的主题 -> 订阅ID -> 处理函数
+}
+
+// New 创建并连接一个新的Bus，客户端ID为配置的前缀加随机后缀
+func New(cfg config.Cfg) (*Bus, error) {
+	b := &Bus{
+		prefix: strings.Trim(cfg.MQTTTopicPrefix(), "/"),
+		qos:    cfg.MQTTQoS(),
+		retain: cfg.MQTTRetain(),
+		subs:   make(map[string]map[uint64]Handler),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBrokerURL()).
+		SetClientID(clientID(cfg.MQTTClientID())).
+		SetUsername(cfg.MQTTUsername()).
+		SetPassword(cfg.MQTTPassword()).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetOnConnectHandler(b.resubscribe).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			fmt.Printf("MQTT连接断开，正在重连：%v\n", err)
+		})
+	b.client = mqtt.NewClient(opts)
+
+	token := b.client.Connect()
+	if !token.WaitTimeout(connectTimeout) {
+		b.client.Disconnect(0)
+		return nil, fmt.Errorf("无法连接到MQTT代理%s：超时", cfg.MQTTBrokerURL())
+	}
+	if token.Error() != nil {
+		return nil, fmt.Errorf("无法连接到MQTT代理%s：%v", cfg.MQTTBrokerURL(), token.Error())
+	}
+	return b, nil
+}
+
+// clientID 生成带随机后缀的客户端ID，避免多个实例使用相同的ID互相踢下线
+func clientID(prefix string) string {
+	if prefix == "" {
+		prefix = "agi"
+	}
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + "_" + hex.EncodeToString(buf)
+}
+
+// Topic 返回加上主题前缀后的完整主题
+func (b *Bus) Topic(topic string) string {
+	if b.prefix == "" {
+		return topic
+	}
+	return b.prefix + "/" + strings.TrimPrefix(topic, "/")
+}
+
+// trimTopic 去掉完整主题中的主题前缀
+func (b *Bus) trimTopic(topic string) string {
+	if b.prefix == "" {
+		return topic
+	}
+	return strings.TrimPrefix(topic, b.prefix+"/")
+}
+
+// Publish 使用配置的QoS和保留标志发布消息，ctx被取消时不再等待发送结果
+func (b *Bus) Publish(ctx context.Context, topic string, payload interface{}) error {
+	return b.PublishWith(ctx, topic, payload, b.qos, b.retain)
+}
+
+// PublishWith 使用指定的QoS和保留标志发布消息
+func (b *Bus) PublishWith(ctx context.Context, topic string, payload interface{}, qos byte, retain bool) error {
+	if !b.client.IsConnectionOpen() {
+		return fmt.Errorf("%w: publish %s", ErrNotConnected, b.Topic(topic))
+	}
+	token := b.client.Publish(b.Topic(topic), qos, retain, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return token.Error()
+}
+
+// Subscribe 订阅主题，返回的cancel函数用于取消这次订阅
+// 同一主题可以被多次订阅，每个处理函数都会收到消息，最后一个订阅取消时才向代理退订
+func (b *Bus) Subscribe(topic string, handler Handler) (cancel func(), err error) {
+	full := b.Topic(topic)
+
+	b.mu.Lock()
+	b.nextID++
+	id := b.nextID
+	handlers, subscribed := b.subs[full]
+	if !subscribed {
+		handlers = make(map[uint64]Handler)
+		b.subs[full] = handlers
+	}
+	handlers[id] = handler
+	b.mu.Unlock()
+
+	cancel = func() { b.unsubscribe(full, id) }
+	// 连接断开期间只记录订阅，重连成功后由resubscribe订阅
+	if subscribed || !b.client.IsConnectionOpen() {
+		return cancel, nil
+	}
+	token := b.client.Subscribe(full, b.qos, b.dispatch(full))
+	if !token.WaitTimeout(connectTimeout) {
+		cancel()
+		return nil, fmt.Errorf("订阅主题%s超时", full)
+	}
+	if token.Error() != nil {
+		cancel()
+		return nil, fmt.Errorf("订阅主题%s失败：%v", full, token.Error())
+	}
+	return cancel, nil
+}
+
+// unsubscribe 移除一个处理函数，主题没有处理函数时向代理退订
+func (b *Bus) unsubscribe(full string, id uint64) {
+	b.mu.Lock()
+	handlers := b.subs[full]
+	if _, ok := handlers[id]; !ok {
+		b.mu.Unlock()
+		return
+	}
+	delete(handlers, id)
+	last := len(handlers) == 0
+	if last {
+		delete(b.subs, full)
+	}
+	b.mu.Unlock()
+
+	if last && b.client.IsConnectionOpen() {
+		b.client.Unsubscribe(full).WaitTimeout(connectTimeout)
+	}
+}
+
+// dispatch 返回把消息分发给主题所有处理函数的paho回调
+func (b *Bus) dispatch(full string) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		b.mu.Lock()
+		handlers := make([]Handler, 0, len(b.subs[full]))
+		for _, handler := range b.subs[full] {
+			handlers = append(handlers, handler)
+		}
+		b.mu.Unlock()
+
+		topic := b.trimTopic(msg.Topic())
+		for _, handler := range handlers {
+			handler(topic, msg.Payload())
+		}
+	}
+}
+
+// resubscribe 在（重新）连接成功后订阅所有主题，重连时代理已丢弃之前的订阅
+func (b *Bus) resubscribe(client mqtt.Client) {
+	b.mu.Lock()
+	topics := make([]string, 0, len(b.subs))
+	for full := range b.subs {
+		topics = append(topics, full)
+	}
+	b.mu.Unlock()
+
+	for _, full := range topics {
+		token := client.Subscribe(full, b.qos, b.dispatch(full))
+		go func(full string) {
+			if token.WaitTimeout(connectTimeout) && token.Error() != nil {
+				fmt.Printf("重新订阅主题%s失败：%v\n", full, token.Error())
+			}
+		}(full)
+	}
+}
+
+// IsConnected 返回当前连接是否可用
+func (b *Bus) IsConnected() bool {
+	return b.client.IsConnectionOpen()
+}
+
+// Health 检查MQTT连接是否可用
+func (b *Bus) Health() error {
+	if !b.IsConnected() {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// Close 断开连接
+// Shared返回的Bus按引用计数共享，每次Shared对应一次Close，最后一次Close才断开连接并从缓存中移除，之后再调用Shared会重新连接
+func (b *Bus) Close() {
+	sharedMu.Lock()
+	if e, ok := shared[b.sharedKey]; ok && e.bus == b {
+		e.refs--
+		if e.refs > 0 {
+			sharedMu.Unlock()
+			return
+		}
+		delete(shared, b.sharedKey)
+	}
+	sharedMu.Unlock()
+	b.client.Disconnect(250)
+}
+
+// sharedBus 缓存中的一个共享Bus
+type sharedBus struct {
+	ready chan struct{} // 连接完成（成功或失败）后关闭
+	bus   *Bus
+	err   error
+	refs  int // Shared返回该Bus的次数减去Close的次数
+}
+
+var (
+	sharedMu sync.Mutex
+	shared   = make(map[string]*sharedBus)
+
+	// newBus 创建并连接Bus，测试时替换为不连接代理的实现
+	newBus = New
+)
+
+// Shared 返回按代理地址、用户名、客户端ID前缀和主题前缀共享的Bus，第一次调用时建立连接
+// 连接在sharedMu之外进行，不阻塞其他配置的Shared；同一配置的并发调用等待同一次连接的结果
+// 连接失败时不缓存，下次调用会重试；不再使用时调用Close
+func Shared(cfg config.Cfg) (*Bus, error) {
+	key := strings.Join([]string{cfg.MQTTBrokerURL(), cfg.MQTTUsername(), cfg.MQTTClientID(), cfg.MQTTTopicPrefix(),
+		fmt.Sprint(cfg.MQTTQoS()), fmt.Sprint(cfg.MQTTRetain())}, "|")
+
+	for {
+		sharedMu.Lock()
+		e, ok := shared[key]
+		if !ok {
+			e = &sharedBus{ready: make(chan struct{})}
+			shared[key] = e
+		}
+		sharedMu.Unlock()
+		if !ok {
+			connectShared(cfg, key, e)
+		}
+		<-e.ready
+
+		sharedMu.Lock()
+		if e.err != nil {
+			sharedMu.Unlock()
+			return nil, e.err
+		}
+		if shared[key] == e {
+			e.refs++
+			sharedMu.Unlock()
+			return e.bus, nil
+		}
+		// 等待期间Bus已被最后一个使用者关闭，重新连接
+		sharedMu.Unlock()
+	}
+}
+
+// connectShared 不持有sharedMu建立连接，完成后把结果记录到e
+func connectShared(cfg config.Cfg, key string, e *sharedBus) {
+	b, err := newBus(cfg)
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	defer close(e.ready)
+	switch {
+	case err != nil:
+		e.err = err
+		if shared[key] == e {
+			delete(shared, key)
+		}
+	case shared[key] != e:
+		// 连接期间CloseShared关闭了所有共享的Bus
+		b.client.Disconnect(0)
+		e.err = fmt.Errorf("%w: shared buses were closed while connecting", ErrNotConnected)
+	default:
+		b.sharedKey = key
+		e.bus = b
+	}
+}
+
+// CloseShared 不论引用计数，断开所有共享的Bus，通常在程序退出时调用
+func CloseShared() {
+	sharedMu.Lock()
+	buses := make([]*Bus, 0, len(shared))
+	for _, e := range shared {
+		// 正在连接的Bus由connectShared在连接完成后断开
+		if e.bus != nil {
+			buses = append(buses, e.bus)
+		}
+	}
+	shared = make(map[string]*sharedBus)
+	sharedMu.Unlock()
+
+	for _, b := range buses {
+		b.client.Disconnect(250)
+	}
+}
@@ -0,0 +1,374 @@
+package mqttbus
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// doneToken 已完成的mqtt.Token
+type doneToken struct{ err error }
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                   { return t.err }
+
+func (t doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// fakeMessage 投递给订阅回调的消息
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeClient 记录订阅和发布的mqtt.Client，不连接代理
+type fakeClient struct {
+	mu           sync.Mutex
+	connected    bool
+	subscribed   map[string]mqtt.MessageHandler
+	unsubscribed []string
+	published    []string
+	disconnects  int
+}
+
+func newFakeClient(connected bool) *fakeClient {
+	return &fakeClient{connected: connected, subscribed: make(map[string]mqtt.MessageHandler)}
+}
+
+func (c *fakeClient) IsConnected() bool { return c.IsConnectionOpen() }
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) Connect() mqtt.Token { return doneToken{} }
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	c.disconnects++
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, topic)
+	return doneToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed[topic] = callback
+	return doneToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return doneToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subscribed, topic)
+		c.unsubscribed = append(c.unsubscribed, topic)
+	}
+	return doneToken{}
+}
+
+func (c *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader             { return mqtt.ClientOptionsReader{} }
+
+// deliver 模拟代理把消息投递给订阅了topic的回调
+func (c *fakeClient) deliver(topic string, payload string) {
+	c.mu.Lock()
+	callback := c.subscribed[topic]
+	c.mu.Unlock()
+	if callback != nil {
+		callback(c, fakeMessage{topic: topic, payload: []byte(payload)})
+	}
+}
+
+// subscribedTopics 返回当前订阅的主题
+func (c *fakeClient) subscribedTopics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.subscribed))
+	for topic := range c.subscribed {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// newTestBus 创建使用fakeClient的Bus
+func newTestBus(client *fakeClient, prefix string) *Bus {
+	return &Bus{client: client, prefix: prefix, subs: make(map[string]map[uint64]Handler)}
+}
+
+func TestTopic(t *testing.T) {
+	tests := []struct {
+		prefix string
+		topic  string
+		want   string
+	}{
+		{prefix: "", topic: "dog/face", want: "dog/face"},
+		{prefix: "home", topic: "dog/face", want: "home/dog/face"},
+		{prefix: "home", topic: "/dog/face", want: "home/dog/face"},
+	}
+	for _, tt := range tests {
+		b := newTestBus(newFakeClient(true), tt.prefix)
+		if got := b.Topic(tt.topic); got != tt.want {
+			t.Errorf("Topic(%q) with prefix %q = %q, want %q", tt.topic, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	client := newFakeClient(true)
+	b := newTestBus(client, "home")
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	handler := func(name string) Handler {
+		return func(topic string, payload []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name] = append(received[name], topic+"="+string(payload))
+		}
+	}
+
+	cancelA, err := b.Subscribe("dog/face", handler("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelB, err := b.Subscribe("dog/face", handler("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.subscribedTopics(); !reflect.DeepEqual(got, []string{"home/dog/face"}) {
+		t.Fatalf("subscribed = %v", got)
+	}
+
+	// 同一主题的所有处理函数都收到去掉前缀的主题
+	client.deliver("home/dog/face", "Happy")
+	want := map[string][]string{"a": {"dog/face=Happy"}, "b": {"dog/face=Happy"}}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("received = %v, want %v", received, want)
+	}
+
+	// 最后一个订阅取消时才向代理退订
+	cancelA()
+	if len(client.unsubscribed) != 0 {
+		t.Errorf("unsubscribed %v while b is still subscribed", client.unsubscribed)
+	}
+	client.deliver("home/dog/face", "Sad")
+	cancelB()
+	cancelB()
+	if !reflect.DeepEqual(client.unsubscribed, []string{"home/dog/face"}) {
+		t.Errorf("unsubscribed = %v", client.unsubscribed)
+	}
+	if len(received["a"]) != 1 || len(received["b"]) != 2 {
+		t.Errorf("received = %v", received)
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	client := newFakeClient(false)
+	b := newTestBus(client, "")
+
+	// 连接断开期间只记录订阅，重连成功后订阅
+	if _, err := b.Subscribe("dog/legs", func(string, []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.subscribedTopics(); len(got) != 0 {
+		t.Fatalf("subscribed %v while disconnected", got)
+	}
+	client.connected = true
+	b.resubscribe(client)
+	if got := client.subscribedTopics(); !reflect.DeepEqual(got, []string{"dog/legs"}) {
+		t.Errorf("subscribed after reconnect = %v", got)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	client := newFakeClient(false)
+	b := newTestBus(client, "home")
+
+	if err := b.Publish(context.Background(), "dog/face", "Happy"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Publish while disconnected = %v, want ErrNotConnected", err)
+	}
+	if !errors.Is(b.Health(), ErrNotConnected) {
+		t.Errorf("Health() = %v, want ErrNotConnected", b.Health())
+	}
+
+	client.connected = true
+	if err := b.Publish(context.Background(), "dog/face", "Happy"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(client.published, []string{"home/dog/face"}) {
+		t.Errorf("published = %v", client.published)
+	}
+}
+
+// stubNewBus 让Shared使用connect创建Bus，测试结束后恢复并清空共享的Bus
+func stubNewBus(t *testing.T, connect func(cfg config.Cfg) (*Bus, error)) {
+	t.Helper()
+	previous := newBus
+	newBus = connect
+	t.Cleanup(func() {
+		CloseShared()
+		newBus = previous
+	})
+}
+
+func TestSharedRefCount(t *testing.T) {
+	var connects int
+	var clients []*fakeClient
+	stubNewBus(t, func(cfg config.Cfg) (*Bus, error) {
+		connects++
+		client := newFakeClient(true)
+		clients = append(clients, client)
+		return newTestBus(client, cfg.MQTTTopicPrefix()), nil
+	})
+	cfg := config.New()
+
+	first, err := Shared(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Shared(cfg)
+	if err != nil || second != first || connects != 1 {
+		t.Fatalf("second Shared = %p, %v after %d connects, want the same bus %p", second, err, connects, first)
+	}
+	other, err := Shared(config.New().SetMQTTTopicPrefix("robot2"))
+	if err != nil || other == first || connects != 2 {
+		t.Fatalf("Shared with another prefix = %p, %v after %d connects, want a new bus", other, err, connects)
+	}
+
+	// 最后一次Close才断开连接
+	first.Close()
+	if clients[0].disconnects != 0 {
+		t.Fatal("Close disconnected a bus that is still in use")
+	}
+	second.Close()
+	if clients[0].disconnects != 1 {
+		t.Fatalf("disconnects = %d after the last Close, want 1", clients[0].disconnects)
+	}
+	if clients[1].disconnects != 0 {
+		t.Error("closing one bus disconnected another")
+	}
+
+	// 关闭后再调用Shared重新连接
+	again, err := Shared(cfg)
+	if err != nil || again == first || connects != 3 {
+		t.Errorf("Shared after Close = %p, %v after %d connects, want a new bus", again, err, connects)
+	}
+
+	// CloseShared不论引用计数断开所有Bus
+	CloseShared()
+	if clients[1].disconnects != 1 || clients[2].disconnects != 1 {
+		t.Errorf("disconnects after CloseShared = %d, %d", clients[1].disconnects, clients[2].disconnects)
+	}
+}
+
+func TestSharedConnectsOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	connects := make(map[string]int)
+	stubNewBus(t, func(cfg config.Cfg) (*Bus, error) {
+		mu.Lock()
+		connects[cfg.MQTTTopicPrefix()]++
+		mu.Unlock()
+		if cfg.MQTTTopicPrefix() == "slow" {
+			<-release
+		}
+		return newTestBus(newFakeClient(true), cfg.MQTTTopicPrefix()), nil
+	})
+	slow := config.New().SetMQTTTopicPrefix("slow")
+
+	// 同一配置的并发调用只连接一次，得到同一个Bus
+	const callers = 5
+	buses := make(chan *Bus, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			b, err := Shared(slow)
+			if err != nil {
+				t.Error(err)
+			}
+			buses <- b
+		}()
+	}
+
+	// 连接进行中时其他配置的Shared不被阻塞
+	done := make(chan error, 1)
+	go func() {
+		_, err := Shared(config.New().SetMQTTTopicPrefix("fast"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shared for another config waited for a slow connect")
+	}
+
+	close(release)
+	first := <-buses
+	for i := 1; i < callers; i++ {
+		if b := <-buses; b != first {
+			t.Errorf("callers got different buses %p and %p", first, b)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if connects["slow"] != 1 {
+		t.Errorf("connected %d times, want 1", connects["slow"])
+	}
+}
+
+func TestSharedFailureIsNotCached(t *testing.T) {
+	fail := true
+	stubNewBus(t, func(cfg config.Cfg) (*Bus, error) {
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return newTestBus(newFakeClient(true), ""), nil
+	})
+
+	if _, err := Shared(config.New()); err == nil {
+		t.Fatal("Shared succeeded, want the connect error")
+	}
+	fail = false
+	if b, err := Shared(config.New()); err != nil || b == nil {
+		t.Errorf("Shared after a failed connect = %v, %v, want a retry", b, err)
+	}
+}
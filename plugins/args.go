@@ -0,0 +1,403 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// ArgumentProblem 描述参数中的一处错误，Path为出错的参数路径，例如"command"或"steps[0].delay"
+type ArgumentProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ArgumentError 表示模型给出的参数不符合函数定义
+// 插件返回ArgumentError时，PluginManager会把Problems原样放进响应，方便模型修正参数后重试
+type ArgumentError struct {
+	Function string
+	Problems []ArgumentProblem
+}
+
+func (e *ArgumentError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		if p.Path == "" {
+			problems[i] = p.Message
+		} else {
+			problems[i] = p.Path + ": " + p.Message
+		}
+	}
+	return fmt.Sprintf("invalid arguments for %s: %s", e.Function, strings.Join(problems, "; "))
+}
+
+// Schema 插件参数的JSON Schema，在jsonschema.Definition的基础上增加了数值范围
+// 插件的FunctionDefinition.Parameters可以是Schema、jsonschema.Definition或任何能编码为JSON Schema的值
+type Schema struct {
+	Type                 jsonschema.DataType `json:"type,omitempty"`
+	Description          string              `json:"description,omitempty"`
+	Enum                 []string            `json:"enum,omitempty"`
+	Minimum              *float64            `json:"minimum,omitempty"`
+	Maximum              *float64            `json:"maximum,omitempty"`
+	Properties           map[string]Schema   `json:"properties,omitempty"`
+	Required             []string            `json:"required,omitempty"`
+	Items                *Schema             `json:"items,omitempty"`
+	AdditionalProperties interface{}         `json:"additionalProperties,omitempty"`
+}
+
+// MarshalJSON 对象类型总是输出properties，与jsonschema.Definition一致
+func (s Schema) MarshalJSON() ([]byte, error) {
+	if s.Type == jsonschema.Object && s.Properties == nil {
+		s.Properties = make(map[string]Schema)
+	}
+	type alias Schema
+	return json.Marshal(alias(s))
+}
+
+// schemaCache 缓存按参数类型生成的schema
+var schemaCache sync.Map // reflect.Type -> Schema
+
+// SchemaFor 根据参数结构体生成JSON Schema，结果按类型缓存
+// 字段名按encoding/json的规则取自json标签（标签为"-"的字段被忽略），description标签作为说明，enum标签（逗号分隔）限定取值，
+// minimum和maximum标签限定数值范围；没有omitempty的字段都是必填字段，也可以用required:"false"显式标记为可选
+// 参数结构体包含不支持的类型（map、interface等）或标签写错属于编程错误，SchemaFor会panic
+func SchemaFor[T any]() Schema {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if schema, ok := schemaCache.Load(t); ok {
+		return schema.(Schema)
+	}
+
+	schema, err := schemaForType(t)
+	if err != nil {
+		panic(fmt.Sprintf("plugins: cannot generate schema for %s: %v", t, err))
+	}
+	schemaCache.Store(t, schema)
+	return schema
+}
+
+// schemaForType 根据参数类型生成JSON Schema，不使用缓存
+func schemaForType(t reflect.Type) (Schema, error) {
+	definition, err := jsonschema.GenerateSchemaForType(reflect.New(t).Elem().Interface())
+	if err != nil {
+		return Schema{}, err
+	}
+	schema, err := toSchema(definition)
+	if err != nil {
+		return Schema{}, err
+	}
+	if err := applyTags(t, &schema); err != nil {
+		return Schema{}, err
+	}
+	return schema, nil
+}
+
+// toSchema 将函数定义的Parameters转换为Schema
+func toSchema(parameters interface{}) (Schema, error) {
+	switch p := parameters.(type) {
+	case Schema:
+		return p, nil
+	case *Schema:
+		return *p, nil
+	}
+	b, err := json.Marshal(parameters)
+	if err != nil {
+		return Schema{}, err
+	}
+	var schema Schema
+	err = json.Unmarshal(b, &schema)
+	return schema, err
+}
+
+// jsonField 按encoding/json的规则解析字段的json标签
+// 返回字段在JSON中的名字和是否带有omitempty选项，skip为true表示字段不参与编解码（标签为"-"）
+func jsonField(field reflect.StructField) (name string, omitempty bool, skip bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	for _, option := range strings.Split(options, ",") {
+		if option == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty, false
+}
+
+// generatedName 返回GenerateSchemaForType为字段生成的属性名，它只去掉",omitempty"后缀，不认识其他选项和"-"
+func generatedName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "" {
+		return field.Name
+	}
+	return strings.TrimSuffix(tag, ",omitempty")
+}
+
+// applyTags 补充GenerateSchemaForType不支持的结构体标签，并按encoding/json的规则修正属性名和必填字段
+func applyTags(t reflect.Type, d *Schema) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if d.Items != nil {
+			return applyTags(t.Elem(), d.Items)
+		}
+	case reflect.Struct:
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			property, ok := d.Properties[generatedName(field)]
+			if !ok {
+				continue
+			}
+			delete(d.Properties, generatedName(field))
+			name, omitempty, skip := jsonField(field)
+			if skip {
+				continue
+			}
+			// 没有omitempty的字段是必填字段，required标签可以覆盖
+			isRequired := !omitempty
+			if s := field.Tag.Get("required"); s != "" {
+				isRequired, _ = strconv.ParseBool(s)
+			}
+			if isRequired {
+				required = append(required, name)
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property.Enum = strings.Split(enum, ",")
+			}
+			for tag, bound := range map[string]**float64{"minimum": &property.Minimum, "maximum": &property.Maximum} {
+				if s := field.Tag.Get(tag); s != "" {
+					v, err := strconv.ParseFloat(s, 64)
+					if err != nil {
+						return fmt.Errorf("field %s: invalid %s tag %q", field.Name, tag, s)
+					}
+					*bound = &v
+				}
+			}
+			if err := applyTags(field.Type, &property); err != nil {
+				return err
+			}
+			d.Properties[name] = property
+		}
+		d.Required = required
+	}
+	return nil
+}
+
+// FunctionDefinitionFor 根据参数结构体生成插件的函数定义，使函数定义和参数解码使用同一个结构体
+func FunctionDefinitionFor[T any](name, description string) openai.FunctionDefinition {
+	return openai.FunctionDefinition{
+		Name:        name,
+		Description: description,
+		Parameters:  SchemaFor[T](),
+	}
+}
+
+// ValidateArguments 按函数定义的Parameters校验模型给出的参数
+// 检查JSON格式、类型、必填字段、枚举值和数值范围，不符合时返回*ArgumentError，列出所有问题；
+// Parameters为空或无法解析为JSON Schema时不做检查
+func ValidateArguments(definition openai.FunctionDefinition, jsonInput string) error {
+	if definition.Parameters == nil {
+		return nil
+	}
+	schema, err := toSchema(definition.Parameters)
+	if err != nil {
+		return nil
+	}
+	return validateArguments(definition.Name, schema, jsonInput)
+}
+
+// validateArguments 按schema校验参数
+func validateArguments(function string, schema Schema, jsonInput string) error {
+	if strings.TrimSpace(jsonInput) == "" {
+		jsonInput = "{}"
+	}
+	var data interface{}
+	if err := json.Unmarshal([]byte(jsonInput), &data); err != nil {
+		return &ArgumentError{
+			Function: function,
+			Problems: []ArgumentProblem{{Message: "arguments are not valid JSON: " + err.Error()}},
+		}
+	}
+	if problems := validateValue(schema, data, ""); len(problems) > 0 {
+		return &ArgumentError{Function: function, Problems: problems}
+	}
+	return nil
+}
+
+// BindArguments 按参数结构体的schema校验模型给出的参数，并解码到结构体
+// 参数不符合schema时返回*ArgumentError，列出所有问题
+func BindArguments[T any](function string, jsonInput string) (T, error) {
+	var args T
+	if err := validateArguments(function, SchemaFor[T](), jsonInput); err != nil {
+		return args, err
+	}
+	if strings.TrimSpace(jsonInput) == "" {
+		jsonInput = "{}"
+	}
+	if err := json.Unmarshal([]byte(jsonInput), &args); err != nil {
+		return args, &ArgumentError{
+			Function: function,
+			Problems: []ArgumentProblem{{Message: err.Error()}},
+		}
+	}
+	return args, nil
+}
+
+// CallTyped 校验并解码参数后调用类型化的处理函数
+func CallTyped[T any](ctx context.Context, function string, jsonInput string, handler func(ctx context.Context, args T) (string, error)) (string, error) {
+	args, err := BindArguments[T](function, jsonInput)
+	if err != nil {
+		return "", err
+	}
+	return handler(ctx, args)
+}
+
+// validateValue 按schema检查JSON解码后的值，返回所有问题
+func validateValue(schema Schema, value interface{}, path string) []ArgumentProblem {
+	problem := func(format string, a ...interface{}) []ArgumentProblem {
+		return []ArgumentProblem{{Path: path, Message: fmt.Sprintf(format, a...)}}
+	}
+
+	switch schema.Type {
+	case jsonschema.Object:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return problem("expected an object, got %s", jsonType(value))
+		}
+		var problems []ArgumentProblem
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, ArgumentProblem{Path: joinPath(path, name), Message: "missing required property"})
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties == false {
+					problems = append(problems, ArgumentProblem{Path: joinPath(path, name), Message: "unknown property"})
+				}
+				continue
+			}
+			problems = append(problems, validateValue(property, object[name], joinPath(path, name))...)
+		}
+		return problems
+	case jsonschema.Array:
+		array, ok := value.([]interface{})
+		if !ok {
+			return problem("expected an array, got %s", jsonType(value))
+		}
+		if schema.Items == nil {
+			return nil
+		}
+		var problems []ArgumentProblem
+		for i, item := range array {
+			problems = append(problems, validateValue(*schema.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return problems
+	case jsonschema.String:
+		s, ok := value.(string)
+		if !ok {
+			return problem("expected a string, got %s", jsonType(value))
+		}
+		if len(schema.Enum) > 0 && !containsString(schema.Enum, s) {
+			return problem("%q is not one of %s", s, strings.Join(schema.Enum, ", "))
+		}
+	case jsonschema.Integer:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return problem("expected an integer, got %s", jsonType(value))
+		}
+		return checkRange(schema, n, path)
+	case jsonschema.Number:
+		n, ok := value.(float64)
+		if !ok {
+			return problem("expected a number, got %s", jsonType(value))
+		}
+		return checkRange(schema, n, path)
+	case jsonschema.Boolean:
+		if _, ok := value.(bool); !ok {
+			return problem("expected a boolean, got %s", jsonType(value))
+		}
+	case jsonschema.Null:
+		if value != nil {
+			return problem("expected null, got %s", jsonType(value))
+		}
+	}
+	return nil
+}
+
+// checkRange 检查数值是否在schema的minimum和maximum之间
+func checkRange(schema Schema, n float64, path string) []ArgumentProblem {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	if schema.Minimum != nil && n < *schema.Minimum {
+		return []ArgumentProblem{{Path: path, Message: fmt.Sprintf("%s is less than the minimum %s", format(n), format(*schema.Minimum))}}
+	}
+	if schema.Maximum != nil && n > *schema.Maximum {
+		return []ArgumentProblem{{Path: path, Message: fmt.Sprintf("%s is greater than the maximum %s", format(n), format(*schema.Maximum))}}
+	}
+	return nil
+}
+
+// joinPath 拼接参数路径
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// jsonType 返回JSON值的类型名，用于错误信息
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// containsString 判断字符串是否在列表中
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// moveArgs 测试用的参数结构体，覆盖枚举、数值范围、可选字段和嵌套数组
+type moveArgs struct {
+	Direction string     `json:"direction" enum:"forward,backward"`
+	Speed     int        `json:"speed" minimum:"1" maximum:"10"`
+	Note      string     `json:"note,omitempty"`
+	Steps     []moveStep `json:"steps,omitempty"`
+}
+
+type moveStep struct {
+	Delay float64 `json:"delay" minimum:"0"`
+}
+
+func TestSchemaFor(t *testing.T) {
+	schema := SchemaFor[moveArgs]()
+
+	if schema.Type != jsonschema.Object {
+		t.Fatalf("type = %q, want object", schema.Type)
+	}
+	if !reflect.DeepEqual(schema.Required, []string{"direction", "speed"}) {
+		t.Errorf("required = %v, want [direction speed]", schema.Required)
+	}
+	if got := schema.Properties["direction"].Enum; !reflect.DeepEqual(got, []string{"forward", "backward"}) {
+		t.Errorf("direction enum = %v", got)
+	}
+	speed := schema.Properties["speed"]
+	if speed.Type != jsonschema.Integer || speed.Minimum == nil || *speed.Minimum != 1 || speed.Maximum == nil || *speed.Maximum != 10 {
+		t.Errorf("speed = %+v, want an integer in 1..10", speed)
+	}
+	steps := schema.Properties["steps"]
+	if steps.Items == nil || steps.Items.Properties["delay"].Minimum == nil {
+		t.Errorf("steps[].delay has no minimum: %+v", steps.Items)
+	}
+}
+
+func TestSchemaForBadTag(t *testing.T) {
+	type badArgs struct {
+		Speed int `json:"speed" minimum:"fast"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("SchemaFor did not panic on an invalid minimum tag")
+		}
+	}()
+	SchemaFor[badArgs]()
+}
+
+func TestSchemaForJSONTags(t *testing.T) {
+	tests := []struct {
+		tag          string
+		wantName     string // 为空表示字段不出现在schema中
+		wantRequired bool
+	}{
+		{tag: `json:"speed"`, wantName: "speed", wantRequired: true},
+		{tag: `json:"speed,omitempty"`, wantName: "speed"},
+		{tag: ``, wantName: "Speed", wantRequired: true},
+		{tag: `json:",omitempty"`, wantName: "Speed"},
+		{tag: `json:"-"`},
+		{tag: `json:"-,"`, wantName: "-", wantRequired: true},
+		{tag: `json:"speed,string"`, wantName: "speed", wantRequired: true},
+		{tag: `json:"speed,omitempty,string"`, wantName: "speed"},
+		{tag: `json:"speed,string,omitempty"`, wantName: "speed"},
+		{tag: `json:"speed,omitempty" required:"true"`, wantName: "speed", wantRequired: true},
+		{tag: `json:"speed" required:"false"`, wantName: "speed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			typ := reflect.StructOf([]reflect.StructField{
+				{Name: "Speed", Type: reflect.TypeOf(0), Tag: reflect.StructTag(tt.tag + ` minimum:"1"`)},
+				{Name: "Direction", Type: reflect.TypeOf(""), Tag: `json:"direction"`},
+			})
+			schema, err := schemaForType(typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantProperties := []string{"direction"}
+			wantRequired := []string{"direction"}
+			if tt.wantName != "" {
+				wantProperties = append(wantProperties, tt.wantName)
+				if tt.wantRequired {
+					wantRequired = []string{tt.wantName, "direction"}
+				}
+			}
+			var properties []string
+			for name := range schema.Properties {
+				properties = append(properties, name)
+			}
+			sort.Strings(properties)
+			sort.Strings(wantProperties)
+			if !reflect.DeepEqual(properties, wantProperties) {
+				t.Errorf("properties = %v, want %v", properties, wantProperties)
+			}
+			if !reflect.DeepEqual(schema.Required, wantRequired) {
+				t.Errorf("required = %v, want %v", schema.Required, wantRequired)
+			}
+			// 其他标签作用在修正后的属性上
+			if tt.wantName != "" && schema.Properties[tt.wantName].Minimum == nil {
+				t.Errorf("%s has no minimum", tt.wantName)
+			}
+		})
+	}
+}
+
+// moveArgsCases moveArgs参数的校验用例，problems为nil表示参数有效
+var moveArgsCases = []struct {
+	name     string
+	input    string
+	problems []ArgumentProblem
+}{
+	{name: "valid", input: `{"direction":"forward","speed":3}`},
+	{name: "valid with nested", input: `{"direction":"backward","speed":10,"steps":[{"delay":0.5}]}`},
+	{
+		name:     "not json",
+		input:    `{"direction":`,
+		problems: []ArgumentProblem{{Message: "arguments are not valid JSON: unexpected end of JSON input"}},
+	},
+	{
+		name:  "empty input",
+		input: "",
+		problems: []ArgumentProblem{
+			{Path: "direction", Message: "missing required property"},
+			{Path: "speed", Message: "missing required property"},
+		},
+	},
+	{
+		name:     "enum",
+		input:    `{"direction":"up","speed":3}`,
+		problems: []ArgumentProblem{{Path: "direction", Message: `"up" is not one of forward, backward`}},
+	},
+	{
+		name:     "not an integer",
+		input:    `{"direction":"forward","speed":1.5}`,
+		problems: []ArgumentProblem{{Path: "speed", Message: "expected an integer, got number"}},
+	},
+	{
+		name:     "above maximum",
+		input:    `{"direction":"forward","speed":11}`,
+		problems: []ArgumentProblem{{Path: "speed", Message: "11 is greater than the maximum 10"}},
+	},
+	{
+		name:     "nested below minimum",
+		input:    `{"direction":"forward","speed":1,"steps":[{"delay":1},{"delay":-1}]}`,
+		problems: []ArgumentProblem{{Path: "steps[1].delay", Message: "-1 is less than the minimum 0"}},
+	},
+	{
+		name:     "nested wrong type",
+		input:    `{"direction":"forward","speed":1,"steps":[{"delay":1},{"delay":"soon"}]}`,
+		problems: []ArgumentProblem{{Path: "steps[1].delay", Message: "expected a number, got string"}},
+	},
+	{
+		name:     "wrong type",
+		input:    `{"direction":"forward","speed":1,"note":true}`,
+		problems: []ArgumentProblem{{Path: "note", Message: "expected a string, got boolean"}},
+	},
+}
+
+// checkArgumentError 检查err是否是列出了problems的*ArgumentError
+func checkArgumentError(t *testing.T, err error, problems []ArgumentProblem) {
+	t.Helper()
+	var argErr *ArgumentError
+	if !errors.As(err, &argErr) {
+		t.Fatalf("err = %v, want *ArgumentError", err)
+	}
+	if argErr.Function != "move" {
+		t.Errorf("function = %q, want move", argErr.Function)
+	}
+	if !reflect.DeepEqual(argErr.Problems, problems) {
+		t.Errorf("problems = %+v, want %+v", argErr.Problems, problems)
+	}
+}
+
+func TestBindArguments(t *testing.T) {
+	for _, tt := range moveArgsCases {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := BindArguments[moveArgs]("move", tt.input)
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if args.Direction == "" || args.Speed == 0 {
+					t.Errorf("args = %+v, want decoded values", args)
+				}
+				return
+			}
+			checkArgumentError(t, err, tt.problems)
+		})
+	}
+}
+
+func TestValidateArguments(t *testing.T) {
+	definitions := map[string]openai.FunctionDefinition{
+		"schema": FunctionDefinitionFor[moveArgs]("move", "移动"),
+	}
+	// 插件也可以直接用jsonschema.Definition或JSON描述参数
+	raw, err := json.Marshal(SchemaFor[moveArgs]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	definitions["raw json"] = openai.FunctionDefinition{Name: "move", Parameters: json.RawMessage(raw)}
+
+	for kind, definition := range definitions {
+		for _, tt := range moveArgsCases {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				err := ValidateArguments(definition, tt.input)
+				if tt.problems == nil {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				checkArgumentError(t, err, tt.problems)
+			})
+		}
+	}
+}
+
+func TestValidateArgumentsWithoutParameters(t *testing.T) {
+	if err := ValidateArguments(openai.FunctionDefinition{Name: "free"}, `not json`); err != nil {
+		t.Errorf("definition without parameters should not be checked: %v", err)
+	}
+}
+
+// movePlugin 使用moveArgs作为参数的测试插件
+type movePlugin struct {
+	recordPlugin
+}
+
+func (p *movePlugin) FunctionDefinition() openai.FunctionDefinition {
+	return FunctionDefinitionFor[moveArgs]("move", "移动")
+}
+
+func TestCallPluginContextValidatesArguments(t *testing.T) {
+	p := &movePlugin{recordPlugin{id: "move"}}
+	pm := newTestManager(p)
+
+	output, err := pm.CallPluginContext(context.Background(), "move", `{"direction":"up","speed":3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp PluginResponse
+	if err := json.Unmarshal([]byte(output), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []ArgumentProblem{{Path: "direction", Message: `"up" is not one of forward, backward`}}
+	if resp.Error == "" || !reflect.DeepEqual(resp.InvalidArguments, want) {
+		t.Errorf("response = %+v, want invalid arguments %+v", resp, want)
+	}
+	if len(p.inputs) != 0 {
+		t.Errorf("plugin was called with invalid arguments: %v", p.inputs)
+	}
+
+	if _, err := pm.CallPluginContext(context.Background(), "move", `{"direction":"forward","speed":3}`); err != nil || len(p.inputs) != 1 {
+		t.Errorf("valid call: err = %v, plugin inputs = %v", err, p.inputs)
+	}
+}
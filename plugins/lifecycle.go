@@ -0,0 +1,155 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 关闭单个插件的默认超时时间
+const shutdownTimeout = 10 * time.Second
+
+// loadCandidate 已打开但尚未初始化的插件
+type loadCandidate struct {
+	path     string // 插件文件路径，编译期注册的插件为空
+	name     string // 打开失败时用于报告的插件名
+	plugin   Plugin
+	err      error
+	duration time.Duration // 打开插件的耗时
+}
+
+// id 返回候选插件的ID，打开失败时返回文件名推断出的插件名
+func (c *loadCandidate) id() string {
+	if c.plugin != nil {
+		return c.plugin.ID()
+	}
+	return c.name
+}
+
+// initCandidates 按依赖关系依次初始化候选插件，返回与初始化顺序一致的加载结果
+func (pm *PluginManager) initCandidates(candidates []*loadCandidate) []LoadResult {
+	var results []LoadResult
+	for _, c := range sortByDependencies(candidates) {
+		start := time.Now()
+		err := c.err
+		if err == nil {
+			err = pm.initPlugin(c.plugin, c.path)
+		} else if c.plugin != nil {
+			// 已打开但因循环依赖等原因不能初始化的插件
+			pm.discard(c.plugin)
+		}
+		result := LoadResult{
+			Path:     c.path,
+			ID:       c.id(),
+			Required: pm.isRequired(c.id()),
+			Err:      err,
+			Duration: c.duration + time.Since(start),
+		}
+		pm.recordStatus(result)
+		results = append(results, result)
+	}
+	return results
+}
+
+// sortByDependencies 将候选插件排序，使每个插件排在它依赖的插件之后，其余保持原有顺序
+// 循环依赖中的插件会被标记为失败
+func sortByDependencies(candidates []*loadCandidate) []*loadCandidate {
+	index := make(map[string]int)
+	for i, c := range candidates {
+		if c.err == nil {
+			index[c.plugin.ID()] = i
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(candidates))
+	ordered := make([]*loadCandidate, 0, len(candidates))
+	var visit func(i int)
+	visit = func(i int) {
+		switch state[i] {
+		case visiting:
+			candidates[i].err = fmt.Errorf("plugin %s has a circular dependency", candidates[i].id())
+			return
+		case visited:
+			return
+		}
+		state[i] = visiting
+		if dp, ok := candidates[i].plugin.(DependentPlugin); ok && candidates[i].err == nil {
+			for _, dep := range dp.Dependencies() {
+				if j, ok := index[dep]; ok {
+					visit(j)
+				}
+			}
+		}
+		state[i] = visited
+		ordered = append(ordered, candidates[i])
+	}
+	for i := range candidates {
+		visit(i)
+	}
+	return ordered
+}
+
+// removeID 返回去掉id之后的切片
+func removeID(ids []string, id string) []string {
+	result := ids[:0:0]
+	for _, existing := range ids {
+		if existing != id {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
+
+// shutdownPlugin 调用插件的Shutdown，插件未实现ShutdownPlugin时什么也不做
+func shutdownPlugin(ctx context.Context, p Plugin) error {
+	sp, ok := p.(ShutdownPlugin)
+	if !ok {
+		return nil
+	}
+	return catchPanic(func() error { return sp.Shutdown(ctx) })
+}
+
+// Close 按初始化的相反顺序关闭所有插件，并清空已加载的插件
+// 每个插件的Shutdown最多等待10秒
+func (pm *PluginManager) Close() error {
+	pm.mu.Lock()
+	order := pm.order
+	loaded := pm.loadedPlugins
+	pm.order = nil
+	pm.loadedPlugins = make(map[string]Plugin)
+	pm.sources = make(map[string]string)
+	pm.version++
+	pm.mu.Unlock()
+
+	var errs []error
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		pm.markUnloaded(id)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := shutdownPlugin(ctx, loaded[id])
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutdown plugin %s: %w", id, err))
+		} else {
+			fmt.Printf("插件%s已关闭\n", id)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health 检查所有实现了HealthPlugin的已加载插件，返回插件ID到检查结果的映射，nil表示正常
+func (pm *PluginManager) Health() map[string]error {
+	health := make(map[string]error)
+	for id, p := range pm.GetAllPlugins() {
+		if hp, ok := p.(HealthPlugin); ok {
+			health[id] = catchPanic(hp.Health)
+		}
+	}
+	return health
+}
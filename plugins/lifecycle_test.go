@@ -0,0 +1,150 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// lifecycleLog 记录插件Init和Shutdown的顺序
+type lifecycleLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *lifecycleLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// lifecyclePlugin 声明依赖并记录生命周期事件的测试插件
+type lifecyclePlugin struct {
+	recordPlugin
+	log     *lifecycleLog
+	deps    []string
+	initErr error
+	health  error
+}
+
+func (p *lifecyclePlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
+	p.log.add("init " + p.id)
+	return p.initErr
+}
+
+func (p *lifecyclePlugin) Dependencies() []string { return p.deps }
+func (p *lifecyclePlugin) Health() error          { return p.health }
+
+func (p *lifecyclePlugin) Shutdown(ctx context.Context) error {
+	p.log.add("shutdown " + p.id)
+	return nil
+}
+
+func TestLifecycle(t *testing.T) {
+	log := &lifecycleLog{}
+	register := func(id string, deps []string, initErr, health error) {
+		Register(id, func() Plugin {
+			return &lifecyclePlugin{recordPlugin: recordPlugin{id: id}, log: log, deps: deps, initErr: initErr, health: health}
+		})
+	}
+	register("lc_app", []string{"lc_db", "lc_bus"}, nil, nil)
+	register("lc_db", []string{"lc_bus"}, nil, errors.New("disk full"))
+	register("lc_bus", nil, nil, nil)
+	register("lc_x", []string{"lc_y"}, nil, nil)
+	register("lc_y", []string{"lc_x"}, nil, nil)
+	register("lc_orphan", []string{"lc_none"}, nil, nil)
+	register("lc_broken", nil, errors.New("bad config"), nil)
+	register("lc_web", []string{"lc_broken"}, nil, nil)
+
+	pm := newTestManager()
+	report := pm.LoadRegisteredReport("lc_app", "lc_db", "lc_bus", "lc_x", "lc_y", "lc_orphan", "lc_broken", "lc_web")
+
+	errs := make(map[string]string)
+	for _, result := range report.Results {
+		if result.Err != nil {
+			errs[result.ID] = result.Err.Error()
+		}
+	}
+	wantErrs := map[string]string{
+		"lc_x":      "circular dependency",
+		"lc_y":      "depends on lc_x",
+		"lc_orphan": "depends on lc_none",
+		"lc_broken": "bad config",
+		"lc_web":    "depends on lc_broken",
+	}
+	if len(errs) != len(wantErrs) {
+		t.Errorf("errors = %v, want failures for %v", errs, wantErrs)
+	}
+	for id, want := range wantErrs {
+		if !strings.Contains(errs[id], want) {
+			t.Errorf("plugin %s error = %q, want %q", id, errs[id], want)
+		}
+	}
+
+	// 依赖先于依赖它的插件初始化，Init失败和因依赖问题被拒绝的插件都会被Shutdown
+	wantInit := []string{
+		"init lc_bus", "init lc_db", "init lc_app",
+		"shutdown lc_y", "shutdown lc_x", "shutdown lc_orphan",
+		"init lc_broken", "shutdown lc_broken", "shutdown lc_web",
+	}
+	if !reflect.DeepEqual(log.events, wantInit) {
+		t.Errorf("events = %v, want %v", log.events, wantInit)
+	}
+
+	health := pm.Health()
+	if len(health) != 3 || health["lc_bus"] != nil || health["lc_db"] == nil {
+		t.Errorf("Health() = %v", health)
+	}
+
+	// Close按初始化的相反顺序关闭插件
+	log.events = nil
+	if err := pm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wantClose := []string{"shutdown lc_app", "shutdown lc_db", "shutdown lc_bus"}
+	if !reflect.DeepEqual(log.events, wantClose) {
+		t.Errorf("events = %v, want %v", log.events, wantClose)
+	}
+	if len(pm.GetAllPlugins()) != 0 {
+		t.Errorf("plugins still loaded after Close: %v", pm.GetAllPlugins())
+	}
+	if status, _ := pm.PluginStatus("lc_app"); status.State != PluginUnloaded {
+		t.Errorf("lc_app state = %s, want %s", status.State, PluginUnloaded)
+	}
+}
+
+func TestSortByDependencies(t *testing.T) {
+	candidate := func(id string, deps ...string) *loadCandidate {
+		return &loadCandidate{name: id, plugin: &lifecyclePlugin{recordPlugin: recordPlugin{id: id}, deps: deps}}
+	}
+	failed := &loadCandidate{name: "failed", err: errors.New("open failed")}
+
+	tests := []struct {
+		name       string
+		candidates []*loadCandidate
+		want       []string
+	}{
+		{name: "independent keep order", candidates: []*loadCandidate{candidate("a"), candidate("b")}, want: []string{"a", "b"}},
+		{name: "dependency first", candidates: []*loadCandidate{candidate("a", "b"), candidate("b")}, want: []string{"b", "a"}},
+		{name: "chain", candidates: []*loadCandidate{candidate("a", "b"), candidate("b", "c"), candidate("c")}, want: []string{"c", "b", "a"}},
+		{name: "dependency outside the batch", candidates: []*loadCandidate{candidate("a", "z"), candidate("b")}, want: []string{"a", "b"}},
+		{name: "failed candidate", candidates: []*loadCandidate{candidate("a", "failed"), failed}, want: []string{"a", "failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range sortByDependencies(tt.candidates) {
+				got = append(got, c.id())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
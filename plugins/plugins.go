@@ -1,15 +1,20 @@
 package plugins
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"plugin"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
 )
 
 // Plugin接口定义了所有插件必须实现的方法
@@ -21,15 +26,99 @@ type Plugin interface {
 	Execute(string) (string, error)
 }
 
+// ContextPlugin是可选接口，实现它的插件可以感知取消和超时
+// PluginManager在调用插件时会优先使用ExecuteContext
+type ContextPlugin interface {
+	Plugin
+	ExecuteContext(ctx context.Context, jsonInput string) (string, error)
+}
+
+// TimeoutPlugin是可选接口，插件可以通过它声明自己的默认执行超时时间
+type TimeoutPlugin interface {
+	DefaultTimeout() time.Duration
+}
+
+// ConcurrentPlugin是可选接口，ConcurrentSafe返回true表示同一插件允许被并发调用
+// 未实现该接口的插件在同一批调用中按顺序执行
+type ConcurrentPlugin interface {
+	ConcurrentSafe() bool
+}
+
+// MultiFunctionPlugin是可选接口，插件通过它提供多个工具，每个工具有独立的名称和参数定义
+// 实现该接口的插件按FunctionDefinitions生成工具，模型调用其中的工具时PluginManager调用ExecuteFunction；
+// 按插件ID调用且ID不是任何工具名时仍然调用Execute，FunctionDefinition不再用于生成工具
+type MultiFunctionPlugin interface {
+	FunctionDefinitions() []openai.FunctionDefinition
+	ExecuteFunction(ctx context.Context, name string, jsonInput string) (string, error)
+}
+
+// ShutdownPlugin是可选接口，插件在Shutdown中关闭Init时打开的连接等资源
+// PluginManager.Close按初始化的相反顺序调用Shutdown
+type ShutdownPlugin interface {
+	Shutdown(ctx context.Context) error
+}
+
+// HealthPlugin是可选接口，Health返回nil表示插件可以正常工作
+type HealthPlugin interface {
+	Health() error
+}
+
+// InitContext 插件初始化时可以使用的配置、客户端和共享服务
+type InitContext struct {
+	Cfg          config.Cfg
+	OpenaiClient *openai.Client
+	bus          func() (*mqttbus.Bus, error)
+}
+
+// Bus 返回共享的MQTT总线，第一次调用时建立连接
+// 插件管理器设置了总线时使用该总线，否则使用按配置共享的总线
+func (ictx InitContext) Bus() (*mqttbus.Bus, error) {
+	if ictx.bus != nil {
+		return ictx.bus()
+	}
+	return mqttbus.Shared(ictx.Cfg)
+}
+
+// InitContextPlugin是可选接口，需要共享服务（例如MQTT总线）的插件实现它
+// PluginManager会调用InitWithContext代替Init
+type InitContextPlugin interface {
+	InitWithContext(ictx InitContext) error
+}
+
+// DependentPlugin是可选接口，Dependencies返回插件依赖的其他插件ID
+// 同一批加载的插件按依赖关系初始化，依赖未加载的插件会加载失败
+type DependentPlugin interface {
+	Dependencies() []string
+}
+
+// PluginCall 描述一次插件调用，用于批量执行模型在同一轮中请求的多个工具
+type PluginCall struct {
+	ID    string // 工具名或插件ID
+	Input string
+}
+
+// DefaultPluginTimeout 插件未声明超时时间时使用的默认值
+const DefaultPluginTimeout = 30 * time.Second
+
 // PluginResponse结构体用于封装插件执行的响应
 type PluginResponse struct {
-	Error  string `json:"error,omitempty"`
-	Result string `json:"result,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	InvalidArguments []ArgumentProblem `json:"invalid_arguments,omitempty"` // 参数校验失败时列出每处错误
+	Result           string            `json:"result,omitempty"`
 }
 
 // PluginManager 管理插件的加载和调用
 type PluginManager struct {
+	mu            sync.RWMutex // 保护loadedPlugins、timeouts、sources和version
 	loadedPlugins map[string]Plugin
+	timeouts      map[string]time.Duration // 按插件ID覆盖的执行超时时间
+	sources       map[string]string        // 插件文件路径 -> 插件ID，用于热加载
+	status        map[string]*PluginStatus // 插件文件路径或注册插件ID -> 插件状态
+	version       uint64                   // 已加载插件每次变化时递增
+	order         []string                 // 插件的初始化顺序，Close时按相反顺序关闭
+	bus           *mqttbus.Bus             // 注入插件的MQTT总线，为nil时使用按配置共享的总线
+	policy        config.ToolPolicy        // 工具权限规则
+	confirmer     Confirmer                // 需要确认的工具调用使用的Confirmer
 	cfg           config.Cfg
 	openaiClient  *openai.Client
 }
@@ -38,75 +127,196 @@ type PluginManager struct {
 func NewPluginManager(cfg config.Cfg, openaiClient *openai.Client) *PluginManager {
 	return &PluginManager{
 		loadedPlugins: make(map[string]Plugin),
+		timeouts:      make(map[string]time.Duration),
+		sources:       make(map[string]string),
+		status:        make(map[string]*PluginStatus),
 		cfg:           cfg,
 		openaiClient:  openaiClient,
 	}
 }
 
-// LoadPlugins 加载指定目录下的所有插件
+// LoadPlugins 加载指定目录下的所有插件，包括.so插件和子进程插件的清单（*.plugin.json）
+// 目录不存在时视为没有.so插件，便于只使用编译期注册插件的静态构建
+// 单个插件加载失败时继续加载其余插件，返回所有失败插件的错误；需要逐个插件的结果时使用LoadPluginsReport
 func (pm *PluginManager) LoadPlugins(compiledDir string) error {
+	report, err := pm.LoadPluginsReport(compiledDir)
+	if err != nil {
+		return err
+	}
+	return report.Err()
+}
+
+// pluginDir 返回插件目录的路径，插件目录相对于本文件所在的目录
+func pluginDir(compiledDir string) (string, error) {
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
-		return fmt.Errorf("cannot get current file path")
+		return "", fmt.Errorf("cannot get current file path")
 	}
+	return filepath.Dir(filename) + "/" + compiledDir, nil
+}
+
+// isPluginFile 判断文件是否是.so插件或子进程插件的清单
+func isPluginFile(name string) bool {
+	return filepath.Ext(name) == ".so" || strings.HasSuffix(name, ManifestSuffix)
+}
 
-	files, err := os.ReadDir(filepath.Dir(filename) + "/" + compiledDir)
+// loadFile 加载并初始化一个插件文件
+func (pm *PluginManager) loadFile(path string) error {
+	p, err := pm.openFile(path)
 	if err != nil {
 		return err
 	}
+	return pm.initPlugin(p, path)
+}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".so" {
-			err := pm.loadSinglePlugin(filepath.Dir(filename) + "/" + compiledDir + "/" + file.Name())
-			if err != nil {
-				return err
+// openFile 根据文件类型打开.so插件或启动子进程插件，不调用Init
+// 子进程插件在启动时就用插件管理器的配置完成了进程内的初始化
+func (pm *PluginManager) openFile(path string) (Plugin, error) {
+	if isManifest(path) {
+		return loadProcessPlugin(path, pm.cfg)
+	}
+	return openSharedObject(path)
+}
+
+// initPlugin 检查插件的依赖并调用Init，成功后加入已加载插件
+// 任何一步失败时都调用插件的Shutdown释放已占用的资源，例如openFile已经启动的子进程
+func (pm *PluginManager) initPlugin(p Plugin, source string) (err error) {
+	defer func() {
+		if err != nil {
+			pm.discard(p)
+		}
+	}()
+
+	if err := pm.checkFunctionNames(p); err != nil {
+		return err
+	}
+	if dp, ok := p.(DependentPlugin); ok {
+		for _, dep := range dp.Dependencies() {
+			if !pm.IsPluginLoaded(dep) {
+				return fmt.Errorf("plugin %s depends on %s, which is not loaded", p.ID(), dep)
 			}
 		}
 	}
-
+	if err := catchPanic(func() error { return initWithContext(p, pm.initContext()) }); err != nil {
+		return err
+	}
+	pm.addPlugin(p, source)
 	return nil
 }
 
-// loadSinglePlugin 加载单个插件
-func (pm *PluginManager) loadSinglePlugin(path string) error {
+// discard 关闭已打开但没有加载成功的插件
+// 同一个.so被再次打开时得到的是已加载的同一个实例，这种情况下不关闭
+func (pm *PluginManager) discard(p Plugin) {
+	pm.mu.RLock()
+	loaded := pm.loadedPlugins[p.ID()] == p
+	pm.mu.RUnlock()
+	if loaded {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdownPlugin(ctx, p)
+}
+
+// initWithContext 插件实现了InitContextPlugin时调用InitWithContext，否则调用Init
+func initWithContext(p Plugin, ictx InitContext) error {
+	if ip, ok := p.(InitContextPlugin); ok {
+		return ip.InitWithContext(ictx)
+	}
+	return p.Init(ictx.Cfg, ictx.OpenaiClient)
+}
+
+// initContext 返回传给插件的InitContext
+func (pm *PluginManager) initContext() InitContext {
+	return InitContext{Cfg: pm.cfg, OpenaiClient: pm.openaiClient, bus: pm.Bus}
+}
+
+// SetBus 设置注入插件的MQTT总线，需要在加载插件之前调用
+func (pm *PluginManager) SetBus(bus *mqttbus.Bus) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.bus = bus
+}
+
+// Bus 返回注入插件的MQTT总线，未设置时返回按配置共享的总线
+func (pm *PluginManager) Bus() (*mqttbus.Bus, error) {
+	pm.mu.RLock()
+	bus := pm.bus
+	pm.mu.RUnlock()
+	if bus != nil {
+		return bus, nil
+	}
+	return mqttbus.Shared(pm.cfg)
+}
+
+// addPlugin 将初始化完成的插件加入已加载插件，source为插件文件路径，编译期注册的插件为空
+func (pm *PluginManager) addPlugin(p Plugin, source string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.loadedPlugins[p.ID()] = p
+	if source != "" {
+		pm.sources[source] = p.ID()
+	}
+	pm.order = append(removeID(pm.order, p.ID()), p.ID())
+	pm.version++
+}
+
+// openSharedObject 打开单个.so插件
+func openSharedObject(path string) (Plugin, error) {
 	plug, err := plugin.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	symbol, err := plug.Lookup("Plugin")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	p, ok := symbol.(*Plugin)
 	if !ok {
-		return fmt.Errorf("unexpected type from module symbol: %s", path)
+		return nil, fmt.Errorf("unexpected type from module symbol: %s", path)
 	}
 
-	err = (*p).Init(pm.cfg, pm.openaiClient)
-	if err != nil {
-		return err
-	}
-
-	pm.loadedPlugins[(*p).ID()] = *p
-	return nil
+	return *p, nil
 }
 
 // CallPlugin 通过ID查找并执行插件
 func (pm *PluginManager) CallPlugin(id string, jsonInput string) (string, error) {
+	return pm.CallPluginContext(context.Background(), id, jsonInput)
+}
+
+// CallPluginContext 按工具名或插件ID查找并执行插件，执行受ctx和插件超时时间的约束
+// 执行前按工具的函数定义校验参数，并按权限策略检查或请求确认，校验或检查失败的调用不会传给插件
+// 插件超时会作为错误信息返回给模型；ctx本身被取消时直接返回ctx的错误
+func (pm *PluginManager) CallPluginContext(ctx context.Context, id string, jsonInput string) (string, error) {
 	response := PluginResponse{}
 
-	plugin, exists := pm.GetPluginByID(id)
+	plugin, definition, function, exists := pm.resolveTool(id)
 	if !exists {
 		response.Error = fmt.Sprintf("plugin with ID %s not found", id)
 		jsonResponse, err := json.Marshal(response)
 		return string(jsonResponse), err
 	}
 
-	result, err := plugin.Execute(jsonInput)
+	// 参数不符合函数定义时不调用插件，把每处错误返回给模型以便修正后重试
+	result, err := "", ValidateArguments(definition, jsonInput)
+	if err == nil {
+		// 被权限策略禁止或被用户拒绝的调用同样作为错误信息返回给模型
+		err = pm.authorize(ctx, plugin, definition.Name, jsonInput)
+	}
+	if err == nil {
+		result, err = pm.executePlugin(ctx, plugin, function, jsonInput)
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	if err != nil {
 		response.Error = err.Error()
+		var argErr *ArgumentError
+		if errors.As(err, &argErr) {
+			response.InvalidArguments = argErr.Problems
+		}
 	} else {
 		response.Result = result
 	}
@@ -119,33 +329,253 @@ func (pm *PluginManager) CallPlugin(id string, jsonInput string) (string, error)
 	return string(jsonResponse), nil
 }
 
+// resolveTool 按工具名查找插件，返回工具的函数定义；function为多函数插件中被调用的函数名，其余情况为空
+// 名称不是任何工具名时按插件ID查找，兼容按插件ID调用的代码
+func (pm *PluginManager) resolveTool(name string) (p Plugin, definition openai.FunctionDefinition, function string, ok bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if p, ok := pm.loadedPlugins[name]; ok {
+		if _, multi := p.(MultiFunctionPlugin); !multi {
+			return p, p.FunctionDefinition(), "", true
+		}
+	}
+	for _, id := range pm.order {
+		p := pm.loadedPlugins[id]
+		mf, multi := p.(MultiFunctionPlugin)
+		if !multi {
+			if def := p.FunctionDefinition(); def.Name == name {
+				return p, def, "", true
+			}
+			continue
+		}
+		for _, def := range mf.FunctionDefinitions() {
+			if def.Name == name {
+				return p, def, name, true
+			}
+		}
+	}
+	if p, ok := pm.loadedPlugins[name]; ok {
+		return p, p.FunctionDefinition(), "", true
+	}
+	return nil, openai.FunctionDefinition{}, "", false
+}
+
+// HasTool 检查是否有已加载的插件提供指定名称的工具，名称也可以是插件ID
+func (pm *PluginManager) HasTool(name string) bool {
+	_, _, _, ok := pm.resolveTool(name)
+	return ok
+}
+
+// functionDefinitions 返回插件提供的全部函数定义
+func functionDefinitions(p Plugin) []openai.FunctionDefinition {
+	if mf, ok := p.(MultiFunctionPlugin); ok {
+		return mf.FunctionDefinitions()
+	}
+	return []openai.FunctionDefinition{p.FunctionDefinition()}
+}
+
+// checkFunctionNames 检查插件的工具名是否与其他已加载插件的工具名重复
+func (pm *PluginManager) checkFunctionNames(p Plugin) error {
+	owners := make(map[string]string)
+	for id, loaded := range pm.GetAllPlugins() {
+		if id == p.ID() {
+			continue
+		}
+		for _, def := range functionDefinitions(loaded) {
+			owners[def.Name] = id
+		}
+	}
+	seen := make(map[string]bool)
+	for _, def := range functionDefinitions(p) {
+		if owner, ok := owners[def.Name]; ok {
+			return fmt.Errorf("tool %s of plugin %s is already provided by plugin %s", def.Name, p.ID(), owner)
+		}
+		if seen[def.Name] {
+			return fmt.Errorf("plugin %s defines tool %s more than once", p.ID(), def.Name)
+		}
+		seen[def.Name] = true
+	}
+	return nil
+}
+
+// executePlugin 在超时时间内执行插件，function不为空时调用多函数插件的ExecuteFunction
+// 不支持context的插件在后台goroutine中执行，超时后调用方不再等待其结果
+func (pm *PluginManager) executePlugin(ctx context.Context, plugin Plugin, function string, jsonInput string) (string, error) {
+	timeout := pm.PluginTimeout(plugin.ID())
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if mf, ok := plugin.(MultiFunctionPlugin); ok && function != "" {
+		result, err := mf.ExecuteFunction(execCtx, function, jsonInput)
+		if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("plugin %s timed out after %v", plugin.ID(), timeout)
+		}
+		return result, err
+	}
+	if cp, ok := plugin.(ContextPlugin); ok {
+		result, err := cp.ExecuteContext(execCtx, jsonInput)
+		if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("plugin %s timed out after %v", plugin.ID(), timeout)
+		}
+		return result, err
+	}
+
+	type executeResult struct {
+		result string
+		err    error
+	}
+	done := make(chan executeResult, 1)
+	go func() {
+		result, err := plugin.Execute(jsonInput)
+		done <- executeResult{result, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-execCtx.Done():
+		if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("plugin %s timed out after %v", plugin.ID(), timeout)
+		}
+		return "", execCtx.Err()
+	}
+}
+
+// CallPluginsContext 批量执行插件调用，返回的结果与calls按下标一一对应
+// 不同插件之间并发执行；同一插件只有在声明ConcurrentSafe时才并发，否则按calls中的顺序执行
+func (pm *PluginManager) CallPluginsContext(ctx context.Context, calls []PluginCall) ([]string, error) {
+	results := make([]string, len(calls))
+	errs := make([]error, len(calls))
+
+	// 按插件ID分组，组内保持原始顺序；同一插件的不同工具属于同一组
+	var order []string
+	groups := make(map[string][]int)
+	for i, call := range calls {
+		id := call.ID
+		if p, _, _, ok := pm.resolveTool(call.ID); ok {
+			id = p.ID()
+		}
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], i)
+	}
+
+	var wg sync.WaitGroup
+	run := func(i int) {
+		results[i], errs[i] = pm.CallPluginContext(ctx, calls[i].ID, calls[i].Input)
+	}
+	for _, id := range order {
+		indexes := groups[id]
+		if pm.isConcurrentSafe(id) {
+			for _, i := range indexes {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					run(i)
+				}(i)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			for _, i := range indexes {
+				run(i)
+			}
+		}(indexes)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// isConcurrentSafe 判断插件是否允许并发调用
+func (pm *PluginManager) isConcurrentSafe(id string) bool {
+	p, ok := pm.GetPluginByID(id)
+	if !ok {
+		return false
+	}
+	cp, ok := p.(ConcurrentPlugin)
+	return ok && cp.ConcurrentSafe()
+}
+
+// SetPluginTimeout 覆盖指定插件的执行超时时间，d<=0时恢复为插件的默认值
+func (pm *PluginManager) SetPluginTimeout(id string, d time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if d <= 0 {
+		delete(pm.timeouts, id)
+		return
+	}
+	pm.timeouts[id] = d
+}
+
+// PluginTimeout 返回指定插件的执行超时时间
+// 优先级：SetPluginTimeout的设置 > 插件声明的DefaultTimeout > DefaultPluginTimeout
+func (pm *PluginManager) PluginTimeout(id string) time.Duration {
+	pm.mu.RLock()
+	d, ok := pm.timeouts[id]
+	pm.mu.RUnlock()
+	if ok {
+		return d
+	}
+	if p, ok := pm.GetPluginByID(id); ok {
+		if tp, ok := p.(TimeoutPlugin); ok && tp.DefaultTimeout() > 0 {
+			return tp.DefaultTimeout()
+		}
+	}
+	return DefaultPluginTimeout
+}
+
 // IsPluginLoaded 检查指定ID的插件是否已加载
 func (pm *PluginManager) IsPluginLoaded(id string) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 	_, exists := pm.loadedPlugins[id]
 	return exists
 }
 
 // GetPluginByID 通过ID获取插件
 func (pm *PluginManager) GetPluginByID(id string) (Plugin, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 	p, exists := pm.loadedPlugins[id]
 	return p, exists
 }
 
-// GetAllPlugins 返回所有已加载的插件
+// GetAllPlugins 返回所有已加载插件的副本
 func (pm *PluginManager) GetAllPlugins() map[string]Plugin {
-	return pm.loadedPlugins
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	all := make(map[string]Plugin, len(pm.loadedPlugins))
+	for id, p := range pm.loadedPlugins {
+		all[id] = p
+	}
+	return all
 }
 
+// GenerateOpenAItoolsDefinition 按插件的初始化顺序生成工具列表，多函数插件的每个函数是一个工具
 func (pm *PluginManager) GenerateOpenAItoolsDefinition() []openai.Tool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 	var tools []openai.Tool
 
-	for _, plugin := range pm.loadedPlugins {
-		functionDef := plugin.FunctionDefinition()
-		tool := openai.Tool{
-			Type:     openai.ToolTypeFunction,
-			Function: &functionDef,  // 直接构建 Tool 结构体
+	for _, id := range pm.order {
+		for _, functionDef := range functionDefinitions(pm.loadedPlugins[id]) {
+			functionDef := functionDef
+			tool := openai.Tool{
+				Type:     openai.ToolTypeFunction,
+				Function: &functionDef, // 直接构建 Tool 结构体
+			}
+			tools = append(tools, tool)
 		}
-		tools = append(tools, tool)
 	}
 
 	return tools
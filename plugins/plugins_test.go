@@ -0,0 +1,339 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// recordPlugin 记录调用顺序和最大并发数的测试插件，返回值是输入本身
+type recordPlugin struct {
+	id         string
+	delay      time.Duration
+	concurrent bool
+
+	mu      sync.Mutex
+	running int
+	peak    int
+	inputs  []string
+}
+
+func (p *recordPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error { return nil }
+func (p *recordPlugin) ID() string                                             { return p.id }
+func (p *recordPlugin) Description() string                                    { return "测试插件" }
+func (p *recordPlugin) ConcurrentSafe() bool                                   { return p.concurrent }
+
+func (p *recordPlugin) FunctionDefinition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{Name: p.id}
+}
+
+func (p *recordPlugin) Execute(jsonInput string) (string, error) {
+	p.mu.Lock()
+	p.running++
+	p.peak = max(p.peak, p.running)
+	p.inputs = append(p.inputs, jsonInput)
+	p.mu.Unlock()
+
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	return jsonInput, nil
+}
+
+// newTestManager 创建已加载指定插件的PluginManager
+func newTestManager(ps ...Plugin) *PluginManager {
+	pm := NewPluginManager(config.Cfg{}, nil)
+	for _, p := range ps {
+		pm.addPlugin(p, "")
+	}
+	return pm
+}
+
+func TestCallPluginsContext(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		concurrent bool
+		calls      []PluginCall
+		wantPeak   map[string]int // 每个插件的最大并发数
+		maxElapsed time.Duration
+	}{
+		{
+			name:     "same plugin runs in order",
+			calls:    []PluginCall{{ID: "a", Input: "1"}, {ID: "a", Input: "2"}, {ID: "a", Input: "3"}},
+			wantPeak: map[string]int{"a": 1},
+		},
+		{
+			name:       "concurrent-safe plugin runs in parallel",
+			concurrent: true,
+			calls:      []PluginCall{{ID: "a", Input: "1"}, {ID: "a", Input: "2"}, {ID: "a", Input: "3"}},
+			wantPeak:   map[string]int{"a": 3},
+			maxElapsed: 2 * delay,
+		},
+		{
+			name:       "different plugins run in parallel",
+			calls:      []PluginCall{{ID: "a", Input: "1"}, {ID: "b", Input: "2"}, {ID: "a", Input: "3"}, {ID: "b", Input: "4"}},
+			wantPeak:   map[string]int{"a": 1, "b": 1},
+			maxElapsed: 3 * delay,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &recordPlugin{id: "a", delay: delay, concurrent: tt.concurrent}
+			b := &recordPlugin{id: "b", delay: delay, concurrent: tt.concurrent}
+			pm := newTestManager(a, b)
+
+			start := time.Now()
+			results, err := pm.CallPluginsContext(context.Background(), tt.calls)
+			elapsed := time.Since(start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, call := range tt.calls {
+				var resp PluginResponse
+				if err := json.Unmarshal([]byte(results[i]), &resp); err != nil || resp.Result != call.Input {
+					t.Errorf("results[%d] = %s, want result %q", i, results[i], call.Input)
+				}
+			}
+			for _, p := range []*recordPlugin{a, b} {
+				if want := tt.wantPeak[p.id]; p.peak != want {
+					t.Errorf("plugin %s peak concurrency = %d, want %d", p.id, p.peak, want)
+				}
+				if !tt.concurrent {
+					// 不能并发的插件按calls中的顺序执行
+					var want []string
+					for _, call := range tt.calls {
+						if call.ID == p.id {
+							want = append(want, call.Input)
+						}
+					}
+					if len(p.inputs) != len(want) {
+						t.Fatalf("plugin %s inputs = %v, want %v", p.id, p.inputs, want)
+					}
+					for i := range want {
+						if p.inputs[i] != want[i] {
+							t.Errorf("plugin %s inputs = %v, want %v", p.id, p.inputs, want)
+							break
+						}
+					}
+				}
+			}
+			if tt.maxElapsed > 0 && elapsed > tt.maxElapsed {
+				t.Errorf("calls took %v, want at most %v", elapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
+
+func TestCallPluginsContextUnknownPlugin(t *testing.T) {
+	pm := newTestManager(&recordPlugin{id: "a"})
+	results, err := pm.CallPluginsContext(context.Background(), []PluginCall{{ID: "missing", Input: "x"}, {ID: "a", Input: "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing, found PluginResponse
+	json.Unmarshal([]byte(results[0]), &missing)
+	json.Unmarshal([]byte(results[1]), &found)
+	if missing.Error == "" || found.Result != "y" {
+		t.Errorf("results = %v", results)
+	}
+}
+
+// multiPlugin 提供多个工具的测试插件，ExecuteFunction返回被调用的函数名和输入
+type multiPlugin struct {
+	recordPlugin
+	functions []string
+}
+
+func (p *multiPlugin) FunctionDefinitions() []openai.FunctionDefinition {
+	definitions := make([]openai.FunctionDefinition, len(p.functions))
+	for i, name := range p.functions {
+		definitions[i] = openai.FunctionDefinition{Name: name}
+	}
+	return definitions
+}
+
+func (p *multiPlugin) ExecuteFunction(ctx context.Context, name string, jsonInput string) (string, error) {
+	return name + ":" + jsonInput, nil
+}
+
+func TestMultiFunctionPlugin(t *testing.T) {
+	seat := &multiPlugin{recordPlugin: recordPlugin{id: "seat"}, functions: []string{"seat_up", "seat_down"}}
+	pm := newTestManager(seat, &recordPlugin{id: "a"})
+
+	var names []string
+	for _, tool := range pm.GenerateOpenAItoolsDefinition() {
+		names = append(names, tool.Function.Name)
+	}
+	if want := []string{"seat_up", "seat_down", "a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tools = %v, want %v", names, want)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "seat_down", want: "seat_down:1"},
+		{name: "seat", want: "1"}, // 按插件ID调用时使用Execute
+		{name: "a", want: "1"},
+	}
+	for _, tt := range tests {
+		output, err := pm.CallPluginContext(context.Background(), tt.name, "1")
+		var resp PluginResponse
+		json.Unmarshal([]byte(output), &resp)
+		if err != nil || resp.Result != tt.want {
+			t.Errorf("CallPluginContext(%s) = %s, %v, want result %q", tt.name, output, err, tt.want)
+		}
+	}
+	if !pm.HasTool("seat_up") || pm.HasTool("seat_left") {
+		t.Errorf("HasTool(seat_up) = %v, HasTool(seat_left) = %v", pm.HasTool("seat_up"), pm.HasTool("seat_left"))
+	}
+
+	duplicates := []Plugin{
+		&multiPlugin{recordPlugin: recordPlugin{id: "seat2"}, functions: []string{"seat_up"}},
+		&multiPlugin{recordPlugin: recordPlugin{id: "seat3"}, functions: []string{"x", "x"}},
+		&recordPlugin{id: "seat_down"},
+	}
+	for _, p := range duplicates {
+		if err := pm.initPlugin(p, ""); err == nil {
+			t.Errorf("plugin %s with a duplicate tool name was loaded", p.ID())
+		}
+	}
+}
+
+// contextRecordPlugin 支持context的测试插件，ctx取消时立即返回，timeout不为0时声明默认超时时间
+type contextRecordPlugin struct {
+	recordPlugin
+	timeout time.Duration
+}
+
+func (p *contextRecordPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	select {
+	case <-time.After(p.delay):
+		return jsonInput, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (p *contextRecordPlugin) DefaultTimeout() time.Duration {
+	if p.timeout == 0 {
+		return DefaultPluginTimeout
+	}
+	return p.timeout
+}
+
+func TestCallPluginContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		plugin    Plugin
+		timeout   time.Duration // 通过SetPluginTimeout覆盖的超时时间
+		ctx       context.Context
+		tool      string
+		wantErr   error  // CallPluginContext本身返回的错误
+		result    string // 响应中的Result
+		errSubstr string // 响应中Error应包含的内容
+	}{
+		{
+			name:   "result",
+			plugin: &contextRecordPlugin{recordPlugin: recordPlugin{id: "echo"}},
+			tool:   "echo",
+			result: "hi",
+		},
+		{
+			name:   "result without context support",
+			plugin: &recordPlugin{id: "echo"},
+			tool:   "echo",
+			result: "hi",
+		},
+		{
+			name:      "default timeout of the plugin",
+			plugin:    &contextRecordPlugin{recordPlugin: recordPlugin{id: "echo", delay: time.Second}, timeout: 20 * time.Millisecond},
+			tool:      "echo",
+			errSubstr: "timed out",
+		},
+		{
+			name:      "configured timeout",
+			plugin:    &contextRecordPlugin{recordPlugin: recordPlugin{id: "echo", delay: time.Second}},
+			timeout:   20 * time.Millisecond,
+			tool:      "echo",
+			errSubstr: "timed out",
+		},
+		{
+			name:      "timeout without context support",
+			plugin:    &recordPlugin{id: "echo", delay: time.Second},
+			timeout:   20 * time.Millisecond,
+			tool:      "echo",
+			errSubstr: "timed out",
+		},
+		{
+			name:    "caller canceled",
+			plugin:  &contextRecordPlugin{recordPlugin: recordPlugin{id: "echo", delay: time.Second}},
+			ctx:     canceled,
+			tool:    "echo",
+			wantErr: context.Canceled,
+		},
+		{
+			name:    "caller canceled without context support",
+			plugin:  &recordPlugin{id: "echo", delay: time.Second},
+			ctx:     canceled,
+			tool:    "echo",
+			wantErr: context.Canceled,
+		},
+		{
+			name:      "unknown plugin",
+			plugin:    &recordPlugin{id: "echo"},
+			tool:      "missing",
+			errSubstr: "not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := newTestManager(tt.plugin)
+			pm.SetPluginTimeout(tt.plugin.ID(), tt.timeout)
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			start := time.Now()
+			out, err := pm.CallPluginContext(ctx, tt.tool, "hi")
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("call took %v, want it to stop early", elapsed)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			var resp PluginResponse
+			if err := json.Unmarshal([]byte(out), &resp); err != nil {
+				t.Fatalf("invalid response %q: %v", out, err)
+			}
+			if resp.Result != tt.result {
+				t.Errorf("result = %q, want %q", resp.Result, tt.result)
+			}
+			if tt.errSubstr == "" && resp.Error != "" || !strings.Contains(resp.Error, tt.errSubstr) {
+				t.Errorf("error = %q, want it to contain %q", resp.Error, tt.errSubstr)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
+)
+
+// ToolRisk 工具的风险等级
+type ToolRisk int
+
+const (
+	RiskSideEffect ToolRisk = iota // 有副作用，例如控制电机、写入记忆；插件未声明时的默认等级
+	RiskReadOnly                   // 只读，不改变外部状态
+	RiskDangerous                  // 危险，例如执行任意命令
+)
+
+func (r ToolRisk) String() string {
+	switch r {
+	case RiskReadOnly:
+		return "read_only"
+	case RiskDangerous:
+		return "dangerous"
+	default:
+		return "side_effect"
+	}
+}
+
+// MarshalText 风险等级在JSON中使用字符串表示
+func (r ToolRisk) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *ToolRisk) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "read_only":
+		*r = RiskReadOnly
+	case "side_effect":
+		*r = RiskSideEffect
+	case "dangerous":
+		*r = RiskDangerous
+	default:
+		return fmt.Errorf("unknown tool risk %q", text)
+	}
+	return nil
+}
+
+// RiskPlugin是可选接口，插件通过它声明每个工具的风险等级，未实现的插件按RiskSideEffect处理
+type RiskPlugin interface {
+	ToolRisk(tool string) ToolRisk
+}
+
+// ErrToolDenied 表示工具调用被权限策略禁止或被用户拒绝
+var ErrToolDenied = errors.New("tool call denied")
+
+// ToolRequest 一次等待确认的工具调用
+type ToolRequest struct {
+	ID        string   `json:"id"`
+	Tool      string   `json:"tool"`
+	PluginID  string   `json:"plugin"`
+	Arguments string   `json:"arguments"`
+	Risk      ToolRisk `json:"risk"`
+}
+
+// Confirmer 在执行工具调用前请求确认，返回false表示拒绝
+type Confirmer interface {
+	Confirm(ctx context.Context, req ToolRequest) (bool, error)
+}
+
+// ConfirmFunc 把普通函数用作Confirmer
+type ConfirmFunc func(ctx context.Context, req ToolRequest) (bool, error)
+
+func (f ConfirmFunc) Confirm(ctx context.Context, req ToolRequest) (bool, error) {
+	return f(ctx, req)
+}
+
+// policyDecision 权限策略对一次工具调用的决定
+type policyDecision int
+
+const (
+	decisionAllow policyDecision = iota
+	decisionConfirm
+	decisionDeny
+)
+
+// decide 按规则和工具的风险等级决定是否允许调用
+func decide(policy config.ToolPolicy, tool string, risk ToolRisk) policyDecision {
+	switch {
+	case matchTool(policy.Deny, tool):
+		return decisionDeny
+	case matchTool(policy.Confirm, tool):
+		return decisionConfirm
+	case matchTool(policy.Allow, tool):
+		return decisionAllow
+	case risk == RiskDangerous:
+		return decisionConfirm
+	case risk == RiskSideEffect && policy.ConfirmSideEffects:
+		return decisionConfirm
+	default:
+		return decisionAllow
+	}
+}
+
+// matchTool 判断工具名是否匹配任意一条规则
+func matchTool(patterns []string, tool string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// toolRisk 返回插件声明的工具风险等级
+func toolRisk(p Plugin, tool string) ToolRisk {
+	if rp, ok := p.(RiskPlugin); ok {
+		return rp.ToolRisk(tool)
+	}
+	return RiskSideEffect
+}
+
+// SetPolicy 设置工具权限规则
+func (pm *PluginManager) SetPolicy(policy config.ToolPolicy) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.policy = policy
+}
+
+// SetConfirmer 设置需要确认的工具调用默认使用的Confirmer，为nil时需要确认的调用都会被拒绝
+// 多个助手共用一个PluginManager时，用WithConfirmer为每次调用指定Confirmer
+func (pm *PluginManager) SetConfirmer(c Confirmer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.confirmer = c
+}
+
+type confirmerKey struct{}
+
+// WithConfirmer 返回带有Confirmer的ctx，用这个ctx调用工具时由c确认，优先于SetConfirmer设置的Confirmer
+func WithConfirmer(ctx context.Context, c Confirmer) context.Context {
+	return context.WithValue(ctx, confirmerKey{}, c)
+}
+
+// confirmerFrom 返回ctx中的Confirmer
+func confirmerFrom(ctx context.Context) (Confirmer, bool) {
+	c, ok := ctx.Value(confirmerKey{}).(Confirmer)
+	return c, ok && c != nil
+}
+
+// ToolRisk 返回工具的风险等级，工具不存在时返回false
+func (pm *PluginManager) ToolRisk(tool string) (ToolRisk, bool) {
+	p, _, _, ok := pm.resolveTool(tool)
+	if !ok {
+		return RiskSideEffect, false
+	}
+	return toolRisk(p, tool), true
+}
+
+// authorize 按权限策略检查工具调用，需要确认时调用Confirmer并等待结果
+func (pm *PluginManager) authorize(ctx context.Context, p Plugin, tool string, jsonInput string) error {
+	pm.mu.RLock()
+	policy, confirmer := pm.policy, pm.confirmer
+	pm.mu.RUnlock()
+	if c, ok := confirmerFrom(ctx); ok {
+		confirmer = c
+	}
+
+	risk := toolRisk(p, tool)
+	switch decide(policy, tool, risk) {
+	case decisionDeny:
+		return fmt.Errorf("%w: %s is not allowed by the tool policy", ErrToolDenied, tool)
+	case decisionConfirm:
+		if confirmer == nil {
+			return fmt.Errorf("%w: %s requires confirmation but no confirmer is configured", ErrToolDenied, tool)
+		}
+		req := ToolRequest{ID: newRequestID(), Tool: tool, PluginID: p.ID(), Arguments: jsonInput, Risk: risk}
+		approved, err := confirmer.Confirm(ctx, req)
+		if err != nil {
+			return fmt.Errorf("confirm %s: %w", tool, err)
+		}
+		if !approved {
+			return fmt.Errorf("%w: the user rejected %s", ErrToolDenied, tool)
+		}
+	}
+	return nil
+}
+
+var requestSeq struct {
+	sync.Mutex
+	n uint64
+}
+
+// newRequestID 生成确认请求的ID
+func newRequestID() string {
+	requestSeq.Lock()
+	defer requestSeq.Unlock()
+	requestSeq.n++
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), requestSeq.n)
+}
+
+// StdinConfirmer 在终端上询问用户是否执行工具调用
+// 标准输入只由StdinConfirmer内部的一个goroutine读取：有等待中的确认时，下一行输入作为确认的回答，
+// 其余输入按顺序从Lines读出，对话循环应从Lines读取输入，而不是自己读取标准输入
+type StdinConfirmer struct {
+	prompt sync.Mutex // 同一时间只询问一个工具调用
+	writer io.Writer
+	lines  chan string
+
+	mu      sync.Mutex
+	waiting chan string // 等待回答的确认，没有时为nil
+	closed  bool        // 标准输入已结束，之后的确认都视为拒绝
+}
+
+// NewStdinConfirmer 创建StdinConfirmer并开始读取reader，reader通常为os.Stdin，writer通常为os.Stdout
+func NewStdinConfirmer(reader io.Reader, writer io.Writer) *StdinConfirmer {
+	c := &StdinConfirmer{writer: writer, lines: make(chan string)}
+	raw := make(chan string)
+	go func() {
+		defer close(raw)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			raw <- scanner.Text()
+		}
+	}()
+	go c.route(raw)
+	return c
+}
+
+// route把输入交给等待中的确认或放入对话输入队列
+// 对话输入先放入队列，避免对话循环忙于处理上一条消息时阻塞读取，使确认的回答无法送达
+func (c *StdinConfirmer) route(raw <-chan string) {
+	defer close(c.lines)
+	var queue []string
+	for raw != nil || len(queue) > 0 {
+		var out chan string
+		var next string
+		if len(queue) > 0 {
+			out, next = c.lines, queue[0]
+		}
+		select {
+		case line, ok := <-raw:
+			if !ok {
+				raw = nil
+				c.mu.Lock()
+				c.closed = true
+				if c.waiting != nil {
+					close(c.waiting)
+					c.waiting = nil
+				}
+				c.mu.Unlock()
+				continue
+			}
+			c.mu.Lock()
+			waiting := c.waiting
+			c.waiting = nil
+			c.mu.Unlock()
+			if waiting != nil {
+				waiting <- line
+			} else {
+				queue = append(queue, line)
+			}
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+// Lines 返回不属于确认回答的输入行，标准输入结束后关闭
+func (c *StdinConfirmer) Lines() <-chan string {
+	return c.lines
+}
+
+// Confirm 输出工具调用并等待下一行输入，y或yes表示同意，其余回答都视为拒绝
+func (c *StdinConfirmer) Confirm(ctx context.Context, req ToolRequest) (bool, error) {
+	c.prompt.Lock()
+	defer c.prompt.Unlock()
+
+	answer := make(chan string, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false, io.EOF
+	}
+	c.waiting = answer
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.waiting == answer {
+			c.waiting = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	fmt.Fprintf(c.writer, "是否执行工具 %s（%s）参数：%s [y/N] ", req.Tool, req.Risk, req.Arguments)
+	select {
+	case line, ok := <-answer:
+		if !ok {
+			return false, io.EOF
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		return line == "y" || line == "yes", nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// ConfirmBus MQTTConfirmer收发消息所用的总线，*mqttbus.Bus实现了该接口
+type ConfirmBus interface {
+	Publish(ctx context.Context, topic string, payload interface{}) error
+	Subscribe(topic string, handler mqttbus.Handler) (cancel func(), err error)
+}
+
+// MQTTConfirmer 通过MQTT把确认请求发给聊天界面，并等待回复
+// 请求以JSON发布到topic，回复发布到topic+"/reply"，格式为{"id": 请求ID, "approved": true}
+type MQTTConfirmer struct {
+	bus     ConfirmBus
+	topic   string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]chan bool
+	cancel  func()
+}
+
+// mqttConfirmReply 聊天界面的确认回复
+type mqttConfirmReply struct {
+	ID       string `json:"id"`
+	Approved bool   `json:"approved"`
+}
+
+// NewMQTTConfirmer 创建MQTTConfirmer并订阅回复主题，timeout<=0时一直等待到ctx结束
+func NewMQTTConfirmer(bus ConfirmBus, topic string, timeout time.Duration) (*MQTTConfirmer, error) {
+	c := &MQTTConfirmer{
+		bus:     bus,
+		topic:   topic,
+		timeout: timeout,
+		pending: make(map[string]chan bool),
+	}
+	cancel, err := bus.Subscribe(topic+"/reply", c.handleReply)
+	if err != nil {
+		return nil, err
+	}
+	c.cancel = cancel
+	return c, nil
+}
+
+// handleReply 把回复交给等待中的Confirm
+func (c *MQTTConfirmer) handleReply(topic string, payload []byte) {
+	var reply mqttConfirmReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		fmt.Printf("无法解析确认回复：%v\n", err)
+		return
+	}
+	c.mu.Lock()
+	ch, ok := c.pending[reply.ID]
+	delete(c.pending, reply.ID)
+	c.mu.Unlock()
+	if ok {
+		ch <- reply.Approved
+	}
+}
+
+// Confirm 发布确认请求并等待回复，超时视为拒绝
+func (c *MQTTConfirmer) Confirm(ctx context.Context, req ToolRequest) (bool, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	ch := make(chan bool, 1)
+	c.mu.Lock()
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.bus.Publish(ctx, c.topic, payload); err != nil {
+		return false, err
+	}
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case approved := <-ch:
+		return approved, nil
+	case <-timeout:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Close 取消回复主题的订阅
+func (c *MQTTConfirmer) Close() {
+	c.cancel()
+}
@@ -0,0 +1,340 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
+)
+
+func TestDecide(t *testing.T) {
+	policy := config.ToolPolicy{
+		Allow:   []string{"command", "seat_*"},
+		Confirm: []string{"seat_heat"},
+		Deny:    []string{"seat_eject"},
+	}
+
+	tests := []struct {
+		name   string
+		policy config.ToolPolicy
+		tool   string
+		risk   ToolRisk
+		want   policyDecision
+	}{
+		{name: "read only", tool: "time", risk: RiskReadOnly, want: decisionAllow},
+		{name: "side effect", tool: "legs", risk: RiskSideEffect, want: decisionAllow},
+		{name: "dangerous", tool: "command", risk: RiskDangerous, want: decisionConfirm},
+		{name: "confirm side effects", policy: config.ToolPolicy{ConfirmSideEffects: true}, tool: "legs", risk: RiskSideEffect, want: decisionConfirm},
+		{name: "confirm side effects keeps read only", policy: config.ToolPolicy{ConfirmSideEffects: true}, tool: "time", risk: RiskReadOnly, want: decisionAllow},
+		{name: "allow overrides dangerous", policy: policy, tool: "command", risk: RiskDangerous, want: decisionAllow},
+		{name: "allow pattern", policy: policy, tool: "seat_up", risk: RiskSideEffect, want: decisionAllow},
+		{name: "confirm overrides allow", policy: policy, tool: "seat_heat", risk: RiskReadOnly, want: decisionConfirm},
+		{name: "deny overrides allow", policy: policy, tool: "seat_eject", risk: RiskReadOnly, want: decisionDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decide(tt.policy, tt.tool, tt.risk); got != tt.want {
+				t.Errorf("decide(%s, %s) = %d, want %d", tt.tool, tt.risk, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolRiskText(t *testing.T) {
+	for _, risk := range []ToolRisk{RiskReadOnly, RiskSideEffect, RiskDangerous} {
+		b, err := json.Marshal(risk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ToolRisk
+		if err := json.Unmarshal(b, &got); err != nil || got != risk {
+			t.Errorf("round trip of %s = %s, %v", risk, got, err)
+		}
+	}
+	var risk ToolRisk
+	if err := json.Unmarshal([]byte(`"unknown"`), &risk); err == nil {
+		t.Error("unknown risk was accepted")
+	}
+}
+
+// riskyPlugin 声明了风险等级的测试插件
+type riskyPlugin struct {
+	recordPlugin
+	risk ToolRisk
+}
+
+func (p *riskyPlugin) ToolRisk(tool string) ToolRisk { return p.risk }
+
+func TestCallPluginContextPolicy(t *testing.T) {
+	approve := ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) { return true, nil })
+	reject := ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) { return false, nil })
+	broken := ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) { return false, errors.New("ui offline") })
+
+	tests := []struct {
+		name      string
+		policy    config.ToolPolicy
+		confirmer Confirmer
+		risk      ToolRisk
+		wantErr   string // 为空表示插件被调用
+	}{
+		{name: "read only runs", risk: RiskReadOnly},
+		{name: "denied", policy: config.ToolPolicy{Deny: []string{"rm"}}, risk: RiskReadOnly, wantErr: "not allowed"},
+		{name: "dangerous without confirmer", risk: RiskDangerous, wantErr: "no confirmer"},
+		{name: "dangerous approved", confirmer: approve, risk: RiskDangerous},
+		{name: "dangerous rejected", confirmer: reject, risk: RiskDangerous, wantErr: "rejected"},
+		{name: "confirmer error", confirmer: broken, risk: RiskDangerous, wantErr: "ui offline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &riskyPlugin{recordPlugin: recordPlugin{id: "rm"}, risk: tt.risk}
+			pm := newTestManager(p)
+			pm.SetPolicy(tt.policy)
+			pm.SetConfirmer(tt.confirmer)
+
+			output, err := pm.CallPluginContext(context.Background(), "rm", `{}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resp PluginResponse
+			json.Unmarshal([]byte(output), &resp)
+			if tt.wantErr == "" {
+				if resp.Error != "" || len(p.inputs) != 1 {
+					t.Errorf("response = %+v, plugin inputs = %v, want the plugin to run", resp, p.inputs)
+				}
+				return
+			}
+			if !strings.Contains(resp.Error, tt.wantErr) || len(p.inputs) != 0 {
+				t.Errorf("response = %+v, plugin inputs = %v, want error %q", resp, p.inputs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfirmerRequest(t *testing.T) {
+	var got ToolRequest
+	pm := newTestManager(&riskyPlugin{recordPlugin: recordPlugin{id: "rm"}, risk: RiskDangerous})
+	pm.SetConfirmer(ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) {
+		got = req
+		return true, nil
+	}))
+	if _, err := pm.CallPluginContext(context.Background(), "rm", `{"path":"/tmp"}`); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID == "" || got.Tool != "rm" || got.PluginID != "rm" || got.Arguments != `{"path":"/tmp"}` || got.Risk != RiskDangerous {
+		t.Errorf("request = %+v", got)
+	}
+}
+
+// promptWriter 把每次写入的提示发送到channel，测试据此知道确认已经在等待回答
+type promptWriter chan string
+
+func (w promptWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestStdinConfirmer(t *testing.T) {
+	input, typed := io.Pipe()
+	prompts := make(promptWriter, 1)
+	c := NewStdinConfirmer(input, prompts)
+
+	type answer struct {
+		approved bool
+		err      error
+	}
+	// confirm 开始一次确认，等到提示输出后输入line，返回确认的结果
+	confirm := func(ctx context.Context, line string) answer {
+		result := make(chan answer, 1)
+		go func() {
+			approved, err := c.Confirm(ctx, ToolRequest{Tool: "rm", Risk: RiskDangerous, Arguments: "{}"})
+			result <- answer{approved, err}
+		}()
+		if prompt := <-prompts; !strings.Contains(prompt, "rm") {
+			t.Errorf("prompt = %q, want the tool name", prompt)
+		}
+		if line != "" {
+			io.WriteString(typed, line)
+		}
+		return <-result
+	}
+	// nextLine 输入line并检查它被交给对话而不是确认
+	nextLine := func(line string) {
+		io.WriteString(typed, line+"\n")
+		if got := <-c.Lines(); got != line {
+			t.Errorf("Lines() = %q, want %q", got, line)
+		}
+	}
+
+	nextLine("你好")
+	for _, tt := range []struct {
+		line string
+		want bool
+	}{
+		{line: "y\n", want: true},
+		{line: " YES \n", want: true},
+		{line: "n\n"},
+		{line: "\n"},
+	} {
+		if got := confirm(context.Background(), tt.line); got.err != nil || got.approved != tt.want {
+			t.Errorf("Confirm with %q = %+v, want %v", tt.line, got, tt.want)
+		}
+	}
+	nextLine("今天天气怎么样")
+
+	// 取消的确认不会吞掉下一行对话输入
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Confirm(ctx, ToolRequest{Tool: "rm"})
+		result <- err
+	}()
+	<-prompts
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled Confirm = %v, want context.Canceled", err)
+	}
+	nextLine("再见")
+
+	// 标准输入结束后Lines关闭，之后的确认都被拒绝
+	typed.Close()
+	if _, ok := <-c.Lines(); ok {
+		t.Error("Lines() is still open after EOF")
+	}
+	if approved, err := c.Confirm(context.Background(), ToolRequest{Tool: "rm"}); approved || !errors.Is(err, io.EOF) {
+		t.Errorf("Confirm after EOF = %v, %v, want io.EOF", approved, err)
+	}
+}
+
+func TestWithConfirmer(t *testing.T) {
+	reject := ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) { return false, nil })
+	approve := ConfirmFunc(func(ctx context.Context, req ToolRequest) (bool, error) { return true, nil })
+	p := &riskyPlugin{recordPlugin: recordPlugin{id: "rm"}, risk: RiskDangerous}
+	pm := newTestManager(p)
+	pm.SetConfirmer(reject)
+
+	// ctx中的Confirmer优先于SetConfirmer设置的Confirmer
+	output, err := pm.CallPluginContext(WithConfirmer(context.Background(), approve), "rm", `{}`)
+	if err != nil || strings.Contains(output, "error") || len(p.inputs) != 1 {
+		t.Errorf("with ctx confirmer: %s, %v, plugin inputs = %v", output, err, p.inputs)
+	}
+	output, err = pm.CallPluginContext(context.Background(), "rm", `{}`)
+	if err != nil || !strings.Contains(output, "rejected") || len(p.inputs) != 1 {
+		t.Errorf("without ctx confirmer: %s, %v, plugin inputs = %v", output, err, p.inputs)
+	}
+}
+
+// fakeConfirmBus 记录MQTTConfirmer发布的请求，测试通过reply模拟聊天界面的回复
+type fakeConfirmBus struct {
+	published chan ToolRequest
+	mu        sync.Mutex
+	topic     string
+	handler   mqttbus.Handler
+}
+
+func (b *fakeConfirmBus) Publish(ctx context.Context, topic string, payload interface{}) error {
+	var req ToolRequest
+	if err := json.Unmarshal(payload.([]byte), &req); err != nil {
+		return err
+	}
+	b.published <- req
+	return nil
+}
+
+func (b *fakeConfirmBus) Subscribe(topic string, handler mqttbus.Handler) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.topic, b.handler = topic, handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.handler = nil
+	}, nil
+}
+
+func (b *fakeConfirmBus) reply(payload string) {
+	b.mu.Lock()
+	handler := b.handler
+	b.mu.Unlock()
+	if handler != nil {
+		handler(b.topic, []byte(payload))
+	}
+}
+
+func TestMQTTConfirmer(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(req ToolRequest) string // 为nil时不回复
+		timeout time.Duration
+		cancel  bool
+		want    bool
+		wantErr error
+	}{
+		{
+			name:  "approved",
+			reply: func(req ToolRequest) string { return fmt.Sprintf(`{"id":%q,"approved":true}`, req.ID) },
+			want:  true,
+		},
+		{
+			name:  "denied",
+			reply: func(req ToolRequest) string { return fmt.Sprintf(`{"id":%q,"approved":false}`, req.ID) },
+		},
+		{
+			// 其他请求的回复和无法解析的回复被忽略，最终超时
+			name:    "timeout",
+			reply:   func(req ToolRequest) string { return `{"id":"other","approved":true}` },
+			timeout: 50 * time.Millisecond,
+		},
+		{
+			name:    "canceled",
+			cancel:  true,
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := &fakeConfirmBus{published: make(chan ToolRequest, 1)}
+			c, err := NewMQTTConfirmer(bus, "robot/confirm", tt.timeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if bus.topic != "robot/confirm/reply" {
+				t.Errorf("subscribed to %s", bus.topic)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				req := <-bus.published
+				if tt.cancel {
+					cancel()
+				}
+				if tt.reply != nil {
+					bus.reply(`not json`)
+					bus.reply(tt.reply(req))
+				}
+			}()
+
+			approved, err := c.Confirm(ctx, ToolRequest{ID: "req-1", Tool: "rm"})
+			if approved != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Confirm = %v, %v, want %v, %v", approved, err, tt.want, tt.wantErr)
+			}
+			// 结束后不再保留等待中的请求
+			c.mu.Lock()
+			pending := len(c.pending)
+			c.mu.Unlock()
+			if pending != 0 {
+				t.Errorf("%d requests still pending", pending)
+			}
+		})
+	}
+}
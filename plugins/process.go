@@ -0,0 +1,530 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// ManifestSuffix 子进程插件清单文件的后缀，LoadPlugins会加载目录中的清单
+const ManifestSuffix = ".plugin.json"
+
+// 子进程插件的默认参数，清单中未设置（<=0）时使用
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultMaxRestarts    = 5 // 每分钟内最多重启的次数
+	defaultInitTimeout    = 30 * time.Second
+)
+
+// ProcessManifest 描述一个子进程插件
+// 插件进程通过stdin/stdout以每行一条JSON-RPC 2.0消息的方式与PluginManager通信
+type ProcessManifest struct {
+	ID                    string   `json:"id,omitempty"`                      // 可选，设置时需与插件声明的ID一致
+	Command               string   `json:"command"`                           // 可执行文件，相对路径相对于清单所在目录
+	Args                  []string `json:"args,omitempty"`                    // 命令行参数
+	Env                   []string `json:"env,omitempty"`                     // 追加的环境变量，格式为KEY=VALUE
+	Dir                   string   `json:"dir,omitempty"`                     // 工作目录，默认为清单所在目录
+	TimeoutSeconds        int      `json:"timeout_seconds,omitempty"`         // 执行超时时间
+	HealthIntervalSeconds int      `json:"health_interval_seconds,omitempty"` // 健康检查间隔
+	MaxRestarts           int      `json:"max_restarts,omitempty"`            // 每分钟内最多重启的次数
+	Concurrent            bool     `json:"concurrent,omitempty"`              // 是否允许并发调用
+}
+
+// JSON-RPC消息
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      uint64          `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      uint64          `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC方法及其参数和结果
+// 插件进程启动后宿主先发送init，之后才能调用其他方法
+const (
+	rpcMethodInit     = "init"
+	rpcMethodDescribe = "describe"
+	rpcMethodExecute  = "execute"
+	rpcMethodHealth   = "health"
+	rpcMethodCancel   = "cancel" // 通知插件进程取消某次调用，没有响应
+)
+
+// 插件执行失败时使用的JSON-RPC错误码
+const rpcCodeExecuteError = -32000
+
+type describeResult struct {
+	ID                 string                      `json:"id"`
+	Description        string                      `json:"description"`
+	FunctionDefinition openai.FunctionDefinition   `json:"function_definition"`
+	Functions          []openai.FunctionDefinition `json:"functions,omitempty"` // 多函数插件的全部函数定义
+	Risks              map[string]ToolRisk         `json:"risks,omitempty"`     // 工具名 -> 风险等级
+	Dependencies       []string                    `json:"dependencies,omitempty"`
+}
+
+type initParams struct {
+	Config config.Cfg `json:"config"` // 宿主的配置，插件用它调用Init
+}
+
+type executeParams struct {
+	Function string `json:"function,omitempty"` // 多函数插件中被调用的函数名
+	Input    string `json:"input"`
+}
+
+type cancelParams struct {
+	ID uint64 `json:"id"` // 被取消的请求ID
+}
+
+type executeResult struct {
+	Result string `json:"result"`
+}
+
+// rpcProcess 一个正在运行的插件进程
+type rpcProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	nextID  atomic.Uint64
+
+	pendingMu sync.Mutex
+	pending   map[uint64]chan rpcResponse
+
+	done chan struct{} // 进程退出后关闭
+	err  error         // 进程退出的原因，done关闭后可读
+}
+
+// startProcess 启动插件进程并开始读取其输出
+func startProcess(manifest ProcessManifest, dir string) (*rpcProcess, error) {
+	command := manifest.Command
+	if !filepath.IsAbs(command) && strings.ContainsRune(command, filepath.Separator) {
+		command = filepath.Join(dir, command)
+	}
+	cmd := exec.Command(command, manifest.Args...)
+	cmd.Dir = dir
+	if manifest.Dir != "" {
+		cmd.Dir = manifest.Dir
+	}
+	cmd.Env = append(os.Environ(), manifest.Env...)
+	cmd.Stderr = os.Stderr // 插件的日志直接输出到宿主的stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &rpcProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[uint64]chan rpcResponse),
+		done:    make(chan struct{}),
+	}
+	go p.readLoop(stdout)
+	return p, nil
+}
+
+// readLoop 读取插件进程的响应并交给等待中的调用，进程退出后关闭done
+func (p *rpcProcess) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var resp rpcResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			fmt.Printf("无法解析插件进程的输出：%v\n", err)
+			continue
+		}
+		p.pendingMu.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.pendingMu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	err := p.cmd.Wait()
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = errors.New("plugin process exited")
+	}
+	p.err = err
+	close(p.done)
+}
+
+// call 发送一次JSON-RPC请求并等待结果
+func (p *rpcProcess) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	req := rpcRequest{JSONRPC: "2.0", ID: p.nextID.Add(1), Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = b
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan rpcResponse, 1)
+	p.pendingMu.Lock()
+	p.pending[req.ID] = ch
+	p.pendingMu.Unlock()
+	defer func() {
+		p.pendingMu.Lock()
+		delete(p.pending, req.ID)
+		p.pendingMu.Unlock()
+	}()
+
+	p.writeMu.Lock()
+	_, err = p.stdin.Write(append(line, '\n'))
+	p.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("write to plugin process: %v", err)
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return errors.New(resp.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-p.done:
+		return fmt.Errorf("plugin process exited: %v", p.err)
+	case <-ctx.Done():
+		// 宿主不再等待结果，通知插件进程停止这次调用
+		p.notify(rpcMethodCancel, cancelParams{ID: req.ID})
+		return ctx.Err()
+	}
+}
+
+// notify 发送一条不需要响应的消息，ID为0
+func (p *rpcProcess) notify(method string, params interface{}) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	line, err := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: b})
+	if err != nil {
+		return
+	}
+	p.writeMu.Lock()
+	p.stdin.Write(append(line, '\n'))
+	p.writeMu.Unlock()
+}
+
+// alive 判断进程是否仍在运行
+func (p *rpcProcess) alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// kill 结束进程
+func (p *rpcProcess) kill() {
+	p.stdin.Close()
+	if p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// processPlugin 通过子进程运行的插件，实现了Plugin、ContextPlugin、TimeoutPlugin和ConcurrentPlugin
+// 进程崩溃后在下一次调用或健康检查时自动重启，重启后重新初始化并获取插件描述
+type processPlugin struct {
+	manifest ProcessManifest
+	dir      string
+	cfg      config.Cfg // 传给插件进程的配置
+
+	infoMu sync.RWMutex
+	info   describeResult
+
+	mu       sync.Mutex // 保护proc和restarts
+	proc     *rpcProcess
+	restarts []time.Time
+
+	stopOnce   sync.Once
+	stopHealth chan struct{}
+}
+
+// loadProcessPlugin 读取清单，启动插件进程，用cfg初始化插件并获取插件描述
+func loadProcessPlugin(path string, cfg config.Cfg) (*processPlugin, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ProcessManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid plugin manifest %s: %v", path, err)
+	}
+	if manifest.Command == "" {
+		return nil, fmt.Errorf("plugin manifest %s has no command", path)
+	}
+
+	p := &processPlugin{
+		manifest:   manifest,
+		dir:        filepath.Dir(path),
+		cfg:        cfg,
+		stopHealth: make(chan struct{}),
+	}
+	proc, info, err := p.start()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	if manifest.ID != "" && manifest.ID != info.ID {
+		proc.kill()
+		return nil, fmt.Errorf("plugin manifest %s declares id %s but plugin reports %s", path, manifest.ID, info.ID)
+	}
+	p.proc, p.info = proc, info
+	return p, nil
+}
+
+// start 启动插件进程，发送init并获取插件描述，失败时结束进程
+func (p *processPlugin) start() (*rpcProcess, describeResult, error) {
+	var info describeResult
+	proc, err := startProcess(p.manifest, p.dir)
+	if err != nil {
+		return nil, info, fmt.Errorf("start: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultInitTimeout)
+	defer cancel()
+	if err := proc.call(ctx, rpcMethodInit, initParams{Config: p.cfg}, nil); err != nil {
+		proc.kill()
+		return nil, info, fmt.Errorf("init: %v", err)
+	}
+	if err := proc.call(ctx, rpcMethodDescribe, nil, &info); err != nil {
+		proc.kill()
+		return nil, info, fmt.Errorf("describe: %v", err)
+	}
+	return proc, info, nil
+}
+
+// describe 返回插件进程最近一次的描述
+func (p *processPlugin) describe() describeResult {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+	return p.info
+}
+
+// Init 启动健康检查，插件自身的初始化在插件进程启动时通过init完成
+func (p *processPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
+	go p.healthLoop()
+	return nil
+}
+
+func (p *processPlugin) ID() string {
+	return p.describe().ID
+}
+
+func (p *processPlugin) Description() string {
+	return p.describe().Description
+}
+
+func (p *processPlugin) FunctionDefinition() openai.FunctionDefinition {
+	return p.describe().FunctionDefinition
+}
+
+func (p *processPlugin) Dependencies() []string {
+	return p.describe().Dependencies
+}
+
+func (p *processPlugin) DefaultTimeout() time.Duration {
+	return time.Duration(p.manifest.TimeoutSeconds) * time.Second
+}
+
+func (p *processPlugin) ConcurrentSafe() bool {
+	return p.manifest.Concurrent
+}
+
+func (p *processPlugin) Execute(jsonInput string) (string, error) {
+	return p.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext 通过JSON-RPC调用插件进程的execute方法
+func (p *processPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	return p.execute(ctx, executeParams{Input: jsonInput})
+}
+
+// FunctionDefinitions 返回插件进程描述的全部函数，单函数插件只有FunctionDefinition
+func (p *processPlugin) FunctionDefinitions() []openai.FunctionDefinition {
+	info := p.describe()
+	if len(info.Functions) > 0 {
+		return info.Functions
+	}
+	return []openai.FunctionDefinition{info.FunctionDefinition}
+}
+
+// ToolRisk 返回插件进程声明的工具风险等级
+func (p *processPlugin) ToolRisk(tool string) ToolRisk {
+	if risk, ok := p.describe().Risks[tool]; ok {
+		return risk
+	}
+	return RiskSideEffect
+}
+
+// ExecuteFunction 调用插件进程中的指定函数，单函数插件等同于ExecuteContext
+func (p *processPlugin) ExecuteFunction(ctx context.Context, name string, jsonInput string) (string, error) {
+	if len(p.describe().Functions) == 0 {
+		return p.ExecuteContext(ctx, jsonInput)
+	}
+	return p.execute(ctx, executeParams{Function: name, Input: jsonInput})
+}
+
+// execute 通过JSON-RPC调用插件进程的execute方法
+func (p *processPlugin) execute(ctx context.Context, params executeParams) (string, error) {
+	proc, err := p.process()
+	if err != nil {
+		return "", err
+	}
+	var result executeResult
+	if err := proc.call(ctx, rpcMethodExecute, params, &result); err != nil {
+		return "", err
+	}
+	return result.Result, nil
+}
+
+// Shutdown 停止健康检查并结束插件进程
+func (p *processPlugin) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stopHealth) })
+	p.mu.Lock()
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+
+	// 先关闭stdin让插件自行退出，超时后强制结束
+	proc.stdin.Close()
+	select {
+	case <-proc.done:
+	case <-ctx.Done():
+		proc.kill()
+		<-proc.done
+	}
+	return nil
+}
+
+// process 返回正在运行的插件进程，进程已退出时重启
+// 重启的进程重新初始化并获取描述，插件的ID不能改变，函数定义等在下一轮对话更新工具列表时生效
+func (p *processPlugin) process() (*rpcProcess, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc != nil && p.proc.alive() {
+		return p.proc, nil
+	}
+	select {
+	case <-p.stopHealth:
+		return nil, fmt.Errorf("plugin %s is shut down", p.ID())
+	default:
+	}
+
+	// 限制重启频率，避免启动即崩溃的插件被反复拉起
+	maxRestarts := p.manifest.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+	now := time.Now()
+	recent := p.restarts[:0]
+	for _, t := range p.restarts {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	p.restarts = recent
+	if len(p.restarts) >= maxRestarts {
+		return nil, fmt.Errorf("plugin %s crashed %d times in the last minute, not restarting", p.ID(), len(p.restarts))
+	}
+
+	if p.proc != nil {
+		fmt.Printf("插件%s的进程已退出（%v），正在重启\n", p.ID(), p.proc.err)
+	}
+	p.restarts = append(p.restarts, now)
+	proc, info, err := p.start()
+	if err != nil {
+		return nil, fmt.Errorf("restart plugin %s: %v", p.ID(), err)
+	}
+	if info.ID != p.ID() {
+		proc.kill()
+		return nil, fmt.Errorf("restart plugin %s: plugin now reports id %s", p.ID(), info.ID)
+	}
+	p.infoMu.Lock()
+	p.info = info
+	p.infoMu.Unlock()
+	p.proc = proc
+	return proc, nil
+}
+
+// healthLoop 定期检查插件进程，无响应的进程会被结束并重启
+func (p *processPlugin) healthLoop() {
+	interval := time.Duration(p.manifest.HealthIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopHealth:
+			return
+		case <-ticker.C:
+		}
+		if err := p.Health(); err != nil {
+			fmt.Printf("插件%s健康检查失败：%v\n", p.ID(), err)
+		}
+	}
+}
+
+// Health 检查插件进程是否能正常响应，必要时重启进程
+func (p *processPlugin) Health() error {
+	proc, err := p.process()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHealthTimeout)
+	defer cancel()
+	if err := proc.call(ctx, rpcMethodHealth, nil, nil); err != nil {
+		proc.kill() // 下一次调用时重启
+		return err
+	}
+	return nil
+}
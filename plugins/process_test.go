@@ -0,0 +1,112 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// buildEchoPlugin 编译testdata/echo并写入指向它的清单，返回清单路径
+func buildEchoPlugin(t *testing.T) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "echo")
+	build := exec.Command(goTool, "build", "-o", bin, "./testdata/echo")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build echo plugin: %v\n%s", err, out)
+	}
+
+	manifest, err := json.Marshal(ProcessManifest{ID: "echo", Command: bin, TimeoutSeconds: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "echo"+ManifestSuffix)
+	if err := os.WriteFile(path, manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessPlugin(t *testing.T) {
+	// 插件进程通过init收到宿主的配置
+	pm := NewPluginManager(config.New().SetMQTTTopicPrefix("robot1"), nil)
+	path := buildEchoPlugin(t)
+	if err := pm.loadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := pm.loadedPlugins["echo"].(*processPlugin)
+	if !ok {
+		t.Fatalf("echo plugin is not loaded: %v", pm.loadedPlugins)
+	}
+	defer p.Shutdown(context.Background())
+
+	if p.Description() != "原样返回输入" || p.FunctionDefinition().Name != "echo" {
+		t.Errorf("describe = %+v", p.describe())
+	}
+	// 描述只在进程启动时获取，进程重启后才会更新
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "description.txt"), []byte("新的说明"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{name: "result", input: `{"a":1}`, want: `{"a":1}`},
+		{name: "host config", input: "topic_prefix", want: "robot1"},
+		{name: "error", input: "fail", wantErr: "echo failed"},
+		{name: "crash", input: "crash", wantErr: "exited"},
+		{name: "restarted after crash", input: "again", want: "again"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.ExecuteContext(context.Background(), tt.input)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ExecuteContext(%s) = %q, %v, want %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+
+	if got := p.Description(); got != "新的说明" {
+		t.Errorf("Description() after restart = %q, want it described again", got)
+	}
+	if err := p.Health(); err != nil {
+		t.Errorf("Health() = %v", err)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ExecuteContext(context.Background(), "x"); err == nil {
+		t.Error("call after Shutdown succeeded")
+	}
+}
+
+func TestLoadManifestIDMismatch(t *testing.T) {
+	path := buildEchoPlugin(t)
+	data, _ := os.ReadFile(path)
+	data = []byte(strings.Replace(string(data), `"id":"echo"`, `"id":"other"`, 1))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestManager().loadFile(path); err == nil || !strings.Contains(err.Error(), "reports echo") {
+		t.Errorf("err = %v, want id mismatch", err)
+	}
+}
@@ -0,0 +1,61 @@
+package plugins
+
+import (
+	"sort"
+	"sync"
+)
+
+// registry 保存编译期注册的插件工厂，不依赖plugin.Open加载.so文件
+// 注册插件的包需要是普通（非main）包，并在程序中以空白导入的方式引入，例如：
+//
+//	import _ "github.com/wangergou2023/agi_modules_for_go/plugins/source/builtin/time"
+//
+// 这样所有插件都编译进同一个可执行文件，可以静态编译，也可以使用-race和单元测试
+var registry = struct {
+	mu        sync.Mutex
+	factories map[string]func() Plugin
+}{factories: make(map[string]func() Plugin)}
+
+// Register 注册插件工厂，通常在插件包的init函数中调用
+// 每个PluginManager加载插件时都会调用factory创建新的实例，各助手之间不共享插件状态
+// factory为nil或ID重复时panic，与database/sql.Register的约定一致
+func Register(id string, factory func() Plugin) {
+	if factory == nil {
+		panic("plugins: Register factory is nil")
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, dup := registry.factories[id]; dup {
+		panic("plugins: Register called twice for plugin " + id)
+	}
+	registry.factories[id] = factory
+}
+
+// Registered 返回所有已注册插件的ID
+func Registered() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	ids := make([]string, 0, len(registry.factories))
+	for id := range registry.factories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RegisteredPlugin 通过ID创建已注册插件的新实例
+func RegisteredPlugin(id string) (Plugin, bool) {
+	registry.mu.Lock()
+	factory, ok := registry.factories[id]
+	registry.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// LoadRegistered 初始化并加载指定ID的已注册插件
+// 单个插件失败时继续加载其余插件，返回所有失败插件的错误；需要逐个插件的结果时使用LoadRegisteredReport
+func (pm *PluginManager) LoadRegistered(ids ...string) error {
+	return pm.LoadRegisteredReport(ids...).Err()
+}
@@ -0,0 +1,83 @@
+package plugins
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	const id = "registry_test_a"
+	newPlugin := func() Plugin { return &recordPlugin{id: id} }
+	Register(id, newPlugin)
+
+	if !slices.Contains(Registered(), id) {
+		t.Errorf("Registered() = %v, want it to contain %s", Registered(), id)
+	}
+	// 每次都通过工厂创建新的实例
+	first, ok := RegisteredPlugin(id)
+	if !ok || first.ID() != id {
+		t.Fatalf("RegisteredPlugin(%s) = %v, %v", id, first, ok)
+	}
+	if second, _ := RegisteredPlugin(id); second == first {
+		t.Error("RegisteredPlugin returned the same instance twice")
+	}
+	if p, ok := RegisteredPlugin("registry_test_missing"); ok {
+		t.Errorf("RegisteredPlugin(registry_test_missing) = %v, want not found", p)
+	}
+
+	tests := []struct {
+		name    string
+		factory func() Plugin
+	}{
+		{name: "nil", factory: nil},
+		{name: "duplicate", factory: newPlugin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Register did not panic")
+				}
+			}()
+			Register(id, tt.factory)
+		})
+	}
+}
+
+func TestLoadRegistered(t *testing.T) {
+	Register("registry_test_b", func() Plugin { return &recordPlugin{id: "registry_test_b"} })
+
+	pm := newTestManager()
+	if err := pm.LoadRegistered("registry_test_b"); err != nil {
+		t.Fatal(err)
+	}
+	if !pm.IsPluginLoaded("registry_test_b") {
+		t.Error("registry_test_b is not loaded")
+	}
+	// 不同的PluginManager加载各自的实例
+	other := newTestManager()
+	if err := other.LoadRegistered("registry_test_b"); err != nil {
+		t.Fatal(err)
+	}
+	if pm.loadedPlugins["registry_test_b"] == other.loadedPlugins["registry_test_b"] {
+		t.Error("two managers share one plugin instance")
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr string
+	}{
+		{name: "not registered", id: "registry_test_missing", wantErr: "not registered"},
+		{name: "already loaded", id: "registry_test_b", wantErr: "already loaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pm.LoadRegistered(tt.id)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
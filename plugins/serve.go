@@ -0,0 +1,214 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Serve 以子进程插件的方式运行插件，通过stdin/stdout与PluginManager通信
+// 插件的main函数中调用即可把现有插件编译成独立的可执行文件：
+//
+//	func main() {
+//		if err := plugins.Serve(Plugin); err != nil {
+//			fmt.Fprintln(os.Stderr, err)
+//			os.Exit(1)
+//		}
+//	}
+//
+// stdout专门用于传输JSON-RPC消息，插件自身的输出会被重定向到stderr（见redirectStdout）
+// 插件在收到宿主的init请求后用宿主的配置调用Init，在此之前其他请求都返回错误；
+// 除非插件实现ConcurrentPlugin并报告可以并发，execute请求会逐个执行；
+// 宿主取消调用时发送cancel消息，对应请求的context随之取消
+func Serve(p Plugin) error {
+	out, err := redirectStdout()
+	if err != nil {
+		return fmt.Errorf("redirect stdout: %v", err)
+	}
+
+	var writeMu sync.Mutex
+	enc := json.NewEncoder(out)
+	respond := func(resp rpcResponse) {
+		resp.JSONRPC = "2.0"
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := enc.Encode(resp); err != nil {
+			fmt.Fprintf(os.Stderr, "write response: %v\n", err)
+		}
+	}
+
+	// 不能并发的插件用execMu串行执行，describe和health不受影响
+	var execMu sync.Mutex
+	concurrent := false
+	if cp, ok := p.(ConcurrentPlugin); ok {
+		concurrent = cp.ConcurrentSafe()
+	}
+
+	var cancelsMu sync.Mutex
+	cancels := make(map[uint64]context.CancelFunc)
+
+	initialized := false
+	var wg sync.WaitGroup
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var req rpcRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid request: %v\n", err)
+			continue
+		}
+		if req.Method == rpcMethodCancel {
+			var params cancelParams
+			if err := json.Unmarshal(req.Params, &params); err == nil {
+				cancelsMu.Lock()
+				if cancel, ok := cancels[params.ID]; ok {
+					cancel()
+				}
+				cancelsMu.Unlock()
+			}
+			continue
+		}
+		// init在读取下一条请求之前完成，之后的请求都能看到初始化的结果
+		if req.Method == rpcMethodInit {
+			resp := serveInit(p, req, initialized)
+			initialized = initialized || resp.Error == nil
+			respond(resp)
+			continue
+		}
+		if !initialized {
+			respond(rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcCodeExecuteError, Message: "plugin is not initialized"}})
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelsMu.Lock()
+		cancels[req.ID] = cancel
+		cancelsMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				cancelsMu.Lock()
+				delete(cancels, req.ID)
+				cancelsMu.Unlock()
+				cancel()
+			}()
+			if req.Method == rpcMethodExecute && !concurrent {
+				execMu.Lock()
+				defer execMu.Unlock()
+			}
+			if ctx.Err() != nil {
+				// 排队期间已被取消，宿主不再等待结果
+				respond(rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcCodeExecuteError, Message: ctx.Err().Error()}})
+				return
+			}
+			respond(serveRequest(ctx, p, req))
+		}()
+	}
+	// stdin关闭表示宿主要求退出，等待进行中的调用完成后关闭插件
+	wg.Wait()
+	if sp, ok := p.(ShutdownPlugin); ok && initialized {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := sp.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "shutdown plugin %s: %v\n", p.ID(), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// serveInit 处理init请求，用宿主传来的配置初始化插件
+func serveInit(p Plugin, req rpcRequest, initialized bool) rpcResponse {
+	resp := rpcResponse{ID: req.ID, Result: json.RawMessage(`"ok"`)}
+	if initialized {
+		resp.Error = &rpcError{Code: rpcCodeExecuteError, Message: "plugin is already initialized"}
+		return resp
+	}
+	var params initParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		resp.Error = &rpcError{Code: -32602, Message: err.Error()}
+		return resp
+	}
+	cfg := params.Config
+	clientConfig := openai.DefaultConfig(cfg.OpenAiAPIKey())
+	clientConfig.BaseURL = cfg.OpenAibaseURL()
+	err := catchPanic(func() error {
+		return initWithContext(p, InitContext{Cfg: cfg, OpenaiClient: openai.NewClientWithConfig(clientConfig)})
+	})
+	if err != nil {
+		resp.Error = &rpcError{Code: rpcCodeExecuteError, Message: fmt.Sprintf("init plugin %s: %v", p.ID(), err)}
+	}
+	return resp
+}
+
+// serveRequest 处理一条JSON-RPC请求，ctx在宿主取消调用时被取消
+func serveRequest(ctx context.Context, p Plugin, req rpcRequest) rpcResponse {
+	resp := rpcResponse{ID: req.ID}
+	var result interface{}
+
+	switch req.Method {
+	case rpcMethodDescribe:
+		info := describeResult{
+			ID:                 p.ID(),
+			Description:        p.Description(),
+			FunctionDefinition: p.FunctionDefinition(),
+		}
+		if mf, ok := p.(MultiFunctionPlugin); ok {
+			info.Functions = mf.FunctionDefinitions()
+		}
+		if rp, ok := p.(RiskPlugin); ok {
+			info.Risks = make(map[string]ToolRisk)
+			for _, def := range functionDefinitions(p) {
+				info.Risks[def.Name] = rp.ToolRisk(def.Name)
+			}
+		}
+		if dp, ok := p.(DependentPlugin); ok {
+			info.Dependencies = dp.Dependencies()
+		}
+		result = info
+	case rpcMethodHealth:
+		if hp, ok := p.(HealthPlugin); ok {
+			if err := hp.Health(); err != nil {
+				resp.Error = &rpcError{Code: rpcCodeExecuteError, Message: err.Error()}
+				return resp
+			}
+		}
+		result = "ok"
+	case rpcMethodExecute:
+		var params executeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp.Error = &rpcError{Code: -32602, Message: err.Error()}
+			return resp
+		}
+		var output string
+		var err error
+		if mf, ok := p.(MultiFunctionPlugin); ok && params.Function != "" {
+			output, err = mf.ExecuteFunction(ctx, params.Function, params.Input)
+		} else if cp, ok := p.(ContextPlugin); ok {
+			output, err = cp.ExecuteContext(ctx, params.Input)
+		} else {
+			output, err = p.Execute(params.Input)
+		}
+		if err != nil {
+			resp.Error = &rpcError{Code: rpcCodeExecuteError, Message: err.Error()}
+			return resp
+		}
+		result = executeResult{Result: output}
+	default:
+		resp.Error = &rpcError{Code: -32601, Message: "method not found: " + req.Method}
+		return resp
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		resp.Error = &rpcError{Code: -32603, Message: err.Error()}
+		return resp
+	}
+	resp.Result = b
+	return resp
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package plugins
+
+import "os"
+
+// redirectStdout 在非Unix系统上只替换os.Stdout变量：
+// 通过os.Stdout输出的内容进入stderr，但cgo代码和子进程直接写到标准输出的内容仍会破坏JSON-RPC消息
+func redirectStdout() (*os.File, error) {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	return out, nil
+}
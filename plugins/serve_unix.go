@@ -0,0 +1,24 @@
+//go:build unix
+
+package plugins
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// redirectStdout 复制一份标准输出用于传输JSON-RPC消息，并把文件描述符1指向stderr
+// 这样fmt.Println、log以及cgo代码和子进程写到标准输出的内容都进入stderr，不会破坏JSON-RPC消息
+func redirectStdout() (*os.File, error) {
+	fd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.Dup2(int(os.Stderr.Fd()), int(os.Stdout.Fd())); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "rpc"), nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -54,7 +55,19 @@ func (l *LeftFrontalLobe) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (l *LeftFrontalLobe) DefaultTimeout() time.Duration {
+	return 60 * time.Second
+}
+
+func (l *LeftFrontalLobe) ConcurrentSafe() bool {
+	return true
+}
+
 func (l *LeftFrontalLobe) Execute(jsonInput string) (string, error) {
+	return l.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (l *LeftFrontalLobe) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input LFLInput
 	err := json.Unmarshal([]byte(jsonInput), &input)
 	if err != nil {
@@ -65,7 +78,7 @@ func (l *LeftFrontalLobe) Execute(jsonInput string) (string, error) {
 
 	// 创建请求给 OpenAI
 	resp, err := l.openaiClient.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT3Dot5Turbo,
 			Messages: []openai.ChatCompletionMessage{
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -54,7 +55,19 @@ func (r *RightFrontalLobe) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (r *RightFrontalLobe) DefaultTimeout() time.Duration {
+	return 60 * time.Second
+}
+
+func (r *RightFrontalLobe) ConcurrentSafe() bool {
+	return true
+}
+
 func (r *RightFrontalLobe) Execute(jsonInput string) (string, error) {
+	return r.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (r *RightFrontalLobe) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input RFLInput
 	err := json.Unmarshal([]byte(jsonInput), &input)
 	if err != nil {
@@ -65,7 +78,7 @@ func (r *RightFrontalLobe) Execute(jsonInput string) (string, error) {
 
 	// 创建请求给 OpenAI
 	resp, err := r.openaiClient.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT3Dot5Turbo,
 			Messages: []openai.ChatCompletionMessage{
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sashabaranov/go-openai"
-	"github.com/sashabaranov/go-openai/jsonschema"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
 
@@ -17,30 +17,34 @@ var Plugin plugins.Plugin = &Alarm{}
 type Alarm struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
-	mqttClient   mqtt.Client // MQTT客户端
+	bus          *mqttbus.Bus  // 共享的MQTT总线
+	stop         chan struct{} // Shutdown时关闭，取消尚未触发的闹钟
+	stopOnce     sync.Once
 }
 
 type AlarmInput struct {
-	Duration string `json:"duration"` // 闹钟的持续时间，例如："10s", "2m"
-	Event    string `json:"event"`    // 事件名称，例如："会议"
-	Message  string `json:"message"`  // 闹钟触发时的消息
+	Duration string `json:"duration" description:"闹钟的持续时间，例如：'10s', '2m', '1h'。"` // 闹钟的持续时间，例如："10s", "2m"
+	Event    string `json:"event" description:"事件名称，例如：'会议'。"`                    // 事件名称，例如："会议"
+	Message  string `json:"message" description:"闹钟触发时的消息。"`                      // 闹钟触发时的消息
 }
 
 func (a *Alarm) Init(cfg config.Cfg, openaiClient *openai.Client) error {
-	a.cfg = cfg
-	a.openaiClient = openaiClient
-
-	// 初始化MQTT客户端
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBrokerURL()).
-		SetClientID("alarm_client").
-		SetUsername(cfg.MQTTUsername()).
-		SetPassword(cfg.MQTTPassword())
-
-	a.mqttClient = mqtt.NewClient(opts)
-	if token := a.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("无法连接到MQTT代理：%v", token.Error())
+	return a.InitWithContext(plugins.InitContext{Cfg: cfg, OpenaiClient: openaiClient})
+}
+
+// InitWithContext 使用共享的MQTT总线初始化插件
+func (a *Alarm) InitWithContext(ictx plugins.InitContext) error {
+	a.cfg = ictx.Cfg
+	a.openaiClient = ictx.OpenaiClient
+	// 同一个.so重新加载时复用同一个实例，需要重置停止信号
+	a.stop = make(chan struct{})
+	a.stopOnce = sync.Once{}
+
+	bus, err := ictx.Bus()
+	if err != nil {
+		return err
 	}
+	a.bus = bus
 
 	fmt.Println("Alarm plugin initialized successfully")
 	return nil
@@ -54,36 +58,50 @@ func (a *Alarm) Description() string {
 	return "An alarm plugin that triggers after a specified duration and reminds you of an event."
 }
 
+// FunctionDefinition 由AlarmInput生成，与ExecuteContext解码参数使用同一个结构体
 func (a *Alarm) FunctionDefinition() openai.FunctionDefinition {
-	return openai.FunctionDefinition{
-		Name:        "alarm",
-		Description: "Set an alarm that triggers after a specified duration and reminds you of an event.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"duration": {
-					Type:        jsonschema.String,
-					Description: "闹钟的持续时间，例如：'10s', '2m', '1h'。",
-				},
-				"event": {
-					Type:        jsonschema.String,
-					Description: "事件名称，例如：'会议'。",
-				},
-				"message": {
-					Type:        jsonschema.String,
-					Description: "闹钟触发时的消息。",
-				},
-			},
-			Required: []string{"duration", "event", "message"},
-		},
+	return plugins.FunctionDefinitionFor[AlarmInput]("alarm", "Set an alarm that triggers after a specified duration and reminds you of an event.")
+}
+
+func (a *Alarm) DefaultTimeout() time.Duration {
+	return 5 * time.Second
+}
+
+func (a *Alarm) ConcurrentSafe() bool {
+	return true
+}
+
+// Shutdown 取消尚未触发的闹钟，共享的MQTT总线由程序退出时统一断开
+func (a *Alarm) Shutdown(ctx context.Context) error {
+	a.stopOnce.Do(func() {
+		if a.stop != nil {
+			close(a.stop)
+		}
+	})
+	return nil
+}
+
+// Health 检查MQTT连接是否可用
+func (a *Alarm) Health() error {
+	if a.bus == nil {
+		return fmt.Errorf("MQTT总线未初始化")
 	}
+	return a.bus.Health()
 }
 
 func (a *Alarm) Execute(jsonInput string) (string, error) {
-	var input AlarmInput
-	err := json.Unmarshal([]byte(jsonInput), &input)
+	return a.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext 只约束闹钟的设置过程，闹钟触发不受ctx影响
+func (a *Alarm) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	input, err := plugins.BindArguments[AlarmInput]("alarm", jsonInput)
 	if err != nil {
-		return "", fmt.Errorf("无法解析输入数据：%v", err)
+		return "", err
 	}
 
 	// 解析持续时间
@@ -99,23 +117,26 @@ func (a *Alarm) Execute(jsonInput string) (string, error) {
 
 	// 使用匿名函数触发闹钟消息
 	go func() {
-		<-timer.C
+		select {
+		case <-timer.C:
+		case <-a.stop:
+			timer.Stop()
+			fmt.Printf("Alarm cancelled: %s\n", input.Event)
+			return
+		}
 		alarmMsg := fmt.Sprintf("Alarm triggered! Event: %s, Message: %s", input.Event, input.Message)
 		fmt.Println(alarmMsg)
 
 		// 将消息发送到MQTT服务器
-		sendMessageToMQTT(alarmMsg, a.mqttClient)
+		sendMessageToMQTT(alarmMsg, a.bus)
 	}()
 
 	return fmt.Sprintf("Alarm set for %v with event: %s, message: %s", duration, input.Event, input.Message), nil
 }
 
 // sendMessageToMQTT 通过MQTT发送消息
-func sendMessageToMQTT(msg string, mqttClient mqtt.Client) {
-	topic := "plugin/messages"
-	token := mqttClient.Publish(topic, 0, false, msg)
-	token.Wait()
-	if token.Error() != nil {
-		fmt.Printf("发送消息到MQTT服务器失败：%v\n", token.Error())
+func sendMessageToMQTT(msg string, bus *mqttbus.Bus) {
+	if err := bus.Publish(context.Background(), "plugin/messages", msg); err != nil {
+		fmt.Printf("发送消息到MQTT服务器失败：%v\n", err)
 	}
 }
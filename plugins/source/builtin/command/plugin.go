@@ -2,9 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -15,19 +27,104 @@ import (
 // 声明CommandPlugin作为plugins.Plugin的实现
 var Plugin plugins.Plugin = &CommandPlugin{}
 
+// 沙箱模式的默认限制
+const (
+	defaultSandboxTimeout = 10 * time.Second
+	defaultCPUSeconds     = 10
+	defaultMemoryBytes    = 512 << 20
+	defaultMaxOutputBytes = 16 << 10
+)
+
+// 后台任务的限制
+const (
+	maxJobs        = 8        // 同时保留的后台任务数，包括已结束但还没被清理的任务
+	jobOutputBytes = 64 << 10 // 每个后台任务保留的未读输出
+)
+
+// 沙箱中命令使用的PATH，也是查找允许执行的程序的目录
+var sandboxPath = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+
+// 未配置AllowedCommands时沙箱允许执行的只读命令
+var defaultAllowedCommands = []string{
+	"date", "cal", "uptime", "uname", "whoami", "id", "pwd",
+	"ls", "cat", "head", "tail", "wc", "grep", "uniq", "cut", "echo",
+	"df", "du", "free", "ps", "which",
+}
+
+// 能够执行其他程序或任意代码的程序，即使配置在AllowedCommands中也不允许执行，
+// 否则例如env sh -c "..."可以绕过允许列表执行任意shell代码
+var launcherPrograms = map[string]bool{
+	"env": true, "sh": true, "bash": true, "dash": true, "zsh": true, "ksh": true, "csh": true, "tcsh": true, "fish": true,
+	"busybox": true, "xargs": true, "find": true, "nice": true, "nohup": true, "timeout": true, "stdbuf": true,
+	"setsid": true, "sudo": true, "su": true, "doas": true, "runuser": true, "chroot": true, "unshare": true, "nsenter": true,
+	"time": true, "watch": true, "strace": true, "ltrace": true, "script": true, "flock": true, "ionice": true,
+	"taskset": true, "chrt": true, "systemd-run": true, "at": true, "batch": true, "crontab": true, "parallel": true,
+	"awk": true, "gawk": true, "mawk": true, "nawk": true, "sed": true, "perl": true, "python": true, "python3": true,
+	"ruby": true, "node": true, "php": true, "lua": true, "tclsh": true, "expect": true,
+	"ssh": true, "git": true, "make": true, "tar": true, "rsync": true, "vi": true, "vim": true, "less": true, "more": true, "man": true,
+}
+
+// 允许执行的程序中会修改系统或执行其他程序的选项，长选项也拒绝GNU风格的缩写
+var forbiddenOptions = map[string][]string{
+	"date": {"-s", "--set", "-f", "--file"},
+	"sort": {"-o", "--output", "-T", "--temporary-directory", "--compress-program"},
+}
+
+// 网络命名空间不可用时（例如系统禁止非特权用户命名空间，或不是Linux系统）置为true，之后不再尝试
+var netnsUnavailable atomic.Bool
+
 // CommandPlugin结构体定义
 type CommandPlugin struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
+	sandbox      config.CommandSandbox
+	workDir      string    // 沙箱的工作目录
+	ownsWorkDir  bool      // 工作目录是否由插件创建，卸载时删除
+	jobs         *jobTable // 后台任务
 }
 
-// Init方法用于初始化插件
+// Init方法用于初始化插件，启用沙箱时准备工作目录
 func (c *CommandPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
 	c.cfg = cfg
 	c.openaiClient = openaiClient
+	c.sandbox = cfg.CommandSandbox()
+	c.jobs = newJobTable()
+	if !c.sandbox.Enabled {
+		return nil
+	}
+	for _, name := range c.sandbox.AllowedCommands {
+		if launcherPrograms[name] {
+			return fmt.Errorf("沙箱不能允许%s：它可以执行其他程序", name)
+		}
+	}
+
+	if c.sandbox.WorkDir != "" {
+		if err := os.MkdirAll(c.sandbox.WorkDir, 0o700); err != nil {
+			return fmt.Errorf("创建沙箱工作目录失败: %v", err)
+		}
+		c.workDir, c.ownsWorkDir = c.sandbox.WorkDir, false
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "command-sandbox-")
+	if err != nil {
+		return fmt.Errorf("创建沙箱工作目录失败: %v", err)
+	}
+	c.workDir, c.ownsWorkDir = dir, true
 	return nil
 }
 
+// Shutdown方法终止所有后台任务，并删除插件创建的沙箱工作目录
+func (c *CommandPlugin) Shutdown(ctx context.Context) error {
+	if c.jobs != nil {
+		c.jobs.killAll(ctx)
+	}
+	if !c.ownsWorkDir {
+		return nil
+	}
+	c.ownsWorkDir = false
+	return os.RemoveAll(c.workDir)
+}
+
 // ID方法返回插件的唯一标识符
 func (c CommandPlugin) ID() string {
 	return "command"
@@ -38,11 +135,17 @@ func (c CommandPlugin) Description() string {
 	return "这个是一台Linux电脑的终端，可以通过它获取很多你想要的信息，但只能执行不需要交互的Linux命令。"
 }
 
-// FunctionDefinition方法返回OpenAI函数定义
+// FunctionDefinition方法返回OpenAI函数定义，沙箱模式下告诉模型可用的命令和限制
 func (c CommandPlugin) FunctionDefinition() openai.FunctionDefinition {
+	description := "执行指定的Linux命令，以JSON返回stdout、stderr、exit_code等结果，success为false表示命令执行失败。注意：该命令必须是不需要用户交互的。" +
+		"不会自行结束的命令（例如ping、tail -f）必须设置background为true在后台运行，之后用command_job_output读取输出，用command_job_kill结束。"
+	if c.sandbox.Enabled {
+		description += "命令在沙箱中执行，不经过shell，不支持管道、重定向、变量和多条命令，参数中不能使用绝对路径和..，只能执行以下程序：" +
+			strings.Join(c.allowedCommands(), "、") + "。后台任务同样会在" + c.DefaultTimeout().String() + "后被终止。"
+	}
 	return openai.FunctionDefinition{
 		Name:        "command",
-		Description: "执行指定的Linux命令并返回结果。注意：该命令必须是不需要用户交互的。",
+		Description: description,
 		Parameters: jsonschema.Definition{
 			Type: jsonschema.Object,
 			Properties: map[string]jsonschema.Definition{
@@ -50,34 +153,702 @@ func (c CommandPlugin) FunctionDefinition() openai.FunctionDefinition {
 					Type:        jsonschema.String,
 					Description: "要执行的不需要交互的命令",
 				},
+				"background": {
+					Type:        jsonschema.Boolean,
+					Description: "是否在后台运行，为true时立即返回任务ID",
+				},
 			},
 			Required: []string{"command"},
 		},
 	}
 }
 
+// DefaultTimeout方法返回命令的默认执行超时时间
+func (c CommandPlugin) DefaultTimeout() time.Duration {
+	if c.sandbox.Enabled {
+		if c.sandbox.Timeout > 0 {
+			return c.sandbox.Timeout
+		}
+		return defaultSandboxTimeout
+	}
+	return 60 * time.Second
+}
+
+// JobInput 查询和结束后台任务的参数
+type JobInput struct {
+	JobID string `json:"job_id" description:"后台任务ID，由background为true的command返回"`
+}
+
+// JobStdinInput command_job_input工具的参数
+type JobStdinInput struct {
+	JobID string `json:"job_id" description:"后台任务ID"`
+	Input string `json:"input" description:"写入任务标准输入的文本，末尾会自动加上换行"`
+	Close bool   `json:"close,omitempty" description:"写入后关闭标准输入，通知任务输入已结束"`
+}
+
+// JobListInput command_job_list工具没有参数
+type JobListInput struct{}
+
+// FunctionDefinitions方法返回执行命令和管理后台任务的工具
+func (c CommandPlugin) FunctionDefinitions() []openai.FunctionDefinition {
+	return []openai.FunctionDefinition{
+		c.FunctionDefinition(),
+		plugins.FunctionDefinitionFor[JobInput]("command_job_output", "读取后台任务上次读取之后的新输出，并返回任务是否仍在运行和退出码。"),
+		plugins.FunctionDefinitionFor[JobStdinInput]("command_job_input", "向后台任务的标准输入写入一行文本。"),
+		plugins.FunctionDefinitionFor[JobInput]("command_job_kill", "结束后台任务，返回任务最后的输出和状态，之后任务ID失效。"),
+		plugins.FunctionDefinitionFor[JobListInput]("command_job_list", "列出所有后台任务及其状态。"),
+	}
+}
+
+// ExecuteFunction方法按工具名执行命令或管理后台任务
+func (c CommandPlugin) ExecuteFunction(ctx context.Context, name string, jsonInput string) (string, error) {
+	switch name {
+	case "command":
+		return c.ExecuteContext(ctx, jsonInput)
+	case "command_job_output":
+		return plugins.CallTyped(ctx, name, jsonInput, c.jobOutput)
+	case "command_job_input":
+		return plugins.CallTyped(ctx, name, jsonInput, c.jobStdin)
+	case "command_job_kill":
+		return plugins.CallTyped(ctx, name, jsonInput, c.jobKill)
+	case "command_job_list":
+		return plugins.CallTyped(ctx, name, jsonInput, c.jobList)
+	default:
+		return "", fmt.Errorf("未知的工具：%s", name)
+	}
+}
+
+// ToolRisk方法声明执行任意命令是危险操作，默认需要用户确认；读取后台任务的输出和列表是只读操作
+func (c CommandPlugin) ToolRisk(tool string) plugins.ToolRisk {
+	switch tool {
+	case "command_job_output", "command_job_list":
+		return plugins.RiskReadOnly
+	case "command_job_input", "command_job_kill":
+		return plugins.RiskSideEffect
+	default:
+		return plugins.RiskDangerous
+	}
+}
+
 // Execute方法执行插件的主要功能，执行指定命令
 func (c CommandPlugin) Execute(jsonInput string) (string, error) {
+	return c.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，ctx被取消或超时时终止正在执行的命令
+func (c CommandPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	// 解析输入参数
 	var input struct {
-		Command string `json:"command"`
+		Command    string `json:"command"`
+		Background bool   `json:"background"`
 	}
 	if err := json.Unmarshal([]byte(jsonInput), &input); err != nil {
 		return "", fmt.Errorf("输入解析错误: %v", err)
 	}
+	if input.Background {
+		return c.startJob(input.Command)
+	}
 
-	// 执行命令
-	cmd := exec.Command("bash", "-c", input.Command)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
+	stdout := &limitedBuffer{limit: c.maxOutputBytes()}
+	stderr := &limitedBuffer{limit: c.maxOutputBytes()}
+	start := time.Now()
+	cmd, err := c.startCommand(ctx, input.Command, stdout, stderr, nil)
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Wait()
 
-	if err := cmd.Run(); err != nil {
+	result := CommandResult{
+		Command:         input.Command,
+		Stdout:          stdout.String(),
+		Stderr:          stderr.String(),
+		StdoutTruncated: stdout.dropped > 0,
+		StderrTruncated: stderr.dropped > 0,
+		DurationMs:      time.Since(start).Milliseconds(),
+	}
+	// 命令以非0状态退出或被信号终止时仍然返回结果，让模型看到失败原因
+	result.ExitCode, result.Signal, err = exitStatus(err)
+	if err != nil {
+		return "", err
+	}
+	result.TimedOut = result.Signal != "" && ctx.Err() != nil
+	result.Success = result.ExitCode == 0 && result.Signal == ""
+	return marshalResult(result)
+}
+
+// exitStatus把cmd.Wait的错误转换为退出码和终止信号，其他错误原样返回
+func exitStatus(err error) (exitCode int, signal string, _ error) {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil, errors.Is(err, exec.ErrWaitDelay):
+		return 0, "", nil
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			signal = status.Signal().String()
+		}
+		return exitErr.ExitCode(), signal, nil
+	default:
+		return 0, "", fmt.Errorf("命令执行错误: %v", err)
+	}
+}
+
+// marshalResult把结果编码为返回给模型的JSON
+func marshalResult(result interface{}) (string, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// CommandResult 命令的执行结果，以JSON返回给模型
+type CommandResult struct {
+	Command         string `json:"command"`
+	Success         bool   `json:"success"`          // 退出码为0且没有被信号终止
+	ExitCode        int    `json:"exit_code"`        // 被信号终止时为-1
+	Signal          string `json:"signal,omitempty"` // 终止命令的信号，例如超时或超出资源限制
+	TimedOut        bool   `json:"timed_out"`
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated"`
+	StderrTruncated bool   `json:"stderr_truncated"`
+	DurationMs      int64  `json:"duration_ms"`
+}
+
+// startCommand方法按插件的模式启动命令，ctx结束时终止命令；stdin为nil时标准输入为空
+func (c CommandPlugin) startCommand(ctx context.Context, command string, stdout, stderr io.Writer, stdin io.Reader) (*exec.Cmd, error) {
+	if c.sandbox.Enabled {
+		return c.startSandboxed(ctx, command, stdout, stderr, stdin)
+	}
+	return startShell(ctx, command, stdout, stderr, stdin)
+}
+
+// startShell在bash中启动命令
+func startShell(ctx context.Context, command string, stdout, stderr io.Writer, stdin io.Reader) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.WaitDelay = time.Second // 命令被终止后，最多再等待1秒回收子进程持有的输出管道
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Stdin = stdin
+	killProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("命令执行错误: %v", err)
+	}
+	return cmd, nil
+}
+
+// startSandboxed方法在沙箱中启动命令：
+// 命令按参数拆分后直接执行允许的程序，不经过shell；使用独立的工作目录和干净的环境变量，
+// 通过rlimit限制CPU时间和内存，系统支持时放进独立的网络命名空间，超时后终止整个进程组
+func (c CommandPlugin) startSandboxed(ctx context.Context, command string, stdout, stderr io.Writer, stdin io.Reader) (*exec.Cmd, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("命令被沙箱拒绝: %v", err)
+	}
+	program, err := c.resolveProgram(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("命令被沙箱拒绝: %v", err)
+	}
+	if err := checkArguments(args[0], args[1:]); err != nil {
+		return nil, fmt.Errorf("命令被沙箱拒绝: %v", err)
+	}
+
+	cpu, memory := c.sandbox.CPUSeconds, c.sandbox.MemoryBytes
+	if cpu == 0 {
+		cpu = defaultCPUSeconds
+	}
+	if memory == 0 {
+		memory = defaultMemoryBytes
+	}
+	// Go无法在exec之前为子进程设置rlimit，由sh设置限制后再exec目标程序，命令参数作为位置参数传入，不会被sh解析
+	wrapper := append([]string{
+		"-c", `ulimit -t "$1" && ulimit -v "$2" && shift 2 && exec "$@"`, "sh",
+		strconv.FormatUint(cpu, 10), strconv.FormatUint(memory/1024, 10), program,
+	}, args[1:]...)
+
+	isolateNetwork := !c.sandbox.AllowNetwork && !netnsUnavailable.Load()
+	for {
+		cmd := exec.CommandContext(ctx, "/bin/sh", wrapper...)
+		cmd.Dir = c.workDir
+		cmd.Env = []string{
+			"PATH=" + strings.Join(sandboxPath, ":"),
+			"HOME=" + c.workDir,
+			"TMPDIR=" + c.workDir,
+			"LANG=C.UTF-8",
+		}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.Stdin = stdin
+		cmd.WaitDelay = time.Second
+		cmd.SysProcAttr = sandboxAttr(isolateNetwork)
+		killProcessGroup(cmd)
+
+		if err := cmd.Start(); err != nil {
+			if isolateNetwork {
+				// 系统不支持网络命名空间时退回到共享网络的沙箱
+				netnsUnavailable.Store(true)
+				isolateNetwork = false
+				continue
+			}
+			return nil, fmt.Errorf("命令执行错误: %v", err)
+		}
+		return cmd, nil
+	}
+}
+
+// allowedCommands方法返回沙箱允许执行的程序名
+func (c CommandPlugin) allowedCommands() []string {
+	if len(c.sandbox.AllowedCommands) > 0 {
+		return c.sandbox.AllowedCommands
+	}
+	return defaultAllowedCommands
+}
+
+// resolveProgram方法检查程序是否允许执行，并在沙箱的PATH中查找程序的完整路径
+func (c CommandPlugin) resolveProgram(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return "", fmt.Errorf("不允许使用路径执行程序: %s", name)
+	}
+	if launcherPrograms[name] {
+		return "", fmt.Errorf("程序%s可以执行其他程序，沙箱中不允许执行", name)
+	}
+	allowed := false
+	for _, a := range c.allowedCommands() {
+		if a == name {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("程序%s不在允许列表中", name)
+	}
+	for _, dir := range sandboxPath {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("找不到程序: %s", name)
+}
+
+// checkArguments检查程序的参数，把文件访问限制在工作目录内：
+// 拒绝绝对路径（包括--file=/path和-f/path形式的选项值）和..，以及forbiddenOptions中的选项；
+// cut -d/这样以/作为选项值的参数仍然允许
+func checkArguments(program string, args []string) error {
+	for _, arg := range args {
+		slash := strings.IndexByte(arg, '/')
+		shortValue := strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && slash >= 2 && slash < len(arg)-1
+		if strings.HasPrefix(arg, "/") || strings.Contains(arg, "=/") || shortValue {
+			return fmt.Errorf("参数%q使用了绝对路径，只能访问工作目录中的文件", arg)
+		}
+		for _, part := range strings.FieldsFunc(arg, func(r rune) bool { return r == '/' || r == '=' }) {
+			if part == ".." {
+				return fmt.Errorf("参数%q使用了..，只能访问工作目录中的文件", arg)
+			}
+		}
+		for _, option := range forbiddenOptions[program] {
+			if matchOption(arg, option) {
+				return fmt.Errorf("不允许使用%s的%s选项", program, option)
+			}
+		}
+	}
+	return nil
+}
+
+// matchOption判断参数是否使用了选项：长选项包括--name=value和GNU允许的缩写，短选项包括-abc形式的组合
+func matchOption(arg, option string) bool {
+	if strings.HasPrefix(option, "--") {
+		name, _, _ := strings.Cut(arg, "=")
+		return len(name) > 2 && strings.HasPrefix(name, "--") && strings.HasPrefix(option, name)
+	}
+	return len(arg) > 1 && arg[0] == '-' && !strings.HasPrefix(arg, "--") && strings.ContainsRune(arg[1:], rune(option[1]))
+}
+
+// splitCommand把命令按shell的规则拆分为参数，支持单引号、双引号和反斜杠转义
+// 未加引号的shell控制字符（管道、重定向、变量、命令替换、多条命令等）会被拒绝，而不是交给shell执行
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			case '$', '`':
+				return nil, errors.New("不支持变量和命令替换")
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case strings.ContainsRune("|&;<>()$`*?[]{}~!#\n\r", r):
+			return nil, fmt.Errorf("不支持shell控制字符%q", r)
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("引号或转义不完整")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("命令为空")
+	}
+	return args, nil
+}
+
+// maxOutputBytes方法返回返回给模型的最大输出长度
+func (c CommandPlugin) maxOutputBytes() int {
+	if c.sandbox.MaxOutputBytes > 0 {
+		return c.sandbox.MaxOutputBytes
+	}
+	return defaultMaxOutputBytes
+}
+
+// limitedBuffer只保留前limit字节的输出，超出部分只计数，String时附上截断标记
+type limitedBuffer struct {
+	buf     bytes.Buffer
+	limit   int
+	dropped int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.dropped += len(p) - max(room, 0)
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// String返回保留的输出，输出被截断时在末尾注明省略的字节数，让模型知道结果不完整
+func (b *limitedBuffer) String() string {
+	if b.dropped == 0 {
+		return b.buf.String()
+	}
+	return fmt.Sprintf("%s\n[truncated: 输出超过%d字节，已省略%d字节]", strings.ToValidUTF8(b.buf.String(), ""), b.limit, b.dropped)
+}
+
+// JobStatus 后台任务的状态，以JSON返回给模型
+type JobStatus struct {
+	JobID         string `json:"job_id"`
+	Command       string `json:"command"`
+	Running       bool   `json:"running"`
+	ExitCode      *int   `json:"exit_code,omitempty"` // 任务结束后才有退出码，被信号终止时为-1
+	Signal        string `json:"signal,omitempty"`
+	TimedOut      bool   `json:"timed_out,omitempty"`      // 沙箱模式下任务运行超过Timeout被终止
+	Output        string `json:"output,omitempty"`         // 上次读取之后的新输出，stdout和stderr按产生顺序合并
+	OutputDropped int    `json:"output_dropped,omitempty"` // 未读输出超出上限时丢弃的较早输出字节数
+	DurationMs    int64  `json:"duration_ms"`
+}
+
+// job 一个后台任务
+type job struct {
+	id      string
+	command string
+	started time.Time
+	cancel  context.CancelFunc
+	done    chan struct{} // 任务结束后关闭
+
+	stdinMu sync.Mutex
+	stdin   *os.File // 任务标准输入的写入端，任务结束或关闭输入后为nil
+
+	mu       sync.Mutex
+	unread   []byte
+	dropped  int
+	exitCode int
+	signal   string
+	timedOut bool
+	finished time.Time
+}
+
+// Write保存任务的输出，未读输出超过jobOutputBytes时丢弃最早的部分
+func (j *job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.unread = append(j.unread, p...)
+	if over := len(j.unread) - jobOutputBytes; over > 0 {
+		j.unread = append(j.unread[:0], j.unread[over:]...)
+		j.dropped += over
+	}
+	return len(p), nil
+}
+
+// running返回任务是否仍在运行
+func (j *job) running() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// status返回任务的状态，readOutput为true时取走未读输出
+func (j *job) status(readOutput bool) JobStatus {
+	running := j.running()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := JobStatus{JobID: j.id, Command: j.command, Running: running}
+	end := time.Now()
+	if !running {
+		exitCode := j.exitCode
+		status.ExitCode, status.Signal, status.TimedOut, end = &exitCode, j.signal, j.timedOut, j.finished
+	}
+	status.DurationMs = end.Sub(j.started).Milliseconds()
+	if readOutput {
+		status.Output = strings.ToValidUTF8(string(j.unread), "")
+		status.OutputDropped = j.dropped
+		j.unread, j.dropped = nil, 0
+	}
+	return status
+}
+
+// closeStdin关闭任务的标准输入
+func (j *job) closeStdin() {
+	j.stdinMu.Lock()
+	defer j.stdinMu.Unlock()
+	if j.stdin != nil {
+		j.stdin.Close()
+		j.stdin = nil
+	}
+}
+
+// jobTable 插件的后台任务表，最多保留maxJobs个任务
+type jobTable struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*job
+}
+
+func newJobTable() *jobTable {
+	return &jobTable{jobs: make(map[string]*job)}
+}
+
+// add把任务加入任务表并分配ID，任务表已满时先清理最早结束的任务，所有任务都在运行时返回错误
+func (t *jobTable) add(j *job) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.jobs) >= maxJobs {
+		var oldest *job
+		for _, other := range t.jobs {
+			if !other.running() && (oldest == nil || other.started.Before(oldest.started)) {
+				oldest = other
+			}
+		}
+		if oldest == nil {
+			return fmt.Errorf("后台任务已达上限%d个，请先用command_job_kill结束不需要的任务", maxJobs)
+		}
+		delete(t.jobs, oldest.id)
+	}
+	t.nextID++
+	j.id = fmt.Sprintf("job-%d", t.nextID)
+	t.jobs[j.id] = j
+	return nil
+}
+
+// get按ID查找任务
+func (t *jobTable) get(id string) (*job, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("找不到后台任务：%s", id)
+	}
+	return j, nil
+}
+
+// remove从任务表中删除任务
+func (t *jobTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.jobs, id)
+}
+
+// list按ID顺序返回所有任务
+func (t *jobTable) list() []*job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]*job, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].started.Before(jobs[b].started) })
+	return jobs
+}
+
+// killAll终止所有任务并清空任务表，等待任务退出直到ctx结束
+func (t *jobTable) killAll(ctx context.Context) {
+	t.mu.Lock()
+	jobs := t.jobs
+	t.jobs = make(map[string]*job)
+	t.mu.Unlock()
+
+	for _, j := range jobs {
+		j.cancel()
+	}
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startJob方法在后台启动命令并立即返回任务ID
+// 后台任务不受工具调用超时的限制，在被command_job_kill结束或插件卸载时终止；
+// 沙箱模式下仍受CPU和内存限制，并且和前台命令一样在沙箱的Timeout后被终止
+func (c CommandPlugin) startJob(command string) (string, error) {
+	if c.jobs == nil {
+		return "", fmt.Errorf("插件未初始化")
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.sandbox.Enabled {
+		ctx, cancel = context.WithTimeout(context.Background(), c.DefaultTimeout())
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	j := &job{command: command, started: time.Now(), cancel: cancel, done: make(chan struct{})}
+	if err := c.jobs.add(j); err != nil {
+		cancel()
+		return "", err
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		c.jobs.remove(j.id)
 		return "", fmt.Errorf("命令执行错误: %v", err)
 	}
+	cmd, err := c.startCommand(ctx, command, j, j, stdinR)
+	stdinR.Close()
+	if err != nil {
+		cancel()
+		stdinW.Close()
+		c.jobs.remove(j.id)
+		return "", err
+	}
+	j.stdin = stdinW
 
-	// 返回命令输出
-	return out.String(), nil
+	go func() {
+		exitCode, signal, err := exitStatus(cmd.Wait())
+		if err != nil {
+			exitCode = -1
+			fmt.Fprintf(j, "\n%v\n", err)
+		}
+		j.mu.Lock()
+		j.exitCode, j.signal, j.finished = exitCode, signal, time.Now()
+		j.timedOut = signal != "" && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		j.mu.Unlock()
+		j.closeStdin()
+		close(j.done)
+		cancel()
+	}()
+
+	// 稍等片刻，让立即失败的命令（例如命令不存在）直接返回结果
+	select {
+	case <-j.done:
+	case <-time.After(200 * time.Millisecond):
+	}
+	return marshalResult(j.status(true))
+}
+
+// jobOutput方法返回后台任务的新输出和状态
+func (c CommandPlugin) jobOutput(ctx context.Context, input JobInput) (string, error) {
+	j, err := c.jobs.get(input.JobID)
+	if err != nil {
+		return "", err
+	}
+	return marshalResult(j.status(true))
+}
+
+// jobStdin方法向后台任务的标准输入写入一行文本
+func (c CommandPlugin) jobStdin(ctx context.Context, input JobStdinInput) (string, error) {
+	j, err := c.jobs.get(input.JobID)
+	if err != nil {
+		return "", err
+	}
+	j.stdinMu.Lock()
+	stdin := j.stdin
+	if stdin == nil {
+		j.stdinMu.Unlock()
+		return "", fmt.Errorf("后台任务%s已结束或已关闭标准输入", input.JobID)
+	}
+	// 任务不读取输入时管道写满会阻塞，最多等待到工具调用超时
+	if deadline, ok := ctx.Deadline(); ok {
+		stdin.SetWriteDeadline(deadline)
+	}
+	_, err = io.WriteString(stdin, input.Input+"\n")
+	j.stdinMu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("写入标准输入失败: %v", err)
+	}
+	if input.Close {
+		j.closeStdin()
+	}
+	return marshalResult(j.status(true))
+}
+
+// jobKill方法结束后台任务并从任务表中删除
+func (c CommandPlugin) jobKill(ctx context.Context, input JobInput) (string, error) {
+	j, err := c.jobs.get(input.JobID)
+	if err != nil {
+		return "", err
+	}
+	j.cancel()
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	c.jobs.remove(j.id)
+	return marshalResult(j.status(true))
+}
+
+// jobList方法返回所有后台任务的状态，不读取输出
+func (c CommandPlugin) jobList(ctx context.Context, input JobListInput) (string, error) {
+	jobs := c.jobs.list()
+	statuses := make([]JobStatus, len(jobs))
+	for i, j := range jobs {
+		statuses[i] = j.status(false)
+	}
+	return marshalResult(statuses)
 }
 
 func main() {
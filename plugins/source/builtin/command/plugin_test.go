@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{command: "ls -l", want: []string{"ls", "-l"}},
+		{command: "  echo   a\tb  ", want: []string{"echo", "a", "b"}},
+		{command: `echo 'a b' "c d"`, want: []string{"echo", "a b", "c d"}},
+		{command: `echo "a;b|c"`, want: []string{"echo", "a;b|c"}},
+		{command: `echo a\ b`, want: []string{"echo", "a b"}},
+		{command: `echo "say \"hi\""`, want: []string{"echo", `say "hi"`}},
+		{command: `echo ''`, want: []string{"echo", ""}},
+		{command: `echo '$HOME'`, want: []string{"echo", "$HOME"}},
+		{command: "ls; id", wantErr: true},
+		{command: "ls | sh", wantErr: true},
+		{command: "ls && id", wantErr: true},
+		{command: "cat < /etc/passwd", wantErr: true},
+		{command: "echo hi > out", wantErr: true},
+		{command: "echo $HOME", wantErr: true},
+		{command: "echo `id`", wantErr: true},
+		{command: `echo "$(id)"`, wantErr: true},
+		{command: "ls *", wantErr: true},
+		{command: "ls ~", wantErr: true},
+		{command: "ls\nid", wantErr: true},
+		{command: `echo "unterminated`, wantErr: true},
+		{command: `echo trailing\`, wantErr: true},
+		{command: "   ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, err := splitCommand(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveProgram(t *testing.T) {
+	plugin := CommandPlugin{}
+	custom := CommandPlugin{sandbox: config.CommandSandbox{AllowedCommands: []string{"echo", "env"}}}
+
+	tests := []struct {
+		name    string
+		plugin  CommandPlugin
+		program string
+		errLike string
+	}{
+		{name: "allowed", plugin: plugin, program: "echo"},
+		{name: "not allowed", plugin: plugin, program: "rm", errLike: "不在允许列表中"},
+		{name: "path", plugin: plugin, program: "/bin/echo", errLike: "不允许使用路径"},
+		{name: "relative path", plugin: plugin, program: "./echo", errLike: "不允许使用路径"},
+		{name: "configured list", plugin: custom, program: "echo"},
+		{name: "not in configured list", plugin: custom, program: "ls", errLike: "不在允许列表中"},
+		{name: "launcher", plugin: plugin, program: "env", errLike: "可以执行其他程序"},
+		{name: "configured launcher", plugin: custom, program: "env", errLike: "可以执行其他程序"},
+		{name: "shell", plugin: custom, program: "sh", errLike: "可以执行其他程序"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.plugin.resolveProgram(tt.program)
+			if tt.errLike == "" {
+				if err != nil && !strings.Contains(err.Error(), "找不到程序") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errLike) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.errLike)
+			}
+		})
+	}
+}
+
+func TestInitRejectsLaunchers(t *testing.T) {
+	cfg := config.New().SetCommandSandbox(config.CommandSandbox{Enabled: true, AllowedCommands: []string{"ls", "xargs"}})
+	var plugin CommandPlugin
+	if err := plugin.Init(cfg, nil); err == nil {
+		plugin.Shutdown(context.Background())
+		t.Fatal("Init accepted xargs in AllowedCommands")
+	}
+}
+
+func TestCheckArguments(t *testing.T) {
+	tests := []struct {
+		program string
+		args    []string
+		wantErr bool
+	}{
+		{program: "ls", args: []string{"-la", "dir/file"}},
+		{program: "date", args: []string{"+%Y-%m-%d"}},
+		{program: "cut", args: []string{"-d/", "-f1", "list.txt"}},
+		{program: "grep", args: []string{"-r", "a/b", "."}},
+		{program: "echo", args: []string{"1/2", "..."}},
+		{program: "cat", args: []string{"/etc/shadow"}, wantErr: true},
+		{program: "cat", args: []string{"../secret"}, wantErr: true},
+		{program: "cat", args: []string{"dir/../../secret"}, wantErr: true},
+		{program: "cat", args: []string{".."}, wantErr: true},
+		{program: "grep", args: []string{"--file=/etc/passwd", "x"}, wantErr: true},
+		{program: "grep", args: []string{"--file=../x", "y"}, wantErr: true},
+		{program: "grep", args: []string{"-f/etc/passwd", "x"}, wantErr: true},
+		{program: "date", args: []string{"-s", "2020-01-01"}, wantErr: true},
+		{program: "date", args: []string{"--set=2020-01-01"}, wantErr: true},
+		{program: "date", args: []string{"--se", "2020-01-01"}, wantErr: true},
+		{program: "date", args: []string{"-uf", "dates"}, wantErr: true},
+		{program: "sort", args: []string{"-o", "out", "in"}, wantErr: true},
+		{program: "sort", args: []string{"-ro", "out", "in"}, wantErr: true},
+		{program: "sort", args: []string{"--out=out", "in"}, wantErr: true},
+		{program: "sort", args: []string{"--compress-program=sh", "in"}, wantErr: true},
+		{program: "sort", args: []string{"-r", "in"}},
+		{program: "ls", args: []string{"-s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.program+" "+strings.Join(tt.args, " "), func(t *testing.T) {
+			err := checkArguments(tt.program, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecuteSandboxed(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "note.txt"), []byte("hello\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New().SetCommandSandbox(config.CommandSandbox{Enabled: true, WorkDir: workDir, MaxOutputBytes: 8})
+	var plugin CommandPlugin
+	if err := plugin.Init(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Shutdown(context.Background())
+
+	tests := []struct {
+		command  string
+		want     string
+		wantFail bool // 命令以非0状态退出，stderr中有错误信息
+		errLike  string
+	}{
+		{command: "cat note.txt", want: "hello\n"},
+		{command: "pwd", want: workDir[:8] + "\n[truncated: 输出超过8字节，已省略" + strconv.Itoa(len(workDir)-7) + "字节]"},
+		{command: "cat missing.txt", wantFail: true},
+		{command: "echo a; id", errLike: "命令被沙箱拒绝"},
+		{command: "rm note.txt", errLike: "不在允许列表中"},
+		{command: "cat ../note.txt", errLike: "命令被沙箱拒绝"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, err := plugin.ExecuteContext(context.Background(), `{"command":"`+tt.command+`"}`)
+			if tt.errLike != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errLike) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.errLike)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result CommandResult
+			if err := json.Unmarshal([]byte(got), &result); err != nil {
+				t.Fatalf("output %s is not a CommandResult: %v", got, err)
+			}
+			if tt.wantFail {
+				if result.Success || result.ExitCode == 0 || result.Stderr == "" {
+					t.Errorf("result = %+v, want a failure with stderr", result)
+				}
+				return
+			}
+			if !result.Success || result.Stdout != tt.want || result.StdoutTruncated != (tt.command == "pwd") {
+				t.Errorf("result = %+v, want stdout %q", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteShell(t *testing.T) {
+	var plugin CommandPlugin
+	if err := plugin.Init(config.New(), nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := plugin.ExecuteContext(context.Background(), `{"command":"echo out; echo err >&2; exit 3"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result CommandResult
+	if err := json.Unmarshal([]byte(got), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Success || result.ExitCode != 3 || result.Stdout != "out\n" || result.Stderr != "err\n" {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+// callJob 调用command插件的工具并解码返回的JobStatus
+func callJob(t *testing.T, plugin *CommandPlugin, tool string, input string) JobStatus {
+	t.Helper()
+	output, err := plugin.ExecuteFunction(context.Background(), tool, input)
+	if err != nil {
+		t.Fatalf("%s(%s): %v", tool, input, err)
+	}
+	var status JobStatus
+	if err := json.Unmarshal([]byte(output), &status); err != nil {
+		t.Fatalf("%s returned %s: %v", tool, output, err)
+	}
+	return status
+}
+
+// waitJob 轮询后台任务直到结束，返回期间读到的全部输出和最后的状态
+func waitJob(t *testing.T, plugin *CommandPlugin, id string) (string, JobStatus) {
+	t.Helper()
+	var output strings.Builder
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status := callJob(t, plugin, "command_job_output", `{"job_id":"`+id+`"}`)
+		output.WriteString(status.Output)
+		if !status.Running {
+			return output.String(), status
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return "", JobStatus{}
+}
+
+func TestBackgroundJob(t *testing.T) {
+	var plugin CommandPlugin
+	if err := plugin.Init(config.New(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Shutdown(context.Background())
+
+	started := callJob(t, &plugin, "command", `{"command":"read line; echo got $line; exit 4","background":true}`)
+	if started.JobID == "" || !started.Running {
+		t.Fatalf("started = %+v, want a running job", started)
+	}
+	// 写入输入的结果中可能已经带有任务的输出
+	written := callJob(t, &plugin, "command_job_input", `{"job_id":"`+started.JobID+`","input":"hi","close":true}`)
+	output, status := waitJob(t, &plugin, started.JobID)
+	if output = written.Output + output; output != "got hi\n" || status.ExitCode == nil || *status.ExitCode != 4 {
+		t.Errorf("output = %q, status = %+v, want exit code 4", output, status)
+	}
+	if _, err := plugin.ExecuteFunction(context.Background(), "command_job_input", `{"job_id":"`+started.JobID+`","input":"again"}`); err == nil {
+		t.Error("writing to a finished job succeeded")
+	}
+
+	sleeping := callJob(t, &plugin, "command", `{"command":"sleep 30","background":true}`)
+	output, err := plugin.ExecuteFunction(context.Background(), "command_job_list", `{}`)
+	var list []JobStatus
+	if err != nil || json.Unmarshal([]byte(output), &list) != nil || len(list) != 2 || !list[1].Running {
+		t.Errorf("job list = %s, %v", output, err)
+	}
+	killed := callJob(t, &plugin, "command_job_kill", `{"job_id":"`+sleeping.JobID+`"}`)
+	if killed.Running || killed.Signal == "" {
+		t.Errorf("killed = %+v, want a job terminated by a signal", killed)
+	}
+	if _, err := plugin.ExecuteFunction(context.Background(), "command_job_output", `{"job_id":"`+sleeping.JobID+`"}`); err == nil {
+		t.Error("killed job is still in the job table")
+	}
+}
+
+func TestSandboxedJobTimeout(t *testing.T) {
+	cfg := config.New().SetCommandSandbox(config.CommandSandbox{
+		Enabled:         true,
+		WorkDir:         t.TempDir(),
+		AllowedCommands: []string{"sleep"},
+		Timeout:         200 * time.Millisecond,
+	})
+	var plugin CommandPlugin
+	if err := plugin.Init(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Shutdown(context.Background())
+
+	started := callJob(t, &plugin, "command", `{"command":"sleep 30","background":true}`)
+	_, status := waitJob(t, &plugin, started.JobID)
+	if !status.TimedOut || status.Signal == "" || status.DurationMs > 2000 {
+		t.Errorf("status = %+v, want the job killed after the sandbox timeout", status)
+	}
+}
+
+func TestJobOutputLimit(t *testing.T) {
+	j := &job{done: make(chan struct{})}
+	j.Write([]byte(strings.Repeat("a", jobOutputBytes)))
+	j.Write([]byte("bcd"))
+	status := j.status(true)
+	if status.OutputDropped != 3 || len(status.Output) != jobOutputBytes || !strings.HasSuffix(status.Output, "abcd") {
+		t.Errorf("dropped = %d, output length = %d", status.OutputDropped, len(status.Output))
+	}
+	if again := j.status(true); again.Output != "" || again.OutputDropped != 0 {
+		t.Errorf("output was not consumed: %+v", again)
+	}
+}
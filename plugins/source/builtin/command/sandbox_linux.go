@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup让命令在独立的进程组中运行，终止时结束整个进程组，避免命令启动的子进程继续运行
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// sandboxAttr返回沙箱进程的属性，isolateNetwork为true时在新的用户和网络命名空间中运行
+// 新的网络命名空间只有未启用的回环接口，命令无法访问网络；用户命名空间把当前用户映射为自身，不提升权限
+func sandboxAttr(isolateNetwork bool) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	if isolateNetwork {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+	return attr
+}
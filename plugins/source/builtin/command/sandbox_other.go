@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// 其他系统没有网络命名空间，沙箱中的命令与插件共享网络
+func init() {
+	netnsUnavailable.Store(true)
+}
+
+// killProcessGroup在其他系统上使用exec的默认行为，终止时只结束命令本身，命令启动的子进程可能继续运行
+func killProcessGroup(cmd *exec.Cmd) {}
+
+// sandboxAttr在其他系统上不设置额外的进程属性
+func sandboxAttr(isolateNetwork bool) *syscall.SysProcAttr {
+	return nil
+}
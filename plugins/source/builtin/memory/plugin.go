@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	milvus "github.com/milvus-io/milvus-sdk-go/v2/client"
 	"github.com/milvus-io/milvus-sdk-go/v2/entity"
@@ -116,7 +117,47 @@ func (c Memory) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+// DefaultTimeout 返回记忆插件的默认执行超时时间，hydrate需要多次检索，因此较长
+func (c Memory) DefaultTimeout() time.Duration {
+	return 60 * time.Second
+}
+
+// ConcurrentSafe 表示记忆插件可以被并发调用，milvus和openai客户端都是并发安全的
+func (c Memory) ConcurrentSafe() bool {
+	return true
+}
+
+// Shutdown 关闭milvus连接
+func (c *Memory) Shutdown(ctx context.Context) error {
+	if c.milvusClient == nil {
+		return nil
+	}
+	return c.milvusClient.Close()
+}
+
+// Health 检查milvus服务是否可用
+func (c *Memory) Health() error {
+	if c.milvusClient == nil {
+		return fmt.Errorf("milvus客户端未初始化")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state, err := c.milvusClient.CheckHealth(ctx)
+	if err != nil {
+		return err
+	}
+	if !state.IsHealthy {
+		return fmt.Errorf("milvus不可用: %s", strings.Join(state.Reasons, "; "))
+	}
+	return nil
+}
+
 func (c Memory) Execute(jsonInput string) (string, error) {
+	return c.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext 与Execute相同，向量检索和embedding请求会在ctx取消时终止
+func (c Memory) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	// marshal jsonInput to inputDefinition
 	var args inputDefinition
 	err := json.Unmarshal([]byte(jsonInput), &args)
@@ -138,7 +179,7 @@ func (c Memory) Execute(jsonInput string) (string, error) {
 	case "set":
 		// Iterate over all memories and set them
 		for _, memory := range args.Memories {
-			ok, err := c.setMemory(memory.Memory, memory.Type, memory.Detail)
+			ok, err := c.setMemory(ctx, memory.Memory, memory.Type, memory.Detail)
 			if err != nil {
 				fmt.Println("Error setting memory: ", err)
 				return fmt.Sprintf(`%v`, err), err
@@ -152,7 +193,7 @@ func (c Memory) Execute(jsonInput string) (string, error) {
 
 	case "get":
 		// Note: This assumes that for 'get', you'll retrieve memories based on the first item in the memories slice. Adjust as needed.
-		memoryResponse, err := c.getMemory(args.Memories[0], args.Num_relevant)
+		memoryResponse, err := c.getMemory(ctx, args.Memories[0], args.Num_relevant)
 		if err != nil {
 			fmt.Println("Error getting memory: ", err)
 			return fmt.Sprintf(`%v`, err), err
@@ -160,7 +201,7 @@ func (c Memory) Execute(jsonInput string) (string, error) {
 		fmt.Println("Memories get successfully")
 		return fmt.Sprintf(`%v`, memoryResponse), nil
 	case "hydrate":
-		prompt, err := c.HydrateUserMemories()
+		prompt, err := c.HydrateUserMemories(ctx)
 		if err != nil {
 			fmt.Println("Error hydrating user memories: ", err)
 			return fmt.Sprintf(`%v`, err), err
@@ -172,24 +213,30 @@ func (c Memory) Execute(jsonInput string) (string, error) {
 	}
 }
 
-func (c Memory) getEmbeddingsFromOpenAI(data string) openai.Embedding {
-	embeddings, err := c.openaiClient.CreateEmbeddings(context.Background(), openai.EmbeddingRequest{
+func (c Memory) getEmbeddingsFromOpenAI(ctx context.Context, data string) (openai.Embedding, error) {
+	embeddings, err := c.openaiClient.CreateEmbeddings(ctx, openai.EmbeddingRequest{
 		Input: []string{data},
 		Model: openai.AdaEmbeddingV2,
 	})
 	if err != nil {
 		fmt.Println("Error getting embeddings from OpenAI: ", err)
-		fmt.Println(err)
+		return openai.Embedding{}, err
+	}
+	if len(embeddings.Data) == 0 {
+		return openai.Embedding{}, fmt.Errorf("empty embeddings response from OpenAI")
 	}
 
-	return embeddings.Data[0]
+	return embeddings.Data[0], nil
 }
 
-func (c Memory) setMemory(newMemory, memoryType, memoryDetail string) (bool, error) {
+func (c Memory) setMemory(ctx context.Context, newMemory, memoryType, memoryDetail string) (bool, error) {
 	// Step 1: Combine the three fields into a single string
 	combinedMemory := memoryType + "|" + memoryDetail + "|" + newMemory
 
-	embeddings := c.getEmbeddingsFromOpenAI(combinedMemory)
+	embeddings, err := c.getEmbeddingsFromOpenAI(ctx, combinedMemory)
+	if err != nil {
+		return false, err
+	}
 
 	longTermMemory := memory{
 		Memory: combinedMemory, // Use combinedMemory here
@@ -211,7 +258,7 @@ func (c Memory) setMemory(newMemory, memoryType, memoryDetail string) (bool, err
 	memoryColumn := entity.NewColumnVarChar("memory", memoryData)
 	vectorColumn := entity.NewColumnFloatVector("embeddings", 1536, vectors)
 
-	_, err := c.milvusClient.Insert(context.Background(), c.cfg.MalvusCollectionName(), "", memoryColumn, vectorColumn)
+	_, err = c.milvusClient.Insert(ctx, c.cfg.MalvusCollectionName(), "", memoryColumn, vectorColumn)
 
 	if err != nil {
 		fmt.Println("Error inserting into Milvus client: ", err)
@@ -221,11 +268,13 @@ func (c Memory) setMemory(newMemory, memoryType, memoryDetail string) (bool, err
 	return true, nil
 }
 
-func (c Memory) getMemory(memory memoryItem, num_relevant int) ([]memoryResult, error) {
+func (c Memory) getMemory(ctx context.Context, memory memoryItem, num_relevant int) ([]memoryResult, error) {
 	combinedMemory := memory.Type + "|" + memory.Detail + "|" + memory.Memory + ","
-	embeddings := c.getEmbeddingsFromOpenAI(combinedMemory)
+	embeddings, err := c.getEmbeddingsFromOpenAI(ctx, combinedMemory)
+	if err != nil {
+		return nil, err
+	}
 
-	ctx := context.Background()
 	partitions := []string{}
 	expr := ""
 	outputFields := []string{"memory"}
@@ -361,7 +410,7 @@ func (c Memory) initMilvusSchema() error {
 	return nil
 }
 
-func (c *Memory) HydrateUserMemories() (string, error) {
+func (c *Memory) HydrateUserMemories(ctx context.Context) (string, error) {
 
 	var memories = []memoryItem{
 		{Type: "Basic Personal Information", Detail: "name"},
@@ -414,7 +463,7 @@ func (c *Memory) HydrateUserMemories() (string, error) {
 
 	for _, m := range memories {
 		// Get each memory from the vector database based on user ID and memory type
-		results, err := c.getMemory(m, 5)
+		results, err := c.getMemory(ctx, m, 5)
 		if err != nil {
 			return "", err
 		}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/sashabaranov/go-openai"
-	"github.com/sashabaranov/go-openai/jsonschema"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
@@ -15,26 +21,132 @@ import (
 // 声明JSONPlugin作为plugins.Plugin的实现
 var Plugin plugins.Plugin = &JSONPlugin{}
 
+// 未配置QAStorePath时，JSON文件保存在用户配置目录下的这个相对路径，不受工作目录影响
+const defaultFilePath = "agi_modules_for_go/qa_data.json"
+
+// 每个问题最多保留的历史记录条数，超过时丢弃最早的记录
+const maxHistory = 10
+
+// schemaVersion 当前JSON文件的格式版本，格式变化时增加版本号并在migrations中添加对应的迁移
+const schemaVersion = 1
+
+// qaFile JSON文件的内容
+type qaFile struct {
+	Version   int                  `json:"version"`
+	Questions map[string][]QAEntry `json:"questions"`
+}
+
+// migrations[i]把版本i的文件内容迁移到版本i+1
+var migrations = []func(data []byte) ([]byte, error){
+	migrateV0,
+}
+
+// migrateV0 版本0的文件直接是问题到记录列表的map，没有版本号；
+// 旧记录的input_params和output_result合并到solution，usage_method是操作名（add、update），直接丢弃
+func migrateV0(data []byte) ([]byte, error) {
+	var legacy map[string][]struct {
+		QAEntry
+		UsageMethod  string `json:"usage_method"`
+		InputParams  string `json:"input_params"`
+		OutputResult string `json:"output_result"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	file := qaFile{Version: 1, Questions: make(map[string][]QAEntry, len(legacy))}
+	for question, entries := range legacy {
+		for _, e := range entries {
+			entry := e.QAEntry
+			if entry.Solution == "" {
+				var parts []string
+				for _, s := range []string{e.InputParams, e.OutputResult} {
+					if s != "" {
+						parts = append(parts, s)
+					}
+				}
+				entry.Solution = strings.Join(parts, "；")
+			}
+			file.Questions[question] = append(file.Questions[question], entry)
+		}
+	}
+	return json.Marshal(file)
+}
+
+// fileVersion返回文件内容的格式版本，没有数字version字段的是版本0
+// 版本0的文件中可能有名为"version"的问题，它的值是数组而不是数字
+func fileVersion(data []byte) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := json.Unmarshal(fields["version"], &version); err != nil {
+		return 0, nil
+	}
+	return version, nil
+}
+
+// 相似问题检索的阈值
+const (
+	getThreshold    = 0.5 // get返回最相似问题的最低相似度，返回结果带有匹配到的问题，由模型判断是否适用
+	searchThreshold = 0.3 // search返回问题的最低相似度
+	semanticFloor   = 0.8 // 向量相似度低于此值视为不相关，ada向量即使内容无关相似度也在0.7左右
+	defaultLimit    = 5   // search默认返回的条数
+)
+
 // QAEntry结构体定义，用于存储每个条目的详细信息
 type QAEntry struct {
-	PluginName   string `json:"plugin_name"`
-	UsageMethod  string `json:"usage_method"`
-	InputParams  string `json:"input_params"`
-	OutputResult string `json:"output_result"`
-	Timestamp    string `json:"timestamp"`
+	PluginName string    `json:"plugin_name"`         // 解决问题使用的插件或工具，例如command
+	Solution   string    `json:"solution"`            // 通用的解决方法
+	Command    string    `json:"command,omitempty"`   // 获取结果时使用的具体命令
+	Timestamp  string    `json:"timestamp"`           // 记录时间
+	Embedding  []float32 `json:"embedding,omitempty"` // 问题的向量，用于语义检索，只保存在最新的记录中；无法获取向量时只按文字相似度检索
+}
+
+// QAInput qa_store的参数
+type QAInput struct {
+	Action     string `json:"action" description:"要执行的操作：add添加新问题、get查找最相似的问题、search搜索相似问题、list列出所有问题、update更新已有问题的解决方法、delete删除" enum:"add,get,search,list,update,delete"`
+	Question   string `json:"question,omitempty" description:"问题的类型，例如'如何查询天气'；list之外的操作都需要"`
+	Solution   string `json:"solution,omitempty" description:"通用的解决方法，add和update时需要"`
+	Command    string `json:"command,omitempty" description:"获取结果时使用的具体命令，例如curl -s 'http://wttr.in/{城市名}?format=3'"`
+	PluginName string `json:"plugin_name,omitempty" description:"解决问题使用的插件或工具名，例如command"`
+	Limit      int    `json:"limit,omitempty" description:"search返回的最大条数，默认5" minimum:"1" maximum:"20"`
+}
+
+// QAMatch 检索结果
+type QAMatch struct {
+	Question   string  `json:"question"`
+	Solution   string  `json:"solution"`
+	Command    string  `json:"command,omitempty"`
+	PluginName string  `json:"plugin_name,omitempty"`
+	Timestamp  string  `json:"timestamp"`
+	Score      float64 `json:"score,omitempty"` // 与查询问题的相似度，0到1
 }
 
 // JSONPlugin结构体定义
 type JSONPlugin struct {
-	cfg      config.Cfg
-	filePath string               // JSON文件路径
-	store    map[string][]QAEntry // 用于存储问题和解决方法的数据
+	cfg          config.Cfg
+	openaiClient *openai.Client
+	filePath     string               // JSON文件路径
+	mu           sync.RWMutex         // 保护store和文件，修改和保存在同一个写锁内完成
+	store        map[string][]QAEntry // 用于存储问题和解决方法的数据，同一问题的多次更新按时间顺序保存
 }
 
 // Init方法用于初始化插件
 func (j *JSONPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
 	j.cfg = cfg
-	j.filePath = "qa_data.json" // 默认的JSON文件路径
+	j.openaiClient = openaiClient
+	j.filePath = cfg.QAStorePath()
+	if j.filePath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return fmt.Errorf("无法确定默认的JSON文件路径，请配置QAStorePath: %v", err)
+		}
+		j.filePath = filepath.Join(dir, defaultFilePath)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.filePath), 0o700); err != nil {
+		return fmt.Errorf("创建JSON文件目录失败: %v", err)
+	}
 
 	// 加载数据
 	if err := j.loadFromFile(); err != nil {
@@ -43,9 +155,12 @@ func (j *JSONPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
 	return nil
 }
 
-// 从JSON文件加载数据
+// 从JSON文件加载数据，旧版本的文件按migrations迁移到当前版本后立即保存
 func (j *JSONPlugin) loadFromFile() error {
-	file, err := os.Open(j.filePath)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	data, err := os.ReadFile(j.filePath)
 	if os.IsNotExist(err) {
 		// 如果文件不存在，则创建一个新文件并初始化一个空存储
 		j.store = make(map[string][]QAEntry)
@@ -53,135 +168,423 @@ func (j *JSONPlugin) loadFromFile() error {
 	} else if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// 读取文件并解析为map
-	bytes, err := os.ReadFile(j.filePath)
+	version, err := fileVersion(data)
 	if err != nil {
 		return err
 	}
+	if version > schemaVersion {
+		// 不认识的新版本文件，不覆盖它
+		return fmt.Errorf("文件版本%d高于支持的版本%d", version, schemaVersion)
+	}
+	for v := version; v < schemaVersion; v++ {
+		if data, err = migrations[v](data); err != nil {
+			return fmt.Errorf("从版本%d迁移失败: %v", v, err)
+		}
+	}
 
-	if err := json.Unmarshal(bytes, &j.store); err != nil {
+	var file qaFile
+	if err := json.Unmarshal(data, &file); err != nil {
 		return err
 	}
+	j.store = file.Questions
+	if j.store == nil {
+		j.store = make(map[string][]QAEntry)
+	}
+	// 旧文件中可能保存了超过上限的历史记录，加载时一并裁剪，下次保存时写回文件
+	for question, entries := range j.store {
+		j.store[question] = trimHistory(entries)
+	}
+	if version < schemaVersion {
+		return j.saveToFile()
+	}
 	return nil
 }
 
-// 将数据保存到JSON文件
+// 将数据保存到JSON文件，调用时需要持有写锁
+// 先写入同一目录下的临时文件并同步到磁盘，再重命名覆盖原文件，写入中途崩溃不会损坏原文件
 func (j *JSONPlugin) saveToFile() error {
-	bytes, err := json.MarshalIndent(j.store, "", "  ")
+	data, err := json.MarshalIndent(qaFile{Version: schemaVersion, Questions: j.store}, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(j.filePath, bytes, 0644)
+	dir := filepath.Dir(j.filePath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(j.filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // 重命名成功后临时文件已不存在，删除失败可以忽略
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.filePath); err != nil {
+		return err
+	}
+	// 同步目录，确保重命名本身也已写入磁盘
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
 
 // ID方法返回插件的唯一标识符
-func (j JSONPlugin) ID() string {
+func (j *JSONPlugin) ID() string {
 	return "qa_store"
 }
 
 // Description方法返回插件的描述
-func (j JSONPlugin) Description() string {
+func (j *JSONPlugin) Description() string {
 	return "这个插件用于存储和检索问题及其解决方法，并将其保存到文件中。"
 }
 
 // FunctionDefinition方法返回OpenAI函数定义
-func (j JSONPlugin) FunctionDefinition() openai.FunctionDefinition {
-	return openai.FunctionDefinition{
-		Name:        "qa_store",
-		Description: "存储或检索问题及其解决方法。",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"action": {
-					Type:        jsonschema.String,
-					Description: "要执行的操作：'add', 'get', 'delete', 或 'update'",
-				},
-				"question": {
-					Type:        jsonschema.String,
-					Description: "要添加、检索或删除的问题",
-				},
-				"solution": {
-					Type:        jsonschema.String,
-					Description: "问题的解决方法，仅在'add'或'update'操作时需要",
-				},
-				"command": {
-					Type:        jsonschema.String,
-					Description: "获取结果时使用的具体命令，仅在'add'或'update'操作时需要",
-				},
-			},
-			Required: []string{"action", "question"},
-		},
-	}
+func (j *JSONPlugin) FunctionDefinition() openai.FunctionDefinition {
+	return plugins.FunctionDefinitionFor[QAInput]("qa_store",
+		"存储或检索问题及其解决方法。get和search按问题的相似度查找，不要求问题完全相同，返回记录的解决方法和命令。")
+}
+
+// DefaultTimeout方法返回插件的默认执行超时时间，检索时可能需要请求问题的向量
+func (j *JSONPlugin) DefaultTimeout() time.Duration {
+	return 15 * time.Second
+}
+
+// ConcurrentSafe方法表示插件可以被并发调用，存储由读写锁保护
+func (j *JSONPlugin) ConcurrentSafe() bool {
+	return true
 }
 
 // Execute方法执行插件的主要功能，根据操作存储或检索问题及其解决方法
 func (j *JSONPlugin) Execute(jsonInput string) (string, error) {
-	var input struct {
-		Action   string `json:"action"`
-		Question string `json:"question"`
-		Solution string `json:"solution,omitempty"`
-		Command  string `json:"command,omitempty"` // 增加command字段来记录具体的命令调用
-	}
-
-	if err := json.Unmarshal([]byte(jsonInput), &input); err != nil {
-		return "", fmt.Errorf("输入解析错误: %v", err)
-	}
-
-	// 检查JSON文件中是否已经存在相应问题
-	if entries, exists := j.store[input.Question]; exists {
-		switch input.Action {
-		case "get":
-			latestEntry := entries[len(entries)-1] // 获取最新的解决方法
-			return fmt.Sprintf("解决方法: %s", latestEntry.OutputResult), nil
-		case "add":
-			return "", fmt.Errorf("问题 '%s' 已存在。使用 'update' 操作来更新解决方法。", input.Question)
-		case "update":
-			// 继续进行更新操作
-		case "delete":
-			// 继续进行删除操作
-		}
+	return j.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，ctx已取消时不再修改存储
+func (j *JSONPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	input, err := plugins.BindArguments[QAInput]("qa_store", jsonInput)
+	if err != nil {
+		return "", err
+	}
+	input.Question = strings.TrimSpace(input.Question)
+	if input.Action != "list" && input.Question == "" {
+		return "", argumentError("question", "操作"+input.Action+"需要question")
 	}
 
-	// 如果执行成功才记录
 	switch input.Action {
-	case "add":
-		// 添加新问题
-		entry := QAEntry{
-			PluginName:   "qa_store",
-			UsageMethod:  "add",
-			InputParams:  "使用 'curl' 命令行工具请求 wttr.in 网站并指定查询参数，如：curl -s 'http://wttr.in/{城市名}?format=3'", // 通用查询天气的方法
-			OutputResult: "使用此方法可以查询任何城市的当前天气信息。",
-			Timestamp:    time.Now().Format(time.RFC3339),
-		}
-		j.store[input.Question] = append(j.store[input.Question], entry)
-
-	case "update":
-		// 更新已有问题
-		entry := QAEntry{
-			PluginName:   "qa_store",
-			UsageMethod:  "update",
-			InputParams:  "使用 'curl' 命令行工具请求 wttr.in 网站并指定查询参数，如：curl -s 'http://wttr.in/{城市名}?format=3'", // 通用查询天气的方法
-			OutputResult: "使用此方法可以查询任何城市的当前天气信息。",
-			Timestamp:    time.Now().Format(time.RFC3339),
-		}
-		j.store[input.Question] = append(j.store[input.Question], entry)
-
+	case "get":
+		return j.get(ctx, input.Question)
+	case "search":
+		return j.search(ctx, input.Question, input.Limit)
+	case "list":
+		return j.list()
+	case "add", "update":
+		return j.put(ctx, input)
 	case "delete":
-		// 删除已有问题
-		if _, exists := j.store[input.Question]; exists {
+		return j.delete(ctx, input.Question)
+	default:
+		return "", fmt.Errorf("无效的操作：%s", input.Action)
+	}
+}
+
+// argumentError返回单个参数的错误，让模型补全参数后重试
+func argumentError(path, message string) error {
+	return &plugins.ArgumentError{Function: "qa_store", Problems: []plugins.ArgumentProblem{{Path: path, Message: message}}}
+}
+
+// put方法添加或更新问题的解决方法，保存模型给出的解决方法、命令和工具名
+// add要求问题不存在，update要求问题已存在
+func (j *JSONPlugin) put(ctx context.Context, input QAInput) (string, error) {
+	if strings.TrimSpace(input.Solution) == "" {
+		return "", argumentError("solution", "操作"+input.Action+"需要solution")
+	}
+	if err := checkPut(input, j.exists(input.Question)); err != nil {
+		return "", err
+	}
+	// 请求向量可能耗时较长，在锁外进行
+	entry := QAEntry{
+		PluginName: input.PluginName,
+		Solution:   input.Solution,
+		Command:    input.Command,
+		Timestamp:  time.Now().Format(time.RFC3339),
+		Embedding:  j.embedding(ctx, input.Question),
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// ctx已取消时不再修改存储
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	previous, exists := j.store[input.Question]
+	// 请求向量期间可能有其他调用添加或删除了同一问题
+	if err := checkPut(input, exists); err != nil {
+		return "", err
+	}
+	j.store[input.Question] = trimHistory(append(previous[:len(previous):len(previous)], entry))
+
+	// 成功执行后保存到文件，保存失败时恢复内存中的数据，保持与文件一致
+	if err := j.saveToFile(); err != nil {
+		if exists {
+			j.store[input.Question] = previous
+		} else {
 			delete(j.store, input.Question)
 		}
+		return "", fmt.Errorf("保存数据到文件时出错: %v", err)
 	}
+	return fmt.Sprintf("操作成功：'%s'", input.Question), nil
+}
+
+// checkPut 检查add的问题不存在、update的问题已存在
+func checkPut(input QAInput, exists bool) error {
+	if input.Action == "add" && exists {
+		return fmt.Errorf("问题 '%s' 已存在。使用 'update' 操作来更新解决方法。", input.Question)
+	}
+	if input.Action == "update" && !exists {
+		return fmt.Errorf("问题 '%s' 不存在。使用 'add' 操作来添加。", input.Question)
+	}
+	return nil
+}
+
+// trimHistory 返回最多maxHistory条最新的记录，检索只用到最新记录的向量，较早记录的向量被丢弃
+// 总是返回新的切片，不修改entries，保存失败时可以用entries恢复
+func trimHistory(entries []QAEntry) []QAEntry {
+	if len(entries) > maxHistory {
+		entries = entries[len(entries)-maxHistory:]
+	}
+	trimmed := make([]QAEntry, len(entries))
+	copy(trimmed, entries)
+	for i := 0; i < len(trimmed)-1; i++ {
+		trimmed[i].Embedding = nil
+	}
+	return trimmed
+}
 
-	// 成功执行后保存到文件
+// delete方法删除问题的所有记录
+func (j *JSONPlugin) delete(ctx context.Context, question string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	previous, exists := j.store[question]
+	if !exists {
+		return "", fmt.Errorf("问题 '%s' 不存在", question)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	delete(j.store, question)
 	if err := j.saveToFile(); err != nil {
+		j.store[question] = previous
 		return "", fmt.Errorf("保存数据到文件时出错: %v", err)
 	}
+	return fmt.Sprintf("操作成功：'%s'", question), nil
+}
 
-	return fmt.Sprintf("操作成功：'%s'", input.Question), nil
+// exists方法判断问题是否已记录
+func (j *JSONPlugin) exists(question string) bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	_, ok := j.store[question]
+	return ok
+}
+
+// get方法返回与问题最相似的记录
+func (j *JSONPlugin) get(ctx context.Context, question string) (string, error) {
+	// 问题完全相同时不需要请求向量
+	j.mu.RLock()
+	entries, exists := j.store[question]
+	j.mu.RUnlock()
+	if exists {
+		return marshalResult(toMatch(question, entries, 1))
+	}
+	matches := j.rank(ctx, question, getThreshold)
+	if len(matches) == 0 {
+		return fmt.Sprintf("没有找到与'%s'相似的问题", question), nil
+	}
+	return marshalResult(matches[0])
+}
+
+// search方法返回与问题相似的记录，按相似度从高到低排列
+func (j *JSONPlugin) search(ctx context.Context, question string, limit int) (string, error) {
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	matches := j.rank(ctx, question, searchThreshold)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return marshalResult(matches)
+}
+
+// list方法列出所有问题的最新解决方法
+func (j *JSONPlugin) list() (string, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	matches := make([]QAMatch, 0, len(j.store))
+	for question, entries := range j.store {
+		if len(entries) > 0 {
+			matches = append(matches, toMatch(question, entries, 0))
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].Question < matches[b].Question })
+	return marshalResult(matches)
+}
+
+// rank方法计算所有问题与查询的相似度，返回不低于threshold的记录
+func (j *JSONPlugin) rank(ctx context.Context, question string, threshold float64) []QAMatch {
+	var query []float32
+	if j.hasEmbeddings() {
+		query = j.embedding(ctx, question)
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	var matches []QAMatch
+	for stored, entries := range j.store {
+		if len(entries) == 0 {
+			continue
+		}
+		latest := entries[len(entries)-1]
+		score := similarity(question, stored)
+		if s := semanticScore(query, latest.Embedding); s > score {
+			score = s
+		}
+		if score >= threshold {
+			matches = append(matches, toMatch(stored, entries, score))
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].Score != matches[b].Score {
+			return matches[a].Score > matches[b].Score
+		}
+		return matches[a].Question < matches[b].Question
+	})
+	return matches
+}
+
+// hasEmbeddings方法判断是否有记录保存了向量，没有时检索不必请求查询的向量
+func (j *JSONPlugin) hasEmbeddings() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	for _, entries := range j.store {
+		if len(entries) > 0 && len(entries[len(entries)-1].Embedding) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// embedding方法请求文本的向量，失败时返回nil，检索退回到文字相似度
+func (j *JSONPlugin) embedding(ctx context.Context, text string) []float32 {
+	if j.openaiClient == nil {
+		return nil
+	}
+	embeddings, err := j.openaiClient.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: []string{text},
+		Model: openai.AdaEmbeddingV2,
+	})
+	if err != nil {
+		fmt.Println("Error getting embeddings from OpenAI: ", err)
+		return nil
+	}
+	if len(embeddings.Data) == 0 {
+		return nil
+	}
+	return embeddings.Data[0].Embedding
+}
+
+// toMatch返回问题的最新记录
+func toMatch(question string, entries []QAEntry, score float64) QAMatch {
+	latest := entries[len(entries)-1]
+	return QAMatch{
+		Question:   question,
+		Solution:   latest.Solution,
+		Command:    latest.Command,
+		PluginName: latest.PluginName,
+		Timestamp:  latest.Timestamp,
+		Score:      math.Round(score*100) / 100,
+	}
+}
+
+// similarity按字符二元组的Dice系数计算两个问题的文字相似度，对中文不需要分词
+func similarity(a, b string) float64 {
+	ga, gb := bigrams(a), bigrams(b)
+	if len(ga) == 0 || len(gb) == 0 {
+		if normalize(a) == normalize(b) {
+			return 1
+		}
+		return 0
+	}
+	common := 0
+	for g, n := range ga {
+		common += min(n, gb[g])
+	}
+	total := 0
+	for _, n := range ga {
+		total += n
+	}
+	for _, n := range gb {
+		total += n
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+// bigrams返回文本去掉空白和标点后的字符二元组及其出现次数
+func bigrams(s string) map[string]int {
+	runes := []rune(normalize(s))
+	grams := make(map[string]int)
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])]++
+	}
+	return grams
+}
+
+// normalize去掉空白和标点并转换为小写
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// semanticScore把两个向量的余弦相似度从[semanticFloor, 1]映射到[0, 1]，任一向量为空时返回0
+func semanticScore(a, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	cosine := dot / math.Sqrt(na*nb)
+	return math.Max(0, (cosine-semanticFloor)/(1-semanticFloor))
+}
+
+// marshalResult把结果编码为返回给模型的JSON
+func marshalResult(result interface{}) (string, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 func main() {
@@ -198,36 +601,18 @@ func main() {
 	}
 
 	// 示例操作
-	addInput := `{"action": "add", "question": "如何查询天气", "solution": "使用此方法可以查询任何城市的当前天气信息。", "command": "curl -s 'http://wttr.in/{城市名}?format=3'"}`
-	getInput := `{"action": "get", "question": "如何查询天气"}`
-	updateInput := `{"action": "update", "question": "如何查询天气", "solution": "使用此方法可以查询任何城市的当前天气信息。", "command": "curl -s 'http://wttr.in/{城市名}?format=3'"}`
+	addInput := `{"action": "add", "question": "如何查询天气", "solution": "使用curl请求wttr.in并指定城市名，可以查询任何城市的当前天气信息。", "command": "curl -s 'http://wttr.in/{城市名}?format=3'", "plugin_name": "command"}`
+	getInput := `{"action": "get", "question": "怎么查询明天的天气"}`
+	searchInput := `{"action": "search", "question": "天气", "limit": 3}`
+	updateInput := `{"action": "update", "question": "如何查询天气", "solution": "使用curl请求wttr.in并指定城市名，format=3只返回一行结果。", "command": "curl -s 'http://wttr.in/{城市名}?format=3'", "plugin_name": "command"}`
+	listInput := `{"action": "list"}`
 	deleteInput := `{"action": "delete", "question": "如何查询天气"}`
 
-	// 执行“add”操作
-	if result, err := plugin.Execute(addInput); err == nil {
-		fmt.Println(result)
-	} else {
-		fmt.Println("执行失败:", err)
-	}
-
-	// 执行“get”操作
-	if result, err := plugin.Execute(getInput); err == nil {
-		fmt.Println("获取的解决方法:", result)
-	} else {
-		fmt.Println("执行失败:", err)
-	}
-
-	// 执行“update”操作
-	if result, err := plugin.Execute(updateInput); err == nil {
-		fmt.Println(result)
-	} else {
-		fmt.Println("执行失败:", err)
-	}
-
-	// 执行“delete”操作
-	if result, err := plugin.Execute(deleteInput); err == nil {
-		fmt.Println(result)
-	} else {
-		fmt.Println("执行失败:", err)
+	for _, input := range []string{addInput, getInput, searchInput, updateInput, listInput, deleteInput} {
+		if result, err := plugin.Execute(input); err == nil {
+			fmt.Println(result)
+		} else {
+			fmt.Println("执行失败:", err)
+		}
 	}
 }
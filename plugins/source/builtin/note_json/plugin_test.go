@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+func TestLoadFromFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // 为空时文件不存在
+		want    map[string][]QAEntry
+		wantErr bool
+	}{
+		{
+			name: "missing file",
+			want: map[string][]QAEntry{},
+		},
+		{
+			name: "version 0",
+			content: `{
+				"如何查询天气": [
+					{"plugin_name": "command", "usage_method": "add", "input_params": "curl wttr.in", "output_result": "晴", "timestamp": "t1"},
+					{"plugin_name": "command", "usage_method": "update", "solution": "用curl查询wttr.in", "timestamp": "t2"}
+				],
+				"version": [
+					{"plugin_name": "command", "input_params": "uname -a", "timestamp": "t3"}
+				]
+			}`,
+			want: map[string][]QAEntry{
+				"如何查询天气": {
+					{PluginName: "command", Solution: "curl wttr.in；晴", Timestamp: "t1"},
+					{PluginName: "command", Solution: "用curl查询wttr.in", Timestamp: "t2"},
+				},
+				"version": {
+					{PluginName: "command", Solution: "uname -a", Timestamp: "t3"},
+				},
+			},
+		},
+		{
+			name:    "current version",
+			content: `{"version": 1, "questions": {"几点了": [{"plugin_name": "time", "solution": "调用time", "timestamp": "t1"}]}}`,
+			want: map[string][]QAEntry{
+				"几点了": {{PluginName: "time", Solution: "调用time", Timestamp: "t1"}},
+			},
+		},
+		{
+			name:    "newer version",
+			content: `{"version": 2, "questions": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			content: `{`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "qa.json")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			j := &JSONPlugin{filePath: path}
+			err := j.loadFromFile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// 无法读取的文件保持原样
+				if data, _ := os.ReadFile(path); string(data) != tt.content {
+					t.Errorf("file was modified: %s", data)
+				}
+				return
+			}
+			if !reflect.DeepEqual(j.store, tt.want) {
+				t.Errorf("store = %+v, want %+v", j.store, tt.want)
+			}
+
+			// 迁移或新建后文件应保存为当前版本
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var file qaFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatal(err)
+			}
+			if file.Version != schemaVersion || !reflect.DeepEqual(file.Questions, tt.want) {
+				t.Errorf("saved file = %+v", file)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{a: "如何查询天气", b: "如何查询天气", want: 1},
+		{a: "如何查询天气？", b: "如何 查询天气", want: 1},
+		{a: "Weather", b: "weather", want: 1},
+		{a: "如何查询天气", b: "查询天气", want: 0.75},
+		{a: "如何查询天气", b: "播放音乐", want: 0},
+		{a: "天", b: "天", want: 1},
+		{a: "天", b: "地", want: 0},
+		{a: "", b: "天气", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"|"+tt.b, func(t *testing.T) {
+			if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("similarity = %v, want %v", got, tt.want)
+			}
+			if got, back := similarity(tt.a, tt.b), similarity(tt.b, tt.a); got != back {
+				t.Errorf("similarity is not symmetric: %v vs %v", got, back)
+			}
+		})
+	}
+}
+
+func TestSemanticScore(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{name: "identical", a: []float32{1, 2, 3}, b: []float32{2, 4, 6}, want: 1},
+		{name: "orthogonal", a: []float32{1, 0}, b: []float32{0, 1}, want: 0},
+		{name: "below floor", a: []float32{1, 0}, b: []float32{0.7, 0.714}, want: 0},
+		{name: "missing embedding", a: nil, b: []float32{1}, want: 0},
+		{name: "different length", a: []float32{1, 0}, b: []float32{1}, want: 0},
+		{name: "zero vector", a: []float32{0, 0}, b: []float32{1, 0}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := semanticScore(tt.a, tt.b); math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("semanticScore = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	j := &JSONPlugin{store: map[string][]QAEntry{
+		"如何查询天气":   {{Solution: "旧方法"}, {Solution: "curl wttr.in"}},
+		"如何查询北京天气": {{Solution: "curl wttr.in/北京"}},
+		"如何播放音乐":   {{Solution: "调用music"}},
+		"空记录":      {},
+		"语义相近的问题":  {{Solution: "按向量匹配", Embedding: []float32{1, 0}}},
+	}}
+
+	tests := []struct {
+		name      string
+		question  string
+		threshold float64
+		want      []string
+	}{
+		{name: "best match first", question: "查询天气", threshold: searchThreshold, want: []string{"如何查询天气", "如何查询北京天气"}},
+		{name: "threshold filters", question: "查询天气", threshold: 0.7, want: []string{"如何查询天气"}},
+		{name: "ties ordered by question", question: "如何", threshold: 0.1, want: []string{"如何播放音乐", "如何查询天气", "如何查询北京天气"}},
+		{name: "no match", question: "打开空调", threshold: searchThreshold, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 没有openaiClient时只按文字相似度检索
+			matches := j.rank(context.Background(), tt.question, tt.threshold)
+			var got []string
+			for i, m := range matches {
+				got = append(got, m.Question)
+				if i > 0 && m.Score > matches[i-1].Score {
+					t.Errorf("matches are not sorted by score: %+v", matches)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 返回每个问题的最新记录
+	matches := j.rank(context.Background(), "如何查询天气", 1)
+	if len(matches) != 1 || matches[0].Solution != "curl wttr.in" || matches[0].Score != 1 {
+		t.Errorf("exact match = %+v", matches)
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	j := &JSONPlugin{filePath: filepath.Join(t.TempDir(), "qa.json")}
+	if err := j.loadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		input   string
+		want    string // 结果中应包含的内容
+		wantErr string
+	}{
+		{input: `{"action":"add","question":"如何查询天气","solution":"用curl查询wttr.in","command":"curl wttr.in","plugin_name":"command"}`, want: "操作成功"},
+		{input: `{"action":"add","question":"如何查询天气","solution":"重复"}`, wantErr: "已存在"},
+		{input: `{"action":"add","question":"如何播放音乐"}`, wantErr: "solution"},
+		{input: `{"action":"update","question":"如何播放音乐","solution":"调用music"}`, wantErr: "不存在"},
+		{input: `{"action":"get"}`, wantErr: "question"},
+		{input: `{"action":"get","question":"查询天气"}`, want: `"command":"curl wttr.in"`},
+		{input: `{"action":"get","question":"打开空调"}`, want: "没有找到"},
+		{input: `{"action":"update","question":"如何查询天气","solution":"用curl查询wttr.in/城市"}`, want: "操作成功"},
+		{input: `{"action":"search","question":"怎么查询天气"}`, want: "wttr.in/城市"},
+		{input: `{"action":"list"}`, want: `"question":"如何查询天气"`},
+		{input: `{"action":"delete","question":"如何查询天气"}`, want: "操作成功"},
+		{input: `{"action":"delete","question":"如何查询天气"}`, wantErr: "不存在"},
+		{input: `{"action":"list"}`, want: "[]"},
+	}
+	for _, step := range steps {
+		got, err := j.ExecuteContext(context.Background(), step.input)
+		if step.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), step.wantErr) {
+				t.Errorf("%s: err = %v, want %q", step.input, err, step.wantErr)
+			}
+			continue
+		}
+		if err != nil || !strings.Contains(got, step.want) {
+			t.Errorf("%s = %s, %v, want it to contain %s", step.input, got, err, step.want)
+		}
+	}
+
+	// 每次修改都保存到文件
+	reloaded := &JSONPlugin{filePath: j.filePath}
+	if err := reloaded.loadFromFile(); err != nil || len(reloaded.store) != 0 {
+		t.Errorf("reloaded store = %+v, %v", reloaded.store, err)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	j := &JSONPlugin{filePath: filepath.Join(t.TempDir(), "qa.json")}
+	if err := j.loadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	// 没有openaiClient时不会请求向量，直接放入带向量的旧记录
+	j.store["如何查询天气"] = []QAEntry{{Solution: "方法0", Embedding: []float32{1, 0}}}
+
+	for i := 1; i <= maxHistory+2; i++ {
+		input := fmt.Sprintf(`{"action":"update","question":"如何查询天气","solution":"方法%d"}`, i)
+		if _, err := j.ExecuteContext(context.Background(), input); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := &JSONPlugin{filePath: j.filePath}
+	if err := reloaded.loadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	entries := reloaded.store["如何查询天气"]
+	if len(entries) != maxHistory {
+		t.Fatalf("kept %d entries, want %d", len(entries), maxHistory)
+	}
+	if first, last := entries[0].Solution, entries[len(entries)-1].Solution; first != "方法3" || last != fmt.Sprintf("方法%d", maxHistory+2) {
+		t.Errorf("kept entries %s..%s", first, last)
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	entries := []QAEntry{
+		{Solution: "旧", Embedding: []float32{1}},
+		{Solution: "中", Embedding: []float32{2}},
+		{Solution: "新", Embedding: []float32{3}},
+	}
+	got := trimHistory(entries)
+	want := []QAEntry{{Solution: "旧"}, {Solution: "中"}, {Solution: "新", Embedding: []float32{3}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trimHistory = %+v, want %+v", got, want)
+	}
+	// 原来的记录不受影响，保存失败时仍可用来恢复
+	if entries[0].Embedding == nil {
+		t.Error("trimHistory modified its argument")
+	}
+}
+
+func TestInitDefaultPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+
+	j := &JSONPlugin{}
+	if err := j.Init(config.New(), nil); err != nil {
+		t.Fatal(err)
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(configDir, defaultFilePath)
+	if j.filePath != want {
+		t.Errorf("filePath = %s, want %s", j.filePath, want)
+	}
+	// 默认路径在用户配置目录下，不受工作目录影响
+	if !strings.HasPrefix(want, dir) {
+		t.Errorf("default path %s is not under %s", want, dir)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("store file was not created: %v", err)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	dir := t.TempDir()
+	j := &JSONPlugin{filePath: filepath.Join(dir, "qa.json")}
+	if err := j.loadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := fmt.Sprintf(`{"action":"add","question":"问题%d","solution":"方法%d"}`, i, i)
+			if _, err := j.ExecuteContext(context.Background(), input); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	reloaded := &JSONPlugin{filePath: j.filePath}
+	if err := reloaded.loadFromFile(); err != nil || len(reloaded.store) != 20 {
+		t.Errorf("reloaded %d questions, %v, want 20", len(reloaded.store), err)
+	}
+	// 原子写入不留下临时文件
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files in store dir = %v, want only qa.json", entries)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -67,7 +69,23 @@ func (rp *RolePlayingPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) e
 	return nil
 }
 
+func (rp *RolePlayingPlugin) DefaultTimeout() time.Duration {
+	return 5 * time.Second
+}
+
+func (rp *RolePlayingPlugin) ConcurrentSafe() bool {
+	return true
+}
+
 func (rp *RolePlayingPlugin) Execute(jsonInput string) (string, error) {
+	return rp.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (rp *RolePlayingPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	var request Request
 	err := json.Unmarshal([]byte(jsonInput), &request)
 	if err != nil {
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
+	timeplugin "github.com/wangergou2023/agi_modules_for_go/plugins/source/builtin/time"
+)
+
+// 声明TimePlugin作为plugins.Plugin的实现，使用-buildmode=plugin编译时通过它加载
+var Plugin plugins.Plugin = timeplugin.New()
+
+// main函数以子进程插件的方式运行，go build生成的可执行文件可以通过*.plugin.json清单加载
+// 使用-buildmode=plugin编译时不会执行main
+func main() {
+	if err := plugins.Serve(Plugin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
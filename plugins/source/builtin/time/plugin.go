@@ -1,6 +1,9 @@
-package main
+// Package time 获取当前时间的插件
+// 以空白导入的方式引入即可编译进主程序，cmd目录中的main包把它编译成.so或子进程插件
+package time
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -10,8 +13,15 @@ import (
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
 
-// 声明TimePlugin作为plugins.Plugin的实现
-var Plugin plugins.Plugin = &TimePlugin{}
+// 注册插件工厂，每个PluginManager加载时都会得到新的TimePlugin
+func init() {
+	plugins.Register("time", New)
+}
+
+// New 创建TimePlugin
+func New() plugins.Plugin {
+	return &TimePlugin{}
+}
 
 // TimePlugin结构体定义
 type TimePlugin struct {
@@ -49,8 +59,31 @@ func (t TimePlugin) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+// DefaultTimeout方法返回插件的默认执行超时时间
+func (t TimePlugin) DefaultTimeout() time.Duration {
+	return 5 * time.Second
+}
+
+// ToolRisk方法声明获取时间是只读操作，不需要确认
+func (t TimePlugin) ToolRisk(tool string) plugins.ToolRisk {
+	return plugins.RiskReadOnly
+}
+
+// ConcurrentSafe方法表示插件可以被并发调用
+func (t TimePlugin) ConcurrentSafe() bool {
+	return true
+}
+
 // Execute方法执行插件的主要功能，返回当前时间
 func (t TimePlugin) Execute(jsonInput string) (string, error) {
+	return t.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，ctx已取消时直接返回
+func (t TimePlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	// 使用time包获取当前时间
 	currentTime := time.Now()
 	// 格式化当前时间并返回
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -56,7 +57,15 @@ func (v *Tts) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (v *Tts) DefaultTimeout() time.Duration {
+	return 60 * time.Second
+}
+
 func (v *Tts) Execute(jsonInput string) (string, error) {
+	return v.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (v *Tts) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input TtsInput
 	err := json.Unmarshal([]byte(jsonInput), &input)
 	if err != nil {
@@ -66,7 +75,7 @@ func (v *Tts) Execute(jsonInput string) (string, error) {
 	fmt.Printf("Received input: Text=%s\n", input.Text)
 
 	// Make a request to OpenAI GPT-4 Tts Preview
-	res, err := v.openaiClient.CreateSpeech(context.Background(), openai.CreateSpeechRequest{
+	res, err := v.openaiClient.CreateSpeech(ctx, openai.CreateSpeechRequest{
 		Model: openai.TTSModel1,
 		Input: input.Text,
 		Voice: openai.VoiceAlloy,
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -68,7 +69,19 @@ func (v *Vision) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (v *Vision) DefaultTimeout() time.Duration {
+	return 60 * time.Second
+}
+
+func (v *Vision) ConcurrentSafe() bool {
+	return true
+}
+
 func (v *Vision) Execute(jsonInput string) (string, error) {
+	return v.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (v *Vision) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input VisionInput
 	err := json.Unmarshal([]byte(jsonInput), &input)
 	if err != nil {
@@ -111,7 +124,7 @@ func (v *Vision) Execute(jsonInput string) (string, error) {
 
 	// Make a request to OpenAI GPT-4 Vision Preview
 	resp, err := v.openaiClient.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			MaxTokens: 300,
 			Model:     openai.GPT4VisionPreview,
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -50,7 +52,24 @@ func (w WeatherPlugin) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (w WeatherPlugin) DefaultTimeout() time.Duration {
+	return 15 * time.Second
+}
+
+// ToolRisk 查询天气是只读操作，不需要确认
+func (w WeatherPlugin) ToolRisk(tool string) plugins.ToolRisk {
+	return plugins.RiskReadOnly
+}
+
+func (w WeatherPlugin) ConcurrentSafe() bool {
+	return true
+}
+
 func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
+	return w.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (w WeatherPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input struct {
 		Location string `json:"location"`
 	}
@@ -59,7 +78,7 @@ func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
 		return "", err
 	}
 
-	weatherInfo, err := w.getWeather(input.Location)
+	weatherInfo, err := w.getWeather(ctx, input.Location)
 	if err != nil {
 		return "", err
 	}
@@ -67,11 +86,15 @@ func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
 	return weatherInfo, nil
 }
 
-func (w WeatherPlugin) getWeather(location string) (string, error) {
+func (w WeatherPlugin) getWeather(ctx context.Context, location string) (string, error) {
 	// 使用配置中的API密钥
 	apiKey := w.cfg.OpenWeatherMapAPIKey()
 	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?q=%s&appid=%s&units=metric", location, apiKey)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"encoding/json"
 
@@ -16,6 +19,15 @@ import (
 
 var Plugin plugins.Plugin = &WeatherPlugin{}
 
+// main函数以子进程插件的方式运行，go build生成的可执行文件可以通过*.plugin.json清单加载
+// 使用-buildmode=plugin编译时不会执行main
+func main() {
+	if err := plugins.Serve(Plugin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 type WeatherPlugin struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
@@ -52,7 +64,24 @@ func (w WeatherPlugin) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+func (w WeatherPlugin) DefaultTimeout() time.Duration {
+	return 15 * time.Second
+}
+
+// ToolRisk 查询天气是只读操作，不需要确认
+func (w WeatherPlugin) ToolRisk(tool string) plugins.ToolRisk {
+	return plugins.RiskReadOnly
+}
+
+func (w WeatherPlugin) ConcurrentSafe() bool {
+	return true
+}
+
 func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
+	return w.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (w WeatherPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	var input struct {
 		Location string `json:"location"`
 	}
@@ -61,7 +90,7 @@ func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
 		return "", err
 	}
 
-	weatherInfo, err := w.getWeather(input.Location)
+	weatherInfo, err := w.getWeather(ctx, input.Location)
 	if err != nil {
 		return "", err
 	}
@@ -69,10 +98,14 @@ func (w WeatherPlugin) Execute(jsonInput string) (string, error) {
 	return weatherInfo, nil
 }
 
-func (w WeatherPlugin) getWeather(location string) (string, error) {
+func (w WeatherPlugin) getWeather(ctx context.Context, location string) (string, error) {
 	// 使用 wttr.in 获取天气信息
 	url := fmt.Sprintf("http://wttr.in/%s?format=3", location)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
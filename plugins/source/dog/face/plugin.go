@@ -1,13 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sashabaranov/go-openai"
-	"github.com/sashabaranov/go-openai/jsonschema"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
 
@@ -16,31 +16,34 @@ var Plugin plugins.Plugin = &Face{}
 type Face struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
-	mqttClient   mqtt.Client // MQTT客户端
+	bus          *mqttbus.Bus // 共享的MQTT总线
+	unsubscribe  func()       // 取消状态订阅
 }
 
 type FaceInput struct {
-	Emotion string `json:"emotion"` // 表情控制命令，例如："Normal", "Angry", "Happy"
+	Emotion string `json:"emotion" description:"Emotion command for face control, e.g., 'Normal', 'Angry', 'Happy', 'Glee', 'Sad', 'Worried', 'Focused', 'Annoyed', 'Surprised', 'Skeptic', 'Frustrated', 'Unimpressed', 'Sleepy', 'Suspicious', 'Squint', 'Furious', 'Scared', 'Awe'."` // 表情控制命令，例如："Normal", "Angry", "Happy"
 }
 
 func (f *Face) Init(cfg config.Cfg, openaiClient *openai.Client) error {
-	f.cfg = cfg
-	f.openaiClient = openaiClient
-
-	// 初始化MQTT客户端
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBrokerURL()).
-		SetClientID("face_client").
-		SetUsername(cfg.MQTTUsername()).
-		SetPassword(cfg.MQTTPassword())
-
-	f.mqttClient = mqtt.NewClient(opts)
-	if token := f.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("无法连接到MQTT代理：%v", token.Error())
+	return f.InitWithContext(plugins.InitContext{Cfg: cfg, OpenaiClient: openaiClient})
+}
+
+// InitWithContext 使用共享的MQTT总线初始化插件并订阅表情状态
+func (f *Face) InitWithContext(ictx plugins.InitContext) error {
+	f.cfg = ictx.Cfg
+	f.openaiClient = ictx.OpenaiClient
+
+	bus, err := ictx.Bus()
+	if err != nil {
+		return err
 	}
+	f.bus = bus
 
 	// 订阅表情状态
-	f.mqttClient.Subscribe("emotion/status", 0, f.messageHandler)
+	f.unsubscribe, err = bus.Subscribe("emotion/status", f.messageHandler)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Face plugin initialized successfully")
 	return nil
@@ -54,54 +57,74 @@ func (f *Face) Description() string {
 	return "A face plugin that can control the expression of an ESP8266-based face."
 }
 
+// FunctionDefinition 由FaceInput生成，与ExecuteContext解码参数使用同一个结构体
 func (f *Face) FunctionDefinition() openai.FunctionDefinition {
-	return openai.FunctionDefinition{
-		Name:        "face",
-		Description: "Control the face expression.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"emotion": {
-					Type:        jsonschema.String,
-					Description: "Emotion command for face control, e.g., 'Normal', 'Angry', 'Happy', 'Glee', 'Sad', 'Worried', 'Focused', 'Annoyed', 'Surprised', 'Skeptic', 'Frustrated', 'Unimpressed', 'Sleepy', 'Suspicious', 'Squint', 'Furious', 'Scared', 'Awe'.",
-				},
-			},
-			Required: []string{"emotion"},
-		},
+	return plugins.FunctionDefinitionFor[FaceInput]("face", "Control the face expression.")
+}
+
+func (f *Face) DefaultTimeout() time.Duration {
+	return 10 * time.Second
+}
+
+func (f *Face) ConcurrentSafe() bool {
+	return true
+}
+
+// Shutdown 取消状态订阅，共享的MQTT总线由程序退出时统一断开
+func (f *Face) Shutdown(ctx context.Context) error {
+	if f.unsubscribe != nil {
+		f.unsubscribe()
+		f.unsubscribe = nil
+	}
+	return nil
+}
+
+// Health 检查MQTT连接是否可用
+func (f *Face) Health() error {
+	if f.bus == nil {
+		return fmt.Errorf("MQTT总线未初始化")
 	}
+	return f.bus.Health()
 }
 
 func (f *Face) Execute(jsonInput string) (string, error) {
-	var input FaceInput
-	err := json.Unmarshal([]byte(jsonInput), &input)
+	return f.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (f *Face) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	input, err := plugins.BindArguments[FaceInput]("face", jsonInput)
 	if err != nil {
-		return "", fmt.Errorf("无法解析输入数据：%v", err)
+		return "", err
 	}
 
-	f.controlEmotion(input.Emotion)
+	if err := f.controlEmotion(ctx, input.Emotion); err != nil {
+		return "", err
+	}
 	return fmt.Sprintf("Emotion %s executed successfully", input.Emotion), nil
 }
 
 // controlEmotion 发布表情控制消息到MQTT服务器
-func (f *Face) controlEmotion(emotion string) {
+func (f *Face) controlEmotion(ctx context.Context, emotion string) error {
 	msg := fmt.Sprintf("%s", emotion)
-	sendMessageToMQTT(msg, f.mqttClient)
+	if err := sendMessageToMQTT(ctx, msg, f.bus); err != nil {
+		return err
+	}
 	fmt.Printf("Emotion set to %s\n", emotion)
+	return nil
 }
 
 // messageHandler 处理接收到的MQTT消息并更新表情状态
-func (f *Face) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("Received face status: %s \n", msg.Payload())
+func (f *Face) messageHandler(topic string, payload []byte) {
+	fmt.Printf("Received face status: %s \n", payload)
 }
 
-// sendMessageToMQTT 通过MQTT发送消息
-func sendMessageToMQTT(msg string, mqttClient mqtt.Client) {
-	topic := "emotion/control"
-	token := mqttClient.Publish(topic, 0, false, msg)
-	token.Wait()
-	if token.Error() != nil {
-		fmt.Printf("发送消息到MQTT服务器失败：%v\n", token.Error())
+// sendMessageToMQTT 通过MQTT发送消息，ctx被取消时不再等待发送结果
+func sendMessageToMQTT(ctx context.Context, msg string, bus *mqttbus.Bus) error {
+	if err := bus.Publish(ctx, "emotion/control", msg); err != nil {
+		fmt.Printf("发送消息到MQTT服务器失败：%v\n", err)
+		return err
 	}
+	return nil
 }
 
 // 测试参考数据
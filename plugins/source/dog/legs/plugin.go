@@ -1,13 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sashabaranov/go-openai"
-	"github.com/sashabaranov/go-openai/jsonschema"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
 
@@ -16,32 +16,35 @@ var Plugin plugins.Plugin = &Legs{}
 type Legs struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
-	mqttClient   mqtt.Client // MQTT客户端
+	bus          *mqttbus.Bus // 共享的MQTT总线
+	unsubscribe  func()       // 取消状态订阅
 }
 
 type LegsInput struct {
-	MotorID int `json:"motor_id"` // 电机编号
-	Angle   int `json:"angle"`    // 角度
+	MotorID int `json:"motor_id" description:"ID of the motor to control 0~3." minimum:"0" maximum:"3"`  // 电机编号
+	Angle   int `json:"angle" description:"Angle to set the motor to 0~180°." minimum:"0" maximum:"180"` // 角度
 }
 
 func (f *Legs) Init(cfg config.Cfg, openaiClient *openai.Client) error {
-	f.cfg = cfg
-	f.openaiClient = openaiClient
-
-	// 初始化MQTT客户端
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBrokerURL()).
-		SetClientID("motor_client").
-		SetUsername(cfg.MQTTUsername()).
-		SetPassword(cfg.MQTTPassword())
-
-	f.mqttClient = mqtt.NewClient(opts)
-	if token := f.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("无法连接到MQTT代理：%v", token.Error())
+	return f.InitWithContext(plugins.InitContext{Cfg: cfg, OpenaiClient: openaiClient})
+}
+
+// InitWithContext 使用共享的MQTT总线初始化插件并订阅电机状态
+func (f *Legs) InitWithContext(ictx plugins.InitContext) error {
+	f.cfg = ictx.Cfg
+	f.openaiClient = ictx.OpenaiClient
+
+	bus, err := ictx.Bus()
+	if err != nil {
+		return err
 	}
+	f.bus = bus
 
 	// 订阅电机状态
-	f.mqttClient.Subscribe("motor/status", 0, f.messageHandler)
+	f.unsubscribe, err = bus.Subscribe("motor/status", f.messageHandler)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Legs plugin initialized successfully")
 	return nil
@@ -55,58 +58,74 @@ func (f *Legs) Description() string {
 	return "A legs plugin that can control the motors of legs."
 }
 
+// FunctionDefinition 由LegsInput生成，与ExecuteContext解码参数使用同一个结构体
 func (f *Legs) FunctionDefinition() openai.FunctionDefinition {
-	return openai.FunctionDefinition{
-		Name:        "legs",
-		Description: "Control the motors of the legs.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"motor_id": {
-					Type:        jsonschema.Integer,
-					Description: "ID of the motor to control 0~3.",
-				},
-				"angle": {
-					Type:        jsonschema.Integer,
-					Description: "Angle to set the motor to 0~180°.",
-				},
-			},
-			Required: []string{"motor_id", "angle"},
-		},
+	return plugins.FunctionDefinitionFor[LegsInput]("legs", "Control the motors of the legs.")
+}
+
+func (f *Legs) DefaultTimeout() time.Duration {
+	return 10 * time.Second
+}
+
+func (f *Legs) ConcurrentSafe() bool {
+	return true
+}
+
+// Shutdown 取消状态订阅，共享的MQTT总线由程序退出时统一断开
+func (f *Legs) Shutdown(ctx context.Context) error {
+	if f.unsubscribe != nil {
+		f.unsubscribe()
+		f.unsubscribe = nil
+	}
+	return nil
+}
+
+// Health 检查MQTT连接是否可用
+func (f *Legs) Health() error {
+	if f.bus == nil {
+		return fmt.Errorf("MQTT总线未初始化")
 	}
+	return f.bus.Health()
 }
 
 func (f *Legs) Execute(jsonInput string) (string, error) {
-	var input LegsInput
-	err := json.Unmarshal([]byte(jsonInput), &input)
+	return f.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (f *Legs) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	input, err := plugins.BindArguments[LegsInput]("legs", jsonInput)
 	if err != nil {
-		return "", fmt.Errorf("无法解析输入数据：%v", err)
+		return "", err
 	}
 
-	f.controlMotor(input.MotorID, input.Angle)
+	if err := f.controlMotor(ctx, input.MotorID, input.Angle); err != nil {
+		return "", err
+	}
 	return fmt.Sprintf("Motor %d set to angle %d successfully", input.MotorID, input.Angle), nil
 }
 
 // controlMotor 发布电机控制消息到MQTT服务器
-func (f *Legs) controlMotor(motorID int, angle int) {
+func (f *Legs) controlMotor(ctx context.Context, motorID int, angle int) error {
 	msg := fmt.Sprintf("%d:%d", motorID, angle)
-	sendMessageToMQTT(msg, f.mqttClient)
+	if err := sendMessageToMQTT(ctx, msg, f.bus); err != nil {
+		return err
+	}
 	fmt.Printf("Motor %d set to %d\n", motorID, angle)
+	return nil
 }
 
 // messageHandler 处理接收到的MQTT消息并更新电机状态
-func (f *Legs) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	fmt.Printf("Received motor status: %s \n", msg.Payload())
+func (f *Legs) messageHandler(topic string, payload []byte) {
+	fmt.Printf("Received motor status: %s \n", payload)
 }
 
-// sendMessageToMQTT 通过MQTT发送消息
-func sendMessageToMQTT(msg string, mqttClient mqtt.Client) {
-	topic := "motor/control"
-	token := mqttClient.Publish(topic, 0, false, msg)
-	token.Wait()
-	if token.Error() != nil {
-		fmt.Printf("发送消息到MQTT服务器失败：%v\n", token.Error())
+// sendMessageToMQTT 通过MQTT发送消息，ctx被取消时不再等待发送结果
+func sendMessageToMQTT(ctx context.Context, msg string, bus *mqttbus.Bus) error {
+	if err := bus.Publish(ctx, "motor/control", msg); err != nil {
+		fmt.Printf("发送消息到MQTT服务器失败：%v\n", err)
+		return err
 	}
+	return nil
 }
 
 // 测试参考数据
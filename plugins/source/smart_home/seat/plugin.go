@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sashabaranov/go-openai"
-	"github.com/sashabaranov/go-openai/jsonschema"
 	config "github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
 )
 
@@ -16,14 +18,25 @@ var Plugin plugins.Plugin = &Seat{}
 type Seat struct {
 	cfg          config.Cfg
 	openaiClient *openai.Client
-	mqttClient   mqtt.Client // MQTT客户端
-	seatStatus   SeatStatus
+	bus          *mqttbus.Bus // 共享的MQTT总线
+	unsubscribe  func()       // 取消状态订阅
+
+	mu         sync.Mutex // 保护seatStatus，MQTT回调与工具调用在不同的goroutine中访问
+	seatStatus SeatStatus
 }
 
 type SeatInput struct {
-	Command string `json:"command"` // 控制通风的命令，例如："turn_on", "turn_off", "get_status"
+	Command string `json:"command" description:"Control command for ventilation or get status, e.g., 'turn_on', 'turn_off', 'get_status'." enum:"turn_on,turn_off,get_status"` // 控制通风的命令，例如："turn_on", "turn_off", "get_status"
+}
+
+// VentilationInput seat_set_ventilation工具的参数
+type VentilationInput struct {
+	State string `json:"state" description:"Turn the seat ventilation on or off." enum:"on,off"` // 通风状态
 }
 
+// StatusInput seat_get_status工具没有参数
+type StatusInput struct{}
+
 type SeatStatus struct {
 	Temperature string `json:"temperature"`
 	Humidity    string `json:"humidity"`
@@ -31,23 +44,25 @@ type SeatStatus struct {
 }
 
 func (s *Seat) Init(cfg config.Cfg, openaiClient *openai.Client) error {
-	s.cfg = cfg
-	s.openaiClient = openaiClient
-
-	// 初始化MQTT客户端
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBrokerURL()).
-		SetClientID("seat_client").
-		SetUsername(cfg.MQTTUsername()).
-		SetPassword(cfg.MQTTPassword())
-
-	s.mqttClient = mqtt.NewClient(opts)
-	if token := s.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("无法连接到MQTT代理：%v", token.Error())
+	return s.InitWithContext(plugins.InitContext{Cfg: cfg, OpenaiClient: openaiClient})
+}
+
+// InitWithContext 使用共享的MQTT总线初始化插件并订阅座椅状态
+func (s *Seat) InitWithContext(ictx plugins.InitContext) error {
+	s.cfg = ictx.Cfg
+	s.openaiClient = ictx.OpenaiClient
+
+	bus, err := ictx.Bus()
+	if err != nil {
+		return err
 	}
+	s.bus = bus
 
 	// 订阅座椅状态
-	s.mqttClient.Subscribe("seat/status", 0, s.messageHandler)
+	s.unsubscribe, err = bus.Subscribe("seat/status", s.messageHandler)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Seat plugin initialized successfully")
 	return nil
@@ -61,41 +76,85 @@ func (s *Seat) Description() string {
 	return "A seat plugin that can get temperature, humidity, and ventilation status, and control the ventilation."
 }
 
+// FunctionDefinition 兼容按插件ID调用时的旧参数格式，模型使用的工具由FunctionDefinitions提供
 func (s *Seat) FunctionDefinition() openai.FunctionDefinition {
-	return openai.FunctionDefinition{
-		Name:        "seat",
-		Description: "Control the seat ventilation and get status of temperature, humidity, and ventilation.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"command": {
-					Type:        jsonschema.String,
-					Description: "Control command for ventilation or get status, e.g., 'turn_on', 'turn_off', 'get_status'.",
-				},
-			},
-			Required: []string{"command"},
-		},
+	return plugins.FunctionDefinitionFor[SeatInput]("seat", "Control the seat ventilation and get status of temperature, humidity, and ventilation.")
+}
+
+// FunctionDefinitions 座椅插件提供控制通风和查询状态两个工具
+func (s *Seat) FunctionDefinitions() []openai.FunctionDefinition {
+	return []openai.FunctionDefinition{
+		plugins.FunctionDefinitionFor[VentilationInput]("seat_set_ventilation", "Turn the seat ventilation on or off."),
+		plugins.FunctionDefinitionFor[StatusInput]("seat_get_status", "Get the temperature, humidity, and ventilation status of the seat."),
 	}
 }
 
+// ExecuteFunction 按工具名执行对应的操作
+func (s *Seat) ExecuteFunction(ctx context.Context, name string, jsonInput string) (string, error) {
+	switch name {
+	case "seat_set_ventilation":
+		return plugins.CallTyped(ctx, name, jsonInput, s.setVentilation)
+	case "seat_get_status":
+		return plugins.CallTyped(ctx, name, jsonInput, s.getStatus)
+	default:
+		return "", fmt.Errorf("未知的工具：%s", name)
+	}
+}
+
+// ToolRisk 查询状态是只读操作，控制通风有副作用
+func (s *Seat) ToolRisk(tool string) plugins.ToolRisk {
+	if tool == "seat_get_status" {
+		return plugins.RiskReadOnly
+	}
+	return plugins.RiskSideEffect
+}
+
+func (s *Seat) DefaultTimeout() time.Duration {
+	return 10 * time.Second
+}
+
+func (s *Seat) ConcurrentSafe() bool {
+	return true
+}
+
+// Shutdown 取消状态订阅，共享的MQTT总线由程序退出时统一断开
+func (s *Seat) Shutdown(ctx context.Context) error {
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+		s.unsubscribe = nil
+	}
+	return nil
+}
+
+// Health 检查MQTT连接是否可用
+func (s *Seat) Health() error {
+	if s.bus == nil {
+		return fmt.Errorf("MQTT总线未初始化")
+	}
+	return s.bus.Health()
+}
+
 func (s *Seat) Execute(jsonInput string) (string, error) {
-	var input SeatInput
-	err := json.Unmarshal([]byte(jsonInput), &input)
+	return s.ExecuteContext(context.Background(), jsonInput)
+}
+
+func (s *Seat) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
+	input, err := plugins.BindArguments[SeatInput]("seat", jsonInput)
 	if err != nil {
-		return "", fmt.Errorf("无法解析输入数据：%v", err)
+		return "", err
 	}
 
 	switch input.Command {
 	case "turn_on":
-		s.controlVentilation("on")
+		if err := s.controlVentilation(ctx, "on"); err != nil {
+			return "", err
+		}
 	case "turn_off":
-		s.controlVentilation("off")
-	case "get_status":
-		statusJSON, err := json.Marshal(s.seatStatus)
-		if err != nil {
-			return "", fmt.Errorf("无法序列化座椅状态：%v", err)
+		if err := s.controlVentilation(ctx, "off"); err != nil {
+			return "", err
 		}
-		return string(statusJSON), nil
+	case "get_status":
+		return s.getStatus(ctx, StatusInput{})
 	default:
 		return "", fmt.Errorf("无效的命令：%v", input.Command)
 	}
@@ -103,32 +162,56 @@ func (s *Seat) Execute(jsonInput string) (string, error) {
 	return fmt.Sprintf("Command %s executed successfully", input.Command), nil
 }
 
-func (s *Seat) controlVentilation(state string) {
+// setVentilation 打开或关闭座椅通风
+func (s *Seat) setVentilation(ctx context.Context, input VentilationInput) (string, error) {
+	if err := s.controlVentilation(ctx, input.State); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Ventilation turned %s successfully", input.State), nil
+}
+
+// getStatus 返回最近一次收到的座椅状态
+func (s *Seat) getStatus(ctx context.Context, input StatusInput) (string, error) {
+	s.mu.Lock()
+	status := s.seatStatus
+	s.mu.Unlock()
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return "", fmt.Errorf("无法序列化座椅状态：%v", err)
+	}
+	return string(statusJSON), nil
+}
+
+func (s *Seat) controlVentilation(ctx context.Context, state string) error {
 	msg := fmt.Sprintf("set_ventilation:%s", state)
-	sendMessageToMQTT(msg, s.mqttClient)
+	if err := sendMessageToMQTT(ctx, msg, s.bus); err != nil {
+		return err
+	}
 	fmt.Printf("Ventilation turned %s\n", state)
+	return nil
 }
 
-func (s *Seat) messageHandler(client mqtt.Client, msg mqtt.Message) {
+func (s *Seat) messageHandler(topic string, payload []byte) {
 	var status SeatStatus
-	err := json.Unmarshal(msg.Payload(), &status)
+	err := json.Unmarshal(payload, &status)
 	if err != nil {
 		fmt.Printf("无法解析座椅状态消息：%v\n", err)
 		return
 	}
 
+	s.mu.Lock()
 	s.seatStatus = status
-	fmt.Printf("Received seat status: %+v\n", s.seatStatus)
+	s.mu.Unlock()
+	fmt.Printf("Received seat status: %+v\n", status)
 }
 
-// sendMessageToMQTT 通过MQTT发送消息
-func sendMessageToMQTT(msg string, mqttClient mqtt.Client) {
-	topic := "seat/control"
-	token := mqttClient.Publish(topic, 0, false, msg)
-	token.Wait()
-	if token.Error() != nil {
-		fmt.Printf("发送消息到MQTT服务器失败：%v\n", token.Error())
+// sendMessageToMQTT 通过MQTT发送消息，ctx被取消时不再等待发送结果
+func sendMessageToMQTT(ctx context.Context, msg string, bus *mqttbus.Bus) error {
+	if err := bus.Publish(ctx, "seat/control", msg); err != nil {
+		fmt.Printf("发送消息到MQTT服务器失败：%v\n", err)
+		return err
 	}
+	return nil
 }
 
 // 测试参考数据
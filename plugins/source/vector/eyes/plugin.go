@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	sdk_wrapper "github.com/fforchino/vector-go-sdk/pkg/sdk-wrapper"
 	"github.com/sashabaranov/go-openai"
@@ -49,19 +50,33 @@ func (c CameraPlugin) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+// DefaultTimeout方法返回插件的默认执行超时时间
+func (c CameraPlugin) DefaultTimeout() time.Duration {
+	return 30 * time.Second
+}
+
 // Execute方法执行插件的主要功能，控制摄像头拍照并返回文件名称
 func (c CameraPlugin) Execute(jsonInput string) (string, error) {
+	return c.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，在获得机器人控制权之前ctx被取消时放弃本次控制
+func (c CameraPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 
-	// 执行控制指令
-	ctx := context.Background()
-	start := make(chan bool)
+	// 执行控制指令，控制权在stop之后释放
+	controlCtx, cancelControl := context.WithCancel(context.Background())
+	start := make(chan bool, 1)
 	stop := make(chan bool)
 	go func() {
-		_ = sdk_wrapper.Robot.BehaviorControl(ctx, start, stop)
+		_ = sdk_wrapper.Robot.BehaviorControl(controlCtx, start, stop)
+		cancelControl()
 	}()
 
 	for {
 		select {
+		case <-ctx.Done():
+			cancelControl()
+			return "", ctx.Err()
 		case <-start:
 			sdk_wrapper.SetLocale("en-US")
 			sdk_wrapper.SayText("are you ok ?")
@@ -52,12 +52,23 @@ func (h HeadControlPlugin) FunctionDefinition() openai.FunctionDefinition {
 					Enum: []string{"lift", "lower"},
 				},
 			},
+			Required: []string{"action"},
 		},
 	}
 }
 
+// DefaultTimeout方法返回插件的默认执行超时时间
+func (h HeadControlPlugin) DefaultTimeout() time.Duration {
+	return 30 * time.Second
+}
+
 // Execute方法执行插件的主要功能，控制头部动作
 func (h HeadControlPlugin) Execute(jsonInput string) (string, error) {
+	return h.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，在获得机器人控制权之前ctx被取消时放弃本次控制
+func (h HeadControlPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	// 解析输入
 	var input struct {
 		Action string `json:"action"`
@@ -66,18 +77,23 @@ func (h HeadControlPlugin) Execute(jsonInput string) (string, error) {
 		return "", fmt.Errorf("无法解析输入: %v", err)
 	}
 
-	ctx := context.Background()
-	start := make(chan bool)
+	// 控制权在stop之后释放，自动复位的定时器可能在Execute返回后才发送stop
+	controlCtx, cancelControl := context.WithCancel(context.Background())
+	start := make(chan bool, 1)
 	stop := make(chan bool)
 	downTimer := time.NewTimer(time.Second * 5) // 设置定时器，例如5秒后自动低头
 	downTimer.Stop()                            // 先停止定时器，以备后面根据实际情况启动
 
 	go func() {
-		_ = sdk_wrapper.Robot.BehaviorControl(ctx, start, stop)
+		_ = sdk_wrapper.Robot.BehaviorControl(controlCtx, start, stop)
+		cancelControl()
 	}()
 
 	for {
 		select {
+		case <-ctx.Done():
+			cancelControl()
+			return "", ctx.Err()
 		case <-start:
 			switch input.Action {
 			case "lift":
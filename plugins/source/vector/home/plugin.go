@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	sdk_wrapper "github.com/fforchino/vector-go-sdk/pkg/sdk-wrapper"
 	"github.com/sashabaranov/go-openai"
@@ -55,8 +56,18 @@ func (h HomeControlPlugin) FunctionDefinition() openai.FunctionDefinition {
 	}
 }
 
+// DefaultTimeout方法返回插件的默认执行超时时间
+func (h HomeControlPlugin) DefaultTimeout() time.Duration {
+	return 120 * time.Second
+}
+
 // Execute方法执行插件的主要功能，控制机器人的家庭动作
 func (h HomeControlPlugin) Execute(jsonInput string) (string, error) {
+	return h.ExecuteContext(context.Background(), jsonInput)
+}
+
+// ExecuteContext方法与Execute相同，在获得机器人控制权之前ctx被取消时放弃本次控制
+func (h HomeControlPlugin) ExecuteContext(ctx context.Context, jsonInput string) (string, error) {
 	// 解析输入
 	var input struct {
 		Action string `json:"action"`
@@ -65,15 +76,20 @@ func (h HomeControlPlugin) Execute(jsonInput string) (string, error) {
 		return "", fmt.Errorf("无法解析输入: %v", err)
 	}
 
-	ctx := context.Background()
-	start := make(chan bool)
+	// 控制权在stop之后释放，自动复位的定时器可能在Execute返回后才发送stop
+	controlCtx, cancelControl := context.WithCancel(context.Background())
+	start := make(chan bool, 1)
 	stop := make(chan bool)
 	go func() {
-		_ = sdk_wrapper.Robot.BehaviorControl(ctx, start, stop)
+		_ = sdk_wrapper.Robot.BehaviorControl(controlCtx, start, stop)
+		cancelControl()
 	}()
 
 	for {
 		select {
+		case <-ctx.Done():
+			cancelControl()
+			return "", ctx.Err()
 		case <-start:
 			switch input.Action {
 			case "return":
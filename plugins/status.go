@@ -0,0 +1,285 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PluginState 插件的加载状态
+type PluginState string
+
+const (
+	PluginLoaded   PluginState = "loaded"   // 已加载，可以调用
+	PluginFailed   PluginState = "failed"   // 加载失败
+	PluginUnloaded PluginState = "unloaded" // 已卸载
+)
+
+// PluginStatus 一个插件（或插件文件）的当前状态
+type PluginStatus struct {
+	ID           string        // 插件ID，加载失败且无法取得ID时为文件名
+	Source       string        // 插件文件路径，编译期注册的插件为"registry"
+	State        PluginState   // 加载状态
+	Required     bool          // 是否是必需插件
+	Error        string        // 加载失败的原因
+	LoadDuration time.Duration // 加载（包括Init）耗时
+	UpdatedAt    time.Time     // 状态更新时间
+}
+
+// LoadResult 加载一个插件的结果
+type LoadResult struct {
+	Path     string        // 插件文件路径，编译期注册的插件为空
+	ID       string        // 插件ID，加载失败且无法取得ID时为文件名
+	Required bool          // 是否是必需插件
+	Err      error         // 加载失败的原因，成功时为nil
+	Duration time.Duration // 加载（包括Init）耗时
+}
+
+// LoadReport 一次加载多个插件的结果，单个插件失败不会影响其他插件的加载
+type LoadReport struct {
+	Results []LoadResult
+}
+
+// Loaded 返回加载成功的插件
+func (r LoadReport) Loaded() []LoadResult {
+	var loaded []LoadResult
+	for _, result := range r.Results {
+		if result.Err == nil {
+			loaded = append(loaded, result)
+		}
+	}
+	return loaded
+}
+
+// Failed 返回加载失败的插件
+func (r LoadReport) Failed() []LoadResult {
+	var failed []LoadResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err 返回所有加载失败的错误，全部成功时返回nil
+func (r LoadReport) Err() error {
+	var errs []error
+	for _, result := range r.Failed() {
+		errs = append(errs, fmt.Errorf("plugin %s: %w", result.ID, result.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// RequiredErr 返回必需插件加载失败的错误，必需插件全部成功时返回nil
+func (r LoadReport) RequiredErr() error {
+	var errs []error
+	for _, result := range r.Failed() {
+		if result.Required {
+			errs = append(errs, fmt.Errorf("required plugin %s: %w", result.ID, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String 返回每个插件的加载结果，每行一个插件
+func (r LoadReport) String() string {
+	var b strings.Builder
+	for _, result := range r.Results {
+		kind := "可选"
+		if result.Required {
+			kind = "必需"
+		}
+		source := result.Path
+		if source == "" {
+			source = "registry"
+		}
+		if result.Err != nil {
+			fmt.Fprintf(&b, "插件%s（%s，%s）加载失败，耗时%v：%v\n", result.ID, kind, source, result.Duration, result.Err)
+		} else {
+			fmt.Fprintf(&b, "插件%s（%s，%s）加载成功，耗时%v\n", result.ID, kind, source, result.Duration)
+		}
+	}
+	return b.String()
+}
+
+// LoadPluginsReport 加载指定目录下的所有插件，单个插件失败时继续加载其余插件
+func (pm *PluginManager) LoadPluginsReport(compiledDir string) (LoadReport, error) {
+	var report LoadReport
+	dir, err := pluginDir(compiledDir)
+	if err != nil {
+		return report, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	// 先打开全部插件，再按依赖关系依次初始化
+	var candidates []*loadCandidate
+	for _, file := range files {
+		if !isPluginFile(file.Name()) {
+			continue
+		}
+		path := dir + "/" + file.Name()
+		start := time.Now()
+		c := &loadCandidate{path: path, name: pluginNameFromPath(path)}
+		c.err = catchPanic(func() (err error) {
+			c.plugin, err = pm.openFile(path)
+			return err
+		})
+		c.duration = time.Since(start)
+		candidates = append(candidates, c)
+	}
+	report.Results = pm.initCandidates(candidates)
+	return report, nil
+}
+
+// LoadRegisteredReport 加载指定ID的已注册插件，单个插件失败时继续加载其余插件
+func (pm *PluginManager) LoadRegisteredReport(ids ...string) LoadReport {
+	var candidates []*loadCandidate
+	for _, id := range ids {
+		c := &loadCandidate{name: id}
+		if p, ok := RegisteredPlugin(id); !ok {
+			c.err = fmt.Errorf("plugin %s is not registered", id)
+		} else if p == nil || p.ID() != id {
+			c.err = fmt.Errorf("plugin %s: factory returned a different plugin", id)
+		} else if pm.IsPluginLoaded(id) {
+			c.err = fmt.Errorf("plugin %s is already loaded", id)
+		} else {
+			c.plugin = p
+		}
+		candidates = append(candidates, c)
+	}
+	return LoadReport{Results: pm.initCandidates(candidates)}
+}
+
+// loadFileResult 加载一个插件文件并记录其状态
+func (pm *PluginManager) loadFileResult(path string) LoadResult {
+	start := time.Now()
+	err := catchPanic(func() error { return pm.loadFile(path) })
+	result := LoadResult{Path: path, Err: err, Duration: time.Since(start)}
+	if id, ok := pm.sourceID(path); ok && err == nil {
+		result.ID = id
+	} else {
+		result.ID = pluginNameFromPath(path)
+	}
+	result.Required = pm.isRequired(result.ID)
+	pm.recordStatus(result)
+	return result
+}
+
+// catchPanic 执行f，把插件在加载或Init中的panic转换为错误，避免影响其他插件
+func catchPanic(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+// pluginNameFromPath 根据文件名推断插件名，例如alarm.so和time.plugin.json
+func pluginNameFromPath(path string) string {
+	name := filepath.Base(path)
+	if isManifest(name) {
+		return strings.TrimSuffix(name, ManifestSuffix)
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// isRequired 判断插件是否在配置中被标记为必需
+func (pm *PluginManager) isRequired(id string) bool {
+	for _, required := range pm.cfg.RequiredPlugins() {
+		if required == id {
+			return true
+		}
+	}
+	return false
+}
+
+// recordStatus 根据加载结果更新插件状态
+func (pm *PluginManager) recordStatus(result LoadResult) {
+	status := &PluginStatus{
+		ID:           result.ID,
+		Source:       result.Path,
+		State:        PluginLoaded,
+		Required:     result.Required,
+		LoadDuration: result.Duration,
+		UpdatedAt:    time.Now(),
+	}
+	if status.Source == "" {
+		status.Source = "registry"
+	}
+	if result.Err != nil {
+		status.State = PluginFailed
+		status.Error = result.Err.Error()
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.status[statusKey(status.Source, status.ID)] = status
+}
+
+// markUnloaded 将插件的状态标记为已卸载
+func (pm *PluginManager) markUnloaded(id string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, status := range pm.status {
+		if status.ID == id && status.State == PluginLoaded {
+			status.State = PluginUnloaded
+			status.UpdatedAt = time.Now()
+		}
+	}
+}
+
+// statusKey 状态表的键，文件插件按路径区分，注册插件按ID区分
+func statusKey(source, id string) string {
+	if source == "registry" {
+		return "registry:" + id
+	}
+	return source
+}
+
+// Status 返回所有插件的状态，按插件ID排序
+func (pm *PluginManager) Status() []PluginStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	statuses := make([]PluginStatus, 0, len(pm.status))
+	for _, status := range pm.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].ID != statuses[j].ID {
+			return statuses[i].ID < statuses[j].ID
+		}
+		return statuses[i].Source < statuses[j].Source
+	})
+	return statuses
+}
+
+// PluginStatus 返回指定插件的状态，同一ID有多条记录时优先返回已加载的记录
+func (pm *PluginManager) PluginStatus(id string) (PluginStatus, bool) {
+	var found *PluginStatus
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	for _, status := range pm.status {
+		if status.ID != id {
+			continue
+		}
+		if found == nil || status.State == PluginLoaded || (found.State != PluginLoaded && status.UpdatedAt.After(found.UpdatedAt)) {
+			found = status
+		}
+	}
+	if found == nil {
+		return PluginStatus{}, false
+	}
+	return *found, true
+}
@@ -0,0 +1,142 @@
+package plugins
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+// initPlugin Init时返回错误或panic的测试插件
+type initPlugin struct {
+	recordPlugin
+	err   error
+	panic string
+}
+
+func (p *initPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
+	if p.panic != "" {
+		panic(p.panic)
+	}
+	return p.err
+}
+
+func TestLoadRegisteredReport(t *testing.T) {
+	Register("status_test_ok", func() Plugin { return &recordPlugin{id: "status_test_ok"} })
+	Register("status_test_err", func() Plugin {
+		return &initPlugin{recordPlugin: recordPlugin{id: "status_test_err"}, err: errors.New("no api key")}
+	})
+	Register("status_test_panic", func() Plugin {
+		return &initPlugin{recordPlugin: recordPlugin{id: "status_test_panic"}, panic: "boom"}
+	})
+
+	cfg := config.New().SetRequiredPlugins([]string{"status_test_err"})
+	pm := NewPluginManager(cfg, nil)
+	report := pm.LoadRegisteredReport("status_test_ok", "status_test_err", "status_test_panic", "status_test_missing")
+
+	tests := []struct {
+		id       string
+		state    PluginState
+		required bool
+		err      string
+	}{
+		{id: "status_test_ok", state: PluginLoaded},
+		{id: "status_test_err", state: PluginFailed, required: true, err: "no api key"},
+		{id: "status_test_panic", state: PluginFailed, err: "panic: boom"},
+		{id: "status_test_missing", state: PluginFailed, err: "not registered"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			result := report.Results[i]
+			if result.ID != tt.id || result.Required != tt.required || (result.Err == nil) != (tt.err == "") {
+				t.Errorf("result = %+v", result)
+			}
+			if tt.err != "" && !strings.Contains(result.Err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", result.Err, tt.err)
+			}
+			status, ok := pm.PluginStatus(tt.id)
+			if !ok || status.State != tt.state || status.Source != "registry" || status.Required != tt.required {
+				t.Errorf("status = %+v, want state %s", status, tt.state)
+			}
+			if pm.IsPluginLoaded(tt.id) != (tt.state == PluginLoaded) {
+				t.Errorf("IsPluginLoaded = %v", pm.IsPluginLoaded(tt.id))
+			}
+		})
+	}
+
+	if len(report.Loaded()) != 1 || len(report.Failed()) != 3 {
+		t.Errorf("loaded %d, failed %d, want 1 and 3", len(report.Loaded()), len(report.Failed()))
+	}
+	if err := report.RequiredErr(); err == nil || !strings.Contains(err.Error(), "status_test_err") || strings.Contains(err.Error(), "status_test_panic") {
+		t.Errorf("RequiredErr() = %v, want only the required plugin", err)
+	}
+	if err := report.Err(); err == nil || !strings.Contains(err.Error(), "status_test_missing") {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestPluginStatusSelection(t *testing.T) {
+	now := time.Now()
+	status := func(source string, state PluginState, age time.Duration) *PluginStatus {
+		return &PluginStatus{ID: "a", Source: source, State: state, UpdatedAt: now.Add(-age)}
+	}
+
+	tests := []struct {
+		name       string
+		records    []*PluginStatus
+		wantSource string
+	}{
+		{
+			name:       "loaded record wins over a newer failure",
+			records:    []*PluginStatus{status("registry", PluginLoaded, time.Hour), status("/p/a.so", PluginFailed, 0)},
+			wantSource: "registry",
+		},
+		{
+			name:       "newest record without a loaded one",
+			records:    []*PluginStatus{status("/p/a.so", PluginFailed, time.Hour), status("/p/a.plugin.json", PluginUnloaded, time.Minute), status("registry", PluginFailed, 2*time.Hour)},
+			wantSource: "/p/a.plugin.json",
+		},
+		{
+			name:       "single record",
+			records:    []*PluginStatus{status("/p/a.so", PluginFailed, 0)},
+			wantSource: "/p/a.so",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := newTestManager()
+			for _, record := range tt.records {
+				pm.status[statusKey(record.Source, record.ID)] = record
+			}
+			got, ok := pm.PluginStatus("a")
+			if !ok || got.Source != tt.wantSource {
+				t.Errorf("PluginStatus(a) = %+v, want source %s", got, tt.wantSource)
+			}
+			if len(pm.Status()) != len(tt.records) {
+				t.Errorf("Status() has %d records, want %d", len(pm.Status()), len(tt.records))
+			}
+		})
+	}
+
+	if _, ok := newTestManager().PluginStatus("a"); ok {
+		t.Error("PluginStatus found a plugin that was never loaded")
+	}
+}
+
+func TestUnloadMarksStatus(t *testing.T) {
+	Register("status_test_unload", func() Plugin { return &recordPlugin{id: "status_test_unload"} })
+	pm := newTestManager()
+	if err := pm.LoadRegistered("status_test_unload"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Unload("status_test_unload"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := pm.PluginStatus("status_test_unload"); status.State != PluginUnloaded {
+		t.Errorf("state = %s, want %s", status.State, PluginUnloaded)
+	}
+}
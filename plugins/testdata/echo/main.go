@@ -0,0 +1,56 @@
+// echo 测试用的子进程插件，由process_test.go编译并通过清单加载
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
+)
+
+type echoPlugin struct {
+	cfg config.Cfg
+}
+
+func (p *echoPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error {
+	p.cfg = cfg
+	return nil
+}
+
+func (echoPlugin) ID() string { return "echo" }
+
+// Description 返回工作目录中description.txt的内容，没有该文件时返回默认说明，用于测试重启后重新获取描述
+func (echoPlugin) Description() string {
+	if b, err := os.ReadFile("description.txt"); err == nil {
+		return string(b)
+	}
+	return "原样返回输入"
+}
+
+func (echoPlugin) FunctionDefinition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{Name: "echo", Description: "原样返回输入"}
+}
+
+// Execute 返回输入；"crash"使进程退出，"fail"返回错误，"topic_prefix"返回宿主配置中的MQTT主题前缀
+func (p *echoPlugin) Execute(jsonInput string) (string, error) {
+	fmt.Println("echo:", jsonInput) // 插件自身的输出不能破坏JSON-RPC消息
+	switch jsonInput {
+	case "topic_prefix":
+		return p.cfg.MQTTTopicPrefix(), nil
+	case "crash":
+		os.Exit(2)
+	case "fail":
+		return "", errors.New("echo failed")
+	}
+	return jsonInput, nil
+}
+
+func main() {
+	if err := plugins.Serve(&echoPlugin{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Version 返回已加载插件的版本号，插件加载或卸载后递增
+// 使用方可以通过比较版本号判断是否需要重新生成工具列表
+func (pm *PluginManager) Version() uint64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.version
+}
+
+// Unload 卸载指定ID的插件，之后的调用会返回插件不存在
+// 子进程插件的进程会被结束；.so插件的代码无法从进程中移除，只是不再可用
+func (pm *PluginManager) Unload(id string) error {
+	pm.mu.Lock()
+	p, ok := pm.loadedPlugins[id]
+	if !ok {
+		pm.mu.Unlock()
+		return fmt.Errorf("plugin %s is not loaded", id)
+	}
+	delete(pm.loadedPlugins, id)
+	pm.order = removeID(pm.order, id)
+	for source, sourceID := range pm.sources {
+		if sourceID == id {
+			delete(pm.sources, source)
+		}
+	}
+	pm.version++
+	pm.mu.Unlock()
+	pm.markUnloaded(id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return shutdownPlugin(ctx, p)
+}
+
+// Watch 定期扫描插件目录：加载新增的插件，卸载文件已删除的插件，重新加载修改过的清单
+// 已修改的.so文件无法在运行时替换，只记录日志；返回的函数用于停止监视
+func (pm *PluginManager) Watch(compiledDir string, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dir, err := pluginDir(compiledDir)
+	if err != nil {
+		fmt.Printf("无法监视插件目录%s：%v\n", compiledDir, err)
+		return cancel
+	}
+
+	// 调用Watch时目录中已有的插件由LoadPlugins负责加载
+	seen := scanPluginFiles(dir)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			seen = pm.syncPluginFiles(dir, seen)
+		}
+	}()
+	return cancel
+}
+
+// scanPluginFiles 返回目录中所有插件文件及其修改时间
+func scanPluginFiles(dir string) map[string]time.Time {
+	files := make(map[string]time.Time)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return files
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isPluginFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[dir+"/"+entry.Name()] = info.ModTime()
+	}
+	return files
+}
+
+// syncPluginFiles 对比两次扫描的结果并加载、卸载或重新加载插件，返回本次扫描的结果
+// 加载失败的文件在修改之前不会重试
+func (pm *PluginManager) syncPluginFiles(dir string, seen map[string]time.Time) map[string]time.Time {
+	current := scanPluginFiles(dir)
+
+	for path := range seen {
+		if _, ok := current[path]; ok {
+			continue
+		}
+		if id, ok := pm.sourceID(path); ok {
+			if err := pm.Unload(id); err != nil {
+				fmt.Printf("插件%s卸载失败：%v\n", id, err)
+			} else {
+				fmt.Printf("插件文件%s已删除，插件%s已卸载\n", path, id)
+			}
+		}
+	}
+
+	for path, modTime := range current {
+		oldModTime, existed := seen[path]
+		switch {
+		case !existed:
+			pm.loadWatchedFile(path, "发现新插件文件")
+		case !modTime.Equal(oldModTime):
+			id, loaded := pm.sourceID(path)
+			if loaded && !isManifest(path) {
+				fmt.Printf("插件文件%s已修改，.so插件无法在运行时替换，需要重启程序\n", path)
+				continue
+			}
+			if loaded {
+				if err := pm.Unload(id); err != nil {
+					fmt.Printf("插件%s卸载失败：%v\n", id, err)
+					continue
+				}
+			}
+			pm.loadWatchedFile(path, "插件文件已修改")
+		}
+	}
+	return current
+}
+
+// loadWatchedFile 加载监视到的插件文件并记录日志
+func (pm *PluginManager) loadWatchedFile(path string, reason string) {
+	result := pm.loadFileResult(path)
+	if result.Err != nil {
+		fmt.Printf("%s：%s，加载失败：%v\n", reason, path, result.Err)
+		return
+	}
+	fmt.Printf("%s：%s，插件%s已加载\n", reason, path, result.ID)
+}
+
+// sourceID 返回插件文件对应的已加载插件ID
+func (pm *PluginManager) sourceID(path string) (string, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	id, ok := pm.sources[path]
+	return id, ok
+}
+
+// isManifest 判断文件是否是子进程插件的清单
+func isManifest(path string) bool {
+	return strings.HasSuffix(path, ManifestSuffix)
+}
@@ -0,0 +1,96 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncPluginFiles(t *testing.T) {
+	manifest, err := os.ReadFile(buildEchoPlugin(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "echo"+ManifestSuffix)
+	pm := newTestManager()
+	seen := scanPluginFiles(dir)
+
+	// loaded 返回echo插件当前的实例，未加载时为nil
+	loaded := func() *processPlugin {
+		pm.mu.RLock()
+		defer pm.mu.RUnlock()
+		p, _ := pm.loadedPlugins["echo"].(*processPlugin)
+		return p
+	}
+
+	steps := []struct {
+		name       string
+		change     func() error
+		wantLoaded bool
+		wantNew    bool // 是否换成了新的插件实例
+	}{
+		{
+			name:       "new file is loaded",
+			change:     func() error { return os.WriteFile(path, manifest, 0o644) },
+			wantLoaded: true,
+			wantNew:    true,
+		},
+		{
+			name:       "unchanged file is kept",
+			change:     func() error { return nil },
+			wantLoaded: true,
+		},
+		{
+			name: "modified manifest is reloaded",
+			change: func() error {
+				later := time.Now().Add(time.Minute)
+				return os.Chtimes(path, later, later)
+			},
+			wantLoaded: true,
+			wantNew:    true,
+		},
+		{
+			name:   "removed file is unloaded",
+			change: func() error { return os.Remove(path) },
+		},
+	}
+
+	var previous *processPlugin
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		version := pm.Version()
+		seen = pm.syncPluginFiles(dir, seen)
+
+		current := loaded()
+		if (current != nil) != step.wantLoaded {
+			t.Fatalf("%s: loaded = %v, want %v", step.name, current != nil, step.wantLoaded)
+		}
+		if changed := current != previous; changed != (step.wantNew || !step.wantLoaded) {
+			t.Errorf("%s: plugin instance changed = %v", step.name, changed)
+		}
+		if changed := pm.Version() != version; changed != (current != previous) {
+			t.Errorf("%s: version changed = %v", step.name, changed)
+		}
+		if previous != nil && current != previous && previous.proc != nil {
+			t.Errorf("%s: process of the replaced plugin is still running", step.name)
+		}
+		previous = current
+	}
+}
+
+func TestUnload(t *testing.T) {
+	pm := newTestManager(&recordPlugin{id: "a"})
+	if err := pm.Unload("a"); err != nil {
+		t.Fatal(err)
+	}
+	if pm.IsPluginLoaded("a") {
+		t.Error("a is still loaded")
+	}
+	if err := pm.Unload("a"); err == nil {
+		t.Error("unloading twice succeeded")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -15,6 +16,15 @@ import (
 var userTopic = "chat_ui/user"
 var aiTopic = "chat_ui/ai"
 var logTopic = "chat_ui/log"
+var confirmTopic = "chat_ui/confirm" // 工具调用的确认请求，回复发布到confirmTopic+"/reply"
+
+// confirmRequest 助手发来的工具调用确认请求
+type confirmRequest struct {
+	ID        string `json:"id"`
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	Risk      string `json:"risk"`
+}
 
 var cfg = config.New()
 
@@ -41,6 +51,9 @@ func main() {
 	// 渲染界面
 	ui.Render(logBox, dialogBox)
 
+	// 确认请求在MQTT回调中收到，交给界面循环处理
+	confirmRequests := make(chan confirmRequest, 8)
+
 	// 创建MQTT客户端选项
 	opts := MQTT.NewClientOptions().AddBroker(cfg.MQTTBrokerURL())
 	opts.SetClientID("chat_ui_mqtt_client")
@@ -54,6 +67,11 @@ func main() {
 		} else if msg.Topic() == logTopic {
 			logBox.Text += fmt.Sprintf("LOG: %s\n", msg.Payload())
 			ui.Render(logBox)
+		} else if msg.Topic() == confirmTopic {
+			var req confirmRequest
+			if err := json.Unmarshal(msg.Payload(), &req); err == nil {
+				confirmRequests <- req
+			}
 		}
 	})
 
@@ -74,12 +92,42 @@ func main() {
 		ui.Close()
 		os.Exit(1)
 	}
+	if token := client.Subscribe(confirmTopic, 1, nil); token.Wait() && token.Error() != nil {
+		fmt.Println(token.Error())
+		ui.Close()
+		os.Exit(1)
+	}
 
 	// 处理用户输入
 	uiEvents := ui.PollEvents()
 	inputBuffer := ""
+	var pending []confirmRequest // 等待用户回答的确认请求，按到达顺序依次回答
 	for {
-		e := <-uiEvents
+		var e ui.Event
+		select {
+		case req := <-confirmRequests:
+			pending = append(pending, req)
+			logBox.Text += fmt.Sprintf("CONFIRM: 是否执行工具 %s（%s）参数：%s，按y同意，按n拒绝\n", req.Tool, req.Risk, req.Arguments)
+			ui.Render(logBox)
+			continue
+		case e = <-uiEvents:
+		}
+
+		// 有待确认的请求时，y和n用于回答，不作为输入
+		if len(pending) > 0 && (e.ID == "y" || e.ID == "n") {
+			approved := e.ID == "y"
+			reply, _ := json.Marshal(map[string]interface{}{"id": pending[0].ID, "approved": approved})
+			client.Publish(confirmTopic+"/reply", 1, false, reply).Wait()
+			result := "已拒绝"
+			if approved {
+				result = "已同意"
+			}
+			logBox.Text += fmt.Sprintf("CONFIRM: %s %s\n", pending[0].Tool, result)
+			ui.Render(logBox)
+			pending = pending[1:]
+			continue
+		}
+
 		switch e.ID {
 		case "q", "<C-c>":
 			client.Disconnect(250)
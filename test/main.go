@@ -1,15 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	openai "github.com/sashabaranov/go-openai"
 	"github.com/wangergou2023/agi_modules_for_go/config"
+	"github.com/wangergou2023/agi_modules_for_go/mqttbus"
+	"github.com/wangergou2023/agi_modules_for_go/plugins"
+	_ "github.com/wangergou2023/agi_modules_for_go/plugins/source/builtin/time"
 	"github.com/wangergou2023/agi_modules_for_go/xiao_wan"
 )
 
@@ -23,15 +28,17 @@ func main() {
 	fmt.Println("xiao wan is starting up... Please wait a moment.")
 
 	config := openai.DefaultConfig(cfg.OpenAiAPIKey())
+	// time插件编译进主程序，由小丸的助手加载
+	cfg = cfg.SetAgentPlugins("for_chat", []string{"time"})
+
 	//need"/v1"
 	config.BaseURL = cfg.OpenAibaseURL()
 	openaiClient := openai.NewClientWithConfig(config)
-	openaiClient_face := openai.NewClientWithConfig(config)
 	openaiClient_legs := openai.NewClientWithConfig(config)
 	openaiClient_friend_duolaameng := openai.NewClientWithConfig(config)
 
-	var xiao_wan_chat_stt xiao_wan.Xiao_wan
-	var xiao_wan_chat_tts xiao_wan.Xiao_wan
+	var xiao_wan_chat_stt *xiao_wan.Xiao_wan
+	var xiao_wan_chat_tts *xiao_wan.Xiao_wan
 
 	if enableSTT {
 		openaiClient_stt := openai.NewClientWithConfig(config)
@@ -43,17 +50,62 @@ func main() {
 		xiao_wan_chat_tts = xiao_wan.StartOne(cfg, openaiClient_tts, xiao_wan.TtsPrompt, "for_after_chat")
 	}
 
-	xiao_wan_chat := xiao_wan.Start(cfg, openaiClient)
-	xiao_wan_chat_face := xiao_wan.StartOne(cfg, openaiClient_face, xiao_wan.FacePrompt, "for_after_chat2")
-	xiao_wan_chat_legs := xiao_wan.StartOne(cfg, openaiClient_legs, xiao_wan.LegsPrompt, "for_after_chat3")
-	xiao_wan_friend_duolaameng := xiao_wan.StartOne(cfg, openaiClient_friend_duolaameng, xiao_wan.DuolaamengPrompt, "for_before_chat")
+	// 标准输入只由terminal读取，执行命令等危险工具前在终端上询问，其余输入作为对话从terminal.Lines读出
+	// MQTT消息触发的对话与终端对话并发进行，两者的确认都经过terminal，不会同时读取标准输入
+	terminal := plugins.NewStdinConfirmer(os.Stdin, os.Stdout)
+
+	// 小丸的回复按Dialogue的JSON Schema输出，并每5秒检查一次插件目录热加载插件
+	chatOpts := []xiao_wan.StartOption{
+		xiao_wan.WithDialogueSchema(),
+		// 流式输出的台词被修正时，另起一行输出修正后的台词
+		xiao_wan.WithStreamCorrection(func(text string) {
+			fmt.Printf("\r\nxiao wan（更正）:%s", text)
+		}),
+		xiao_wan.WithPluginWatch(5 * time.Second),
+		xiao_wan.WithConfirmer(terminal),
+	}
+	// 哆啦A梦加载的command插件默认需要确认，同样在终端上询问
+	duolaamengOpts := []xiao_wan.StartOption{xiao_wan.WithConfirmer(terminal)}
+	// 会话持久化到conversations目录，重启后按会话ID恢复
+	if store, err := xiao_wan.NewJSONLStore("conversations"); err != nil {
+		fmt.Printf("Error creating conversation store: %v\n", err)
+	} else {
+		chatOpts = append(chatOpts, xiao_wan.WithStore(store), xiao_wan.WithSessionID("xiao_wan"))
+		duolaamengOpts = append(duolaamengOpts, xiao_wan.WithStore(store), xiao_wan.WithSessionID("duolaameng"))
+	}
+
+	xiao_wan_chat := xiao_wan.Start(cfg, openaiClient, chatOpts...)
+	// 表情和动作按映射表直接调用face、legs插件，映射表可以用dispatch_table.json覆盖
+	table, err := xiao_wan.LoadDispatchTable("dispatch_table.json")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error loading dispatch table: %v\n", err)
+		}
+		table = xiao_wan.DefaultDispatchTable()
+	}
+	dispatcher := xiao_wan.NewDispatcher(cfg, openaiClient_legs, table, "for_after_chat2", "for_after_chat3")
+	// 表中没有的动作才交给动作管理助手，助手与调度器共用插件
+	dispatcher.SetFallback(xiao_wan.StartOne(cfg, openaiClient_legs, xiao_wan.LegsPrompt, "for_after_chat3", xiao_wan.WithPluginManager(dispatcher.Plugins())))
+	xiao_wan_friend_duolaameng := xiao_wan.StartOne(cfg, openaiClient_friend_duolaameng, xiao_wan.DuolaamengPrompt, "for_before_chat", duolaamengOpts...)
+
+	// 收到退出信号时按加载的相反顺序关闭插件，断开MQTT和milvus连接
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("Shutting down...")
+		xiao_wan_chat.Close()
+		xiao_wan_friend_duolaameng.Close()
+		dispatcher.Close()
+		mqttbus.CloseShared()
+		os.Exit(0)
+	}()
 
 	// 启动MQTT订阅
-	go startMQTTClient(&xiao_wan_chat)
+	go startMQTTClient(xiao_wan_chat)
 	// 等3秒订阅成功
 	time.Sleep(3 * time.Second)
 
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Conversation")
 	fmt.Println("---------------------")
 
@@ -64,48 +116,63 @@ func main() {
 
 	for {
 		fmt.Print("-> ")
-		text, _ := reader.ReadString('\n')
-		text = strings.Replace(text, "\n", "", -1)
+		text, ok := <-terminal.Lines()
+		if !ok {
+			// 标准输入已结束
+			return
+		}
+		text = strings.Replace(text, "\r", "", -1)
 
 		duolaameng_response, _ := xiao_wan_friend_duolaameng.MessageOne(text)
 		fmt.Printf("duolaameng:%s\r\n", duolaameng_response)
-		xiao_wan_friend_duolaameng.SaveConversationToJSON("your_friend", duolaameng_response)
-		response, _ := xiao_wan_chat.Message(text)
-		fmt.Printf("xiao wan:%s\r\n", response)
+		// 将哆啦A梦的回答放入小丸的短期记忆
+		xiao_wan_chat.SaveConversationToJSON("your_friend", duolaameng_response)
+		// 流式输出小丸的回答，不必等待完整回复
+		fmt.Print("xiao wan:")
+		response, err := xiao_wan_chat.MessageStream(context.Background(), text, func(delta string) {
+			fmt.Print(delta)
+		})
+		fmt.Print("\r\n")
+		if err != nil {
+			// 例如工具调用轮数超限或重复调用，本轮对话终止
+			fmt.Printf("xiao wan error:%v\r\n", err)
+			continue
+		}
 
 		if enableTTS {
 			response2, _ := xiao_wan_chat_tts.MessageOne(response)
 			fmt.Printf("xiao wan tts:%s\r\n", response2)
 		}
 
-		go xiao_wan_chat_face.MessageOne(response)
-		go xiao_wan_chat_legs.MessageOne(response)
+		var dialogue xiao_wan.Dialogue
+		if err := json.Unmarshal([]byte(response), &dialogue); err != nil {
+			fmt.Printf("Error parsing dialogue: %v\r\n", err)
+			continue
+		}
+		go func() {
+			if err := dispatcher.Dispatch(context.Background(), &dialogue); err != nil {
+				fmt.Printf("dispatch error:%v\r\n", err)
+			}
+		}()
 	}
 }
 
-// 启动MQTT客户端，订阅消息
+// 通过与插件共享的MQTT总线订阅插件消息
 func startMQTTClient(xiao_wan_chat *xiao_wan.Xiao_wan) {
-	// 生成随机客户端ID
-	clientID := fmt.Sprintf("xiao_wan_client_%d", time.Now().UnixNano())
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTBrokerURL()).
-		SetClientID(clientID).
-		SetUsername(cfg.MQTTUsername()).
-		SetPassword(cfg.MQTTPassword())
-	client := mqtt.NewClient(opts)
-
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Error connecting to MQTT broker: %v\n", token.Error())
+	bus, err := mqttbus.Shared(cfg)
+	if err != nil {
+		fmt.Printf("Error connecting to MQTT broker: %v\n", err)
 		return
 	}
 
 	topic := "plugin/messages"
-	if token := client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		message := string(msg.Payload())
+	if _, err := bus.Subscribe(topic, func(topic string, payload []byte) {
+		message := string(payload)
 		fmt.Printf("Received message from plugin: %s\n", message)
-		xiao_wan_chat.Message(message)
-	}); token.Wait() && token.Error() != nil {
-		fmt.Printf("Error subscribing to topic %s: %v\n", topic, token.Error())
+		// 回调在总线的消息分发goroutine中执行，对话放到新的goroutine，避免阻塞其他订阅
+		go xiao_wan_chat.Message(message)
+	}); err != nil {
+		fmt.Printf("Error subscribing to topic %s: %v\n", topic, err)
 		return
 	}
 
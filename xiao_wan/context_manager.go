@@ -0,0 +1,224 @@
+package xiao_wan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// summaryPrefix 标记由contextManager生成的摘要消息
+const summaryPrefix = "以下是之前对话的摘要："
+
+// summaryPrompt 指导模型如何总结被移出上下文的对话
+const summaryPrompt = `你负责压缩对话历史。请用简洁的中文总结下面的对话，保留用户的偏好、提到的事实、已经完成的操作及其结果，以及尚未解决的问题。只输出摘要本身。`
+
+// 摘要时每条消息最多保留的字符数，避免过长的工具结果占满摘要请求
+const summaryMessageLimit = 500
+
+// contextManager 控制每次请求发送给模型的上下文长度
+// 对话超出token预算时，较早的消息会被总结成一条摘要（或直接丢弃），
+// 系统提示和当前一轮对话（最后一条用户消息及其后的工具调用和结果）总是完整保留
+type contextManager struct {
+	client    *openai.Client
+	model     string
+	budget    int  // token预算，<=0表示不限制
+	summarize bool // 是否用模型总结被移出的消息
+}
+
+// newContextManager 创建contextManager
+func newContextManager(client *openai.Client, model string, budget int, summarize bool) *contextManager {
+	return &contextManager{
+		client:    client,
+		model:     model,
+		budget:    budget,
+		summarize: summarize,
+	}
+}
+
+// compact 在会话超出token预算时压缩会话历史
+// 压缩后保留约3/4的预算，避免之后每一轮都触发总结；调用方需持有s.turnMu
+func (cm *contextManager) compact(ctx context.Context, s *Session, tools []openai.Tool) error {
+	if cm == nil || cm.budget <= 0 {
+		return nil
+	}
+
+	conversation := s.Conversation()
+	reserved := estimateToolsTokens(tools)
+	total := reserved + estimateConversationTokens(conversation)
+	if total <= cm.budget {
+		return nil
+	}
+
+	head, blocks := splitConversation(conversation)
+	target := cm.budget * 3 / 4
+	cut := 0
+	// 当前一轮对话从最后一条用户消息开始，之后可能已经有多轮工具调用，全部保留
+	current := currentTurnStart(blocks)
+	for cut < current && total > target {
+		total -= estimateConversationTokens(blocks[cut])
+		cut++
+	}
+	if cut == 0 {
+		return nil
+	}
+
+	var dropped []openai.ChatCompletionMessage
+	for _, block := range blocks[:cut] {
+		dropped = append(dropped, block...)
+	}
+
+	compacted := append([]openai.ChatCompletionMessage(nil), head...)
+	if cm.summarize {
+		summary, err := cm.summarizeMessages(ctx, dropped)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Println("总结较早的对话失败，直接丢弃:", err)
+		} else {
+			compacted = append(compacted, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: summaryPrefix + summary,
+			})
+		}
+	}
+	for _, block := range blocks[cut:] {
+		compacted = append(compacted, block...)
+	}
+
+	fmt.Printf("上下文超出预算，已压缩%d条较早的消息\n", len(dropped))
+	s.replace(compacted)
+	return nil
+}
+
+// summarizeMessages 使用模型总结一组消息
+func (cm *contextManager) summarizeMessages(ctx context.Context, messages []openai.ChatCompletionMessage) (string, error) {
+	var transcript strings.Builder
+	for _, m := range messages {
+		for _, toolCall := range m.ToolCalls {
+			fmt.Fprintf(&transcript, "%s调用工具 %s(%s)\n", m.Role, toolCall.Function.Name, truncateRunes(toolCall.Function.Arguments, summaryMessageLimit))
+		}
+		if m.Content != "" {
+			fmt.Fprintf(&transcript, "%s: %s\n", m.Role, truncateRunes(m.Content, summaryMessageLimit))
+		}
+	}
+
+	resp, err := cm.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:     cm.model,
+		MaxTokens: 512,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("empty summary response")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// splitConversation 将对话拆分为开头的系统提示和若干消息组
+// 带ToolCalls的assistant消息与紧随其后的tool消息组成一组，保证压缩时不会拆开
+func splitConversation(conversation []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, [][]openai.ChatCompletionMessage) {
+	var head []openai.ChatCompletionMessage
+	i := 0
+	if len(conversation) > 0 && conversation[0].Role == openai.ChatMessageRoleSystem && !isSummary(conversation[0]) {
+		head = conversation[:1]
+		i = 1
+	}
+
+	var blocks [][]openai.ChatCompletionMessage
+	for i < len(conversation) {
+		j := i + 1
+		if conversation[i].Role == openai.ChatMessageRoleAssistant && len(conversation[i].ToolCalls) > 0 {
+			for j < len(conversation) && conversation[j].Role == openai.ChatMessageRoleTool {
+				j++
+			}
+		}
+		blocks = append(blocks, conversation[i:j])
+		i = j
+	}
+	return head, blocks
+}
+
+// currentTurnStart 返回当前一轮对话的第一组消息，即最后一条用户消息所在的组
+// 没有用户消息时只保留最后一组
+func currentTurnStart(blocks [][]openai.ChatCompletionMessage) int {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i][0].Role == openai.ChatMessageRoleUser {
+			return i
+		}
+	}
+	return max(len(blocks)-1, 0)
+}
+
+// isSummary 判断消息是否是contextManager生成的摘要
+func isSummary(m openai.ChatCompletionMessage) bool {
+	return m.Role == openai.ChatMessageRoleSystem && strings.HasPrefix(m.Content, summaryPrefix)
+}
+
+// estimateTokens 估算文本的token数量
+// 中文等非ASCII字符大约每个字符1个token，ASCII文本大约每4个字符1个token
+func estimateTokens(text string) int {
+	tokens, ascii := 0, 0
+	for _, r := range text {
+		if r < 128 {
+			ascii++
+		} else {
+			tokens++
+		}
+	}
+	return tokens + (ascii+3)/4
+}
+
+// estimateMessageTokens 估算一条消息的token数量，包括每条消息固定的格式开销
+func estimateMessageTokens(m openai.ChatCompletionMessage) int {
+	tokens := 4 + estimateTokens(m.Content) + estimateTokens(m.Name)
+	for _, part := range m.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeImageURL {
+			tokens += 85
+			continue
+		}
+		tokens += estimateTokens(part.Text)
+	}
+	for _, toolCall := range m.ToolCalls {
+		tokens += 4 + estimateTokens(toolCall.ID) + estimateTokens(toolCall.Function.Name) + estimateTokens(toolCall.Function.Arguments)
+	}
+	return tokens
+}
+
+// estimateConversationTokens 估算一组消息的token数量
+func estimateConversationTokens(messages []openai.ChatCompletionMessage) int {
+	tokens := 0
+	for _, m := range messages {
+		tokens += estimateMessageTokens(m)
+	}
+	return tokens
+}
+
+// estimateToolsTokens 估算工具定义占用的token数量
+func estimateToolsTokens(tools []openai.Tool) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	b, err := json.Marshal(tools)
+	if err != nil {
+		return 0
+	}
+	return estimateTokens(string(b))
+}
+
+// truncateRunes 将文本截断到最多n个字符
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "..."
+}
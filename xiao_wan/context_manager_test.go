@@ -0,0 +1,180 @@
+package xiao_wan
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func message(role, content string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: role, Content: content}
+}
+
+func toolRequest(names ...string) openai.ChatCompletionMessage {
+	m := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	for _, name := range names {
+		m.ToolCalls = append(m.ToolCalls, toolCall(name, `{}`))
+	}
+	return m
+}
+
+// roles 把消息组转换为角色列表，便于比较拆分结果
+func roles(blocks [][]openai.ChatCompletionMessage) [][]string {
+	var out [][]string
+	for _, block := range blocks {
+		var rs []string
+		for _, m := range block {
+			rs = append(rs, m.Role)
+		}
+		out = append(out, rs)
+	}
+	return out
+}
+
+func TestSplitConversation(t *testing.T) {
+	const (
+		system    = openai.ChatMessageRoleSystem
+		user      = openai.ChatMessageRoleUser
+		assistant = openai.ChatMessageRoleAssistant
+		tool      = openai.ChatMessageRoleTool
+	)
+
+	tests := []struct {
+		name         string
+		conversation []openai.ChatCompletionMessage
+		head         int
+		blocks       [][]string
+	}{
+		{
+			name:         "empty",
+			conversation: nil,
+		},
+		{
+			name: "system prompt and plain messages",
+			conversation: []openai.ChatCompletionMessage{
+				message(system, "提示"), message(user, "你好"), message(assistant, "你好呀"),
+			},
+			head:   1,
+			blocks: [][]string{{user}, {assistant}},
+		},
+		{
+			name: "tool calls stay with their results",
+			conversation: []openai.ChatCompletionMessage{
+				message(system, "提示"), message(user, "几点了"),
+				toolRequest("time", "weather"), message(tool, "10点"), message(tool, "晴"),
+				message(assistant, "10点，晴天"),
+			},
+			head:   1,
+			blocks: [][]string{{user}, {assistant, tool, tool}, {assistant}},
+		},
+		{
+			name: "summary is not treated as the system prompt",
+			conversation: []openai.ChatCompletionMessage{
+				message(system, summaryPrefix+"之前聊过天气"), message(user, "继续"),
+			},
+			head:   0,
+			blocks: [][]string{{system}, {user}},
+		},
+		{
+			name: "unfinished tool call at the end",
+			conversation: []openai.ChatCompletionMessage{
+				message(user, "开灯"), toolRequest("light"),
+			},
+			blocks: [][]string{{user}, {assistant}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, blocks := splitConversation(tt.conversation)
+			if len(head) != tt.head {
+				t.Errorf("head has %d messages, want %d", len(head), tt.head)
+			}
+			if got := roles(blocks); !reflect.DeepEqual(got, tt.blocks) {
+				t.Errorf("blocks = %v, want %v", got, tt.blocks)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	long := strings.Repeat("很长的内容", 20) // 约100个token
+
+	tests := []struct {
+		name   string
+		budget int
+		build  func(s *Session)
+		want   []string // 压缩后各消息的角色
+	}{
+		{
+			name:   "within budget",
+			budget: 10000,
+			build: func(s *Session) {
+				s.append(message(openai.ChatMessageRoleUser, long), message(openai.ChatMessageRoleAssistant, long))
+			},
+			want: []string{"system", "user", "assistant"},
+		},
+		{
+			name:   "drops oldest messages",
+			budget: 300,
+			build: func(s *Session) {
+				for i := 0; i < 3; i++ {
+					s.append(message(openai.ChatMessageRoleUser, long), message(openai.ChatMessageRoleAssistant, long))
+				}
+				s.append(message(openai.ChatMessageRoleUser, "最新的问题"))
+			},
+			want: []string{"system", "user", "assistant", "user"},
+		},
+		{
+			name:   "keeps tool results with their call",
+			budget: 300,
+			build: func(s *Session) {
+				s.append(message(openai.ChatMessageRoleUser, long), message(openai.ChatMessageRoleAssistant, long))
+				s.append(message(openai.ChatMessageRoleUser, long), message(openai.ChatMessageRoleAssistant, long))
+				s.append(toolRequest("time"), message(openai.ChatMessageRoleTool, long), message(openai.ChatMessageRoleTool, long))
+			},
+			want: []string{"system", "user", "assistant", "assistant", "tool", "tool"},
+		},
+		{
+			name:   "keeps every tool round of the current turn",
+			budget: 300,
+			build: func(s *Session) {
+				s.append(message(openai.ChatMessageRoleUser, long), message(openai.ChatMessageRoleAssistant, long))
+				s.append(message(openai.ChatMessageRoleUser, "查一下天气再开灯"))
+				s.append(toolRequest("weather"), message(openai.ChatMessageRoleTool, long))
+				s.append(toolRequest("light"), message(openai.ChatMessageRoleTool, long))
+				s.append(toolRequest("time"), message(openai.ChatMessageRoleTool, long))
+			},
+			want: []string{"system", "user", "assistant", "tool", "assistant", "tool", "assistant", "tool"},
+		},
+		{
+			name:   "never drops the last block",
+			budget: 50,
+			build: func(s *Session) {
+				s.append(message(openai.ChatMessageRoleUser, long))
+			},
+			want: []string{"system", "user"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession("test", "系统提示", 10)
+			tt.build(s)
+			cm := newContextManager(nil, "", tt.budget, false)
+			if err := cm.compact(context.Background(), s, nil); err != nil {
+				t.Fatalf("compact: %v", err)
+			}
+			var got []string
+			for _, m := range s.Conversation() {
+				got = append(got, m.Role)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("roles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package xiao_wan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// 回复不符合Dialogue格式时，要求模型修正的最多次数
+const maxDialogueRepairs = 2
+
+// dialogueRepairPrompt 回复不符合格式时发送给模型的修正要求
+const dialogueRepairPrompt = `你上一条回复不符合要求的JSON格式（%v）。请只输出一个JSON对象，格式为{"dialogue":[{"text":"你要说的话","emotion":"表情名称","action":"动作名称"}]}，dialogue至少包含一项且text不能为空，不要输出其他内容。`
+
+// ErrInvalidDialogue 表示模型的回复在修正后仍不符合Dialogue格式
+var ErrInvalidDialogue = errors.New("invalid dialogue response")
+
+// DialogueLine 小丸的一句话及其对应的表情和动作
+type DialogueLine struct {
+	Text    string `json:"text" description:"要说的话"`
+	Emotion string `json:"emotion" description:"说这句话时的表情名称"`
+	Action  string `json:"action" description:"说这句话时的动作名称"`
+}
+
+// Dialogue 小丸的结构化回复，与SystemPrompt中要求的JSON格式一致
+type Dialogue struct {
+	Dialogue []DialogueLine `json:"dialogue"`
+}
+
+// Text 返回所有台词拼接成的文本
+func (d *Dialogue) Text() string {
+	texts := make([]string, 0, len(d.Dialogue))
+	for _, line := range d.Dialogue {
+		texts = append(texts, line.Text)
+	}
+	return strings.Join(texts, "")
+}
+
+// WithDialogueSchema要求模型按Dialogue的JSON Schema回复
+// 回复不符合格式时会要求模型修正，Message等方法返回规范化后的JSON
+func WithDialogueSchema() StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		schema, err := jsonschema.GenerateSchemaForType(Dialogue{})
+		if err != nil {
+			fmt.Printf("Error generating dialogue schema: %v\n", err)
+			return
+		}
+		xiao_wan.dialogueSchema = schema
+	}
+}
+
+// StreamCorrectionHandler 接收修正后的完整台词
+// 调用方应丢弃已经从流式回调收到的文字，改用text，例如清除屏幕上的输出或停止朗读
+type StreamCorrectionHandler func(text string)
+
+// WithStreamCorrection设置流式输出的台词被修正时的回调，与WithDialogueSchema一起使用
+// 模型的回复不符合格式而被要求修正时，已经流式输出的文字可能与最终的台词不同：
+// 最终台词只是在已输出文字的后面追加内容时，追加的部分仍交给流式回调，否则调用handler
+func WithStreamCorrection(handler StreamCorrectionHandler) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.onCorrection = handler
+	}
+}
+
+// MessageDialogue函数处理用户消息，并返回解析后的结构化回复
+// 需要在启动时使用WithDialogueSchema
+func (xiao_wan *Xiao_wan) MessageDialogue(ctx context.Context, message string) (*Dialogue, error) {
+	if xiao_wan.dialogueSchema == nil {
+		return nil, fmt.Errorf("dialogue schema is not enabled, start with WithDialogueSchema")
+	}
+	response, err := xiao_wan.MessageContext(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	var dialogue Dialogue
+	if err := json.Unmarshal([]byte(response), &dialogue); err != nil {
+		return nil, err
+	}
+	return &dialogue, nil
+}
+
+// responseFormat函数返回请求使用的回复格式，未启用Dialogue格式时返回nil
+func (xiao_wan *Xiao_wan) responseFormat() *openai.ChatCompletionResponseFormat {
+	if xiao_wan.dialogueSchema == nil {
+		return nil
+	}
+	return &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+		JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:   "dialogue",
+			Schema: xiao_wan.dialogueSchema,
+			Strict: true,
+		},
+	}
+}
+
+// repairDialogue函数校验回复是否符合Dialogue格式，不符合时要求模型修正
+// 返回规范化后的JSON；调用方需持有s.turnMu，失败时由调用方回滚对话
+// 修正的回复不以流式请求，流式调用时由finishDialogueStream比较修正前后的台词
+func (xiao_wan *Xiao_wan) repairDialogue(ctx context.Context, s *Session, response string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		normalized, err := xiao_wan.parseDialogue(response)
+		if err == nil {
+			return normalized, nil
+		}
+		if attempt >= maxDialogueRepairs {
+			return "", fmt.Errorf("%w: %v", ErrInvalidDialogue, err)
+		}
+
+		fmt.Println("回复不符合Dialogue格式，要求模型修正:", err)
+		s.append(
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: response,
+			},
+			openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf(dialogueRepairPrompt, err),
+			},
+		)
+		response, err = xiao_wan.sendMessage(ctx, s)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// parseDialogue函数按Dialogue的JSON Schema校验回复，返回规范化后的JSON
+// 模型用代码块包裹JSON或在前后附带说明时，先提取其中的JSON对象
+func (xiao_wan *Xiao_wan) parseDialogue(response string) (string, error) {
+	content := extractJSONObject(response)
+
+	var dialogue Dialogue
+	if err := jsonschema.VerifySchemaAndUnmarshal(*xiao_wan.dialogueSchema, []byte(content), &dialogue); err != nil {
+		return "", err
+	}
+	if len(dialogue.Dialogue) == 0 {
+		return "", fmt.Errorf("dialogue is empty")
+	}
+	for i, line := range dialogue.Dialogue {
+		if strings.TrimSpace(line.Text) == "" {
+			return "", fmt.Errorf("dialogue[%d].text is empty", i)
+		}
+	}
+
+	normalized, err := json.Marshal(dialogue)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// finishDialogueStream函数在回复校验通过后，比较最终的台词和已经流式输出的文字
+// 两者一致时不做处理，已输出的文字是最终台词的前缀时补发剩余部分，否则调用修正回调
+func (xiao_wan *Xiao_wan) finishDialogueStream(text *dialogueTextStream, response string) {
+	var dialogue Dialogue
+	if err := json.Unmarshal([]byte(response), &dialogue); err != nil {
+		return
+	}
+	final, streamed := dialogue.Text(), text.text()
+	switch {
+	case final == streamed:
+	case strings.HasPrefix(final, streamed):
+		text.onDelta(final[len(streamed):])
+	default:
+		fmt.Println("流式输出的台词已被修正")
+		if xiao_wan.onCorrection != nil {
+			xiao_wan.onCorrection(final)
+		}
+	}
+}
+
+// dialogueTextStream 从流式返回的Dialogue JSON中逐段取出台词的文字
+// 只解析到足以找到dialogue数组中各项text字段的程度，完整的校验由parseDialogue完成
+type dialogueTextStream struct {
+	onDelta  StreamHandler
+	streamed strings.Builder // 已经交给onDelta的文字
+
+	stack     []byte          // 未闭合的'{'和'['
+	expectKey bool            // 对象中下一个字符串是键
+	inString  bool            // 正在读取字符串
+	isKey     bool            // 当前字符串是键
+	emitting  bool            // 当前字符串是台词的text，内容直接输出
+	escape    bool            // 读到了字符串中的反斜杠
+	key       strings.Builder // 最近读到的键
+	hex       []byte          // \u转义中已读到的十六进制数字，不在\u转义中时为nil
+	surrogate rune            // UTF-16代理对的前半部分
+	done      bool            // 根对象已经结束
+}
+
+// newDialogueTextStream 创建dialogueTextStream，台词的文字交给onDelta
+func newDialogueTextStream(onDelta StreamHandler) *dialogueTextStream {
+	return &dialogueTextStream{onDelta: onDelta}
+}
+
+// text 返回已经输出的全部文字
+func (d *dialogueTextStream) text() string {
+	return d.streamed.String()
+}
+
+// write 处理模型输出的一个片段，把其中属于台词的文字交给onDelta
+// 根对象之前的内容（例如代码块标记）和之后的内容都被忽略
+func (d *dialogueTextStream) write(delta string) {
+	var out strings.Builder
+	for i := 0; i < len(delta) && !d.done; i++ {
+		c := delta[i]
+		if d.inString {
+			d.readString(c, &out)
+			continue
+		}
+		if len(d.stack) == 0 && c != '{' {
+			continue
+		}
+		switch c {
+		case '{':
+			d.stack = append(d.stack, c)
+			d.expectKey = true
+		case '[':
+			d.stack = append(d.stack, c)
+		case '}', ']':
+			d.stack = d.stack[:len(d.stack)-1]
+			d.done = len(d.stack) == 0
+		case ',':
+			d.expectKey = d.stack[len(d.stack)-1] == '{'
+		case ':':
+			d.expectKey = false
+		case '"':
+			d.inString = true
+			d.isKey = d.expectKey && d.stack[len(d.stack)-1] == '{'
+			// 台词位于{"dialogue":[{"text":"..."}]}中第三层的对象里
+			d.emitting = !d.isKey && string(d.stack) == "{[{" && d.key.String() == "text"
+			if d.isKey {
+				d.key.Reset()
+			}
+		}
+	}
+	if out.Len() > 0 {
+		d.streamed.WriteString(out.String())
+		d.onDelta(out.String())
+	}
+}
+
+// readString 处理字符串中的一个字节，台词的内容解码转义后写入out
+func (d *dialogueTextStream) readString(c byte, out *strings.Builder) {
+	switch {
+	case d.hex != nil:
+		d.hex = append(d.hex, c)
+		if len(d.hex) == 4 {
+			n, _ := strconv.ParseUint(string(d.hex), 16, 16)
+			d.hex = nil
+			d.writeRune(rune(n), out)
+		}
+		return
+	case d.escape:
+		d.escape = false
+		if c == 'u' {
+			d.hex = make([]byte, 0, 4)
+			return
+		}
+		if unescaped, ok := jsonEscapes[c]; ok {
+			c = unescaped
+		}
+	case c == '\\':
+		d.escape = true
+		return
+	case c == '"':
+		d.inString = false
+		return
+	}
+	if d.isKey {
+		d.key.WriteByte(c)
+	} else if d.emitting {
+		out.WriteByte(c)
+	}
+}
+
+// writeRune 写入\u转义得到的字符，UTF-16代理对的两半合并为一个字符
+func (d *dialogueTextStream) writeRune(r rune, out *strings.Builder) {
+	if utf16.IsSurrogate(r) && d.surrogate == 0 {
+		d.surrogate = r
+		return
+	}
+	if d.surrogate != 0 {
+		r = utf16.DecodeRune(d.surrogate, r)
+		d.surrogate = 0
+	}
+	if d.isKey {
+		d.key.WriteRune(r)
+	} else if d.emitting {
+		out.WriteRune(r)
+	}
+}
+
+// jsonEscapes JSON字符串中单字符转义对应的字符
+var jsonEscapes = map[byte]byte{'"': '"', '\\': '\\', '/': '/', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t'}
+
+// extractJSONObject 返回文本中第一个'{'到最后一个'}'之间的内容，找不到时原样返回
+func extractJSONObject(text string) string {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return text
+	}
+	return text[start : end+1]
+}
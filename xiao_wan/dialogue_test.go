@@ -0,0 +1,166 @@
+package xiao_wan
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+)
+
+func TestDialogueTextStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{
+			name:   "one line",
+			chunks: []string{`{"dialogue":[{"text":"你好","emotion":"Happy","action":""}]}`},
+			want:   "你好",
+		},
+		{
+			name:   "several lines",
+			chunks: []string{`{"dialogue":[{"emotion":"Happy","text":"早上好，"},`, `{"text":"今天`, `去哪？","action":"wave"}]}`},
+			want:   "早上好，今天去哪？",
+		},
+		{
+			name:   "escapes split across chunks",
+			chunks: []string{`{"dialogue":[{"text":"a\`, `"b\u4f6`, `0\n\ud83d`, `\ude00\\"}]}`},
+			want:   "a\"b你\n😀\\",
+		},
+		{
+			name:   "code block and text outside the dialogue",
+			chunks: []string{"```json\n{\"text\":\"不是台词\",", `"dialogue":[{"text":"是台词","emotion":"text"}]}`, "\n```\n{\"dialogue\":[{\"text\":\"多余\"}]}"},
+			want:   "是台词",
+		},
+		{
+			name:   "not json",
+			chunks: []string{"我今天很开心"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 按原样的片段和逐字节的片段各处理一次，结果应当相同
+			whole := strings.Join(tt.chunks, "")
+			bytes := make([]string, len(whole))
+			for i := 0; i < len(whole); i++ {
+				bytes[i] = whole[i : i+1]
+			}
+			for _, chunks := range [][]string{tt.chunks, bytes} {
+				var got strings.Builder
+				d := newDialogueTextStream(func(delta string) { got.WriteString(delta) })
+				for _, chunk := range chunks {
+					d.write(chunk)
+				}
+				if got.String() != tt.want || d.text() != tt.want {
+					t.Errorf("streamed %q (text() = %q), want %q", got.String(), d.text(), tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageStreamDialogue(t *testing.T) {
+	const (
+		hello   = `{"dialogue":[{"text":"你好","emotion":"Happy","action":""}]}`
+		invalid = `{"dialogue":[{"text":"你好","emotion":"Happy"}]}` // 缺少action
+	)
+
+	tests := []struct {
+		name        string
+		replies     []string
+		want        string // 返回的规范化JSON，为空表示本轮失败
+		wantDeltas  string // 流式回调收到的全部文字
+		correction  string // 修正回调收到的台词
+		wantRequest int
+	}{
+		{
+			name:        "valid reply is streamed",
+			replies:     []string{hello},
+			want:        hello,
+			wantDeltas:  "你好",
+			wantRequest: 1,
+		},
+		{
+			name:        "repair changes the text",
+			replies:     []string{invalid, `{"dialogue":[{"text":"您好","emotion":"Happy","action":"wave"}]}`},
+			want:        `{"dialogue":[{"text":"您好","emotion":"Happy","action":"wave"}]}`,
+			wantDeltas:  "你好",
+			correction:  "您好",
+			wantRequest: 2,
+		},
+		{
+			name:        "repair appends text",
+			replies:     []string{invalid, `{"dialogue":[{"text":"你好","emotion":"Happy","action":""},{"text":"再见","emotion":"Sad","action":""}]}`},
+			want:        `{"dialogue":[{"text":"你好","emotion":"Happy","action":""},{"text":"再见","emotion":"Sad","action":""}]}`,
+			wantDeltas:  "你好再见",
+			wantRequest: 2,
+		},
+		{
+			name:        "text around the json",
+			replies:     []string{"好的：" + hello},
+			want:        hello,
+			wantDeltas:  "你好",
+			wantRequest: 1,
+		},
+		{
+			name:        "repair fails",
+			replies:     []string{invalid},
+			wantDeltas:  "你好",
+			wantRequest: maxDialogueRepairs + 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies := make([]openai.ChatCompletionMessage, len(tt.replies))
+			for i, reply := range tt.replies {
+				replies[i] = assistant(reply)
+			}
+			fake, client := newFakeOpenAI(t, replies...)
+			var corrections []string
+			x := StartOne(config.New(), client, "", "", WithDialogueSchema(), WithStreamCorrection(func(text string) {
+				corrections = append(corrections, text)
+			}))
+			before := len(x.Session().Conversation())
+
+			var deltas strings.Builder
+			got, err := x.MessageOneStream(context.Background(), "你好", func(delta string) { deltas.WriteString(delta) })
+			if tt.want == "" {
+				if !errors.Is(err, ErrInvalidDialogue) {
+					t.Errorf("err = %v, want ErrInvalidDialogue", err)
+				}
+				if n := len(x.Session().Conversation()); n != before {
+					t.Errorf("conversation has %d messages, want it rolled back to %d", n, before)
+				}
+			} else if err != nil || got != tt.want {
+				t.Errorf("MessageOneStream = %q, %v, want %q", got, err, tt.want)
+			}
+
+			if deltas.String() != tt.wantDeltas {
+				t.Errorf("deltas = %q, want %q", deltas.String(), tt.wantDeltas)
+			}
+			if got := strings.Join(corrections, "|"); got != tt.correction {
+				t.Errorf("corrections = %q, want %q", corrections, tt.correction)
+			}
+
+			// 只有第一次请求是流式的，修正请求中带有格式错误的说明
+			requests := fake.Requests()
+			if len(requests) != tt.wantRequest {
+				t.Fatalf("got %d requests, want %d", len(requests), tt.wantRequest)
+			}
+			for i, req := range requests {
+				if req.Stream != (i == 0) {
+					t.Errorf("request %d stream = %v", i, req.Stream)
+				}
+				if last := req.Messages[len(req.Messages)-1].Content; i > 0 && !strings.Contains(last, "不符合要求的JSON格式") {
+					t.Errorf("request %d ends with %q, want the repair prompt", i, last)
+				}
+			}
+		})
+	}
+}
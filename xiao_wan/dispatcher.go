@@ -0,0 +1,244 @@
+package xiao_wan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
+)
+
+// BodyStep 执行表情或动作时的一次插件调用
+type BodyStep struct {
+	Plugin  string          `json:"plugin"`             // 插件ID，例如face、legs
+	Input   json.RawMessage `json:"input"`              // 插件参数
+	DelayMs int             `json:"delay_ms,omitempty"` // 执行前等待的毫秒数，用于编排连续动作
+}
+
+// DispatchTable 表情和动作到插件调用的映射表
+type DispatchTable struct {
+	Emotions       map[string][]BodyStep `json:"emotions"`
+	Actions        map[string][]BodyStep `json:"actions"`
+	DefaultEmotion string                `json:"default_emotion,omitempty"` // 表中没有的表情使用该表情
+}
+
+// LoadDispatchTable 从JSON文件读取映射表
+func LoadDispatchTable(path string) (DispatchTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DispatchTable{}, err
+	}
+	var table DispatchTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return DispatchTable{}, fmt.Errorf("解析映射表%s失败: %v", path, err)
+	}
+	return table, nil
+}
+
+// DefaultDispatchTable 返回内置的映射表，表情对应face插件，动作对应legs插件
+// legs插件的角度含义：0度四肢向前抬起，90度站立，180度四肢向后抬起
+func DefaultDispatchTable() DispatchTable {
+	face := func(emotion string) []BodyStep {
+		return []BodyStep{{Plugin: "face", Input: json.RawMessage(fmt.Sprintf(`{"emotion":%q}`, emotion))}}
+	}
+	legs := func(delayMs int, angles ...int) []BodyStep {
+		steps := make([]BodyStep, 0, len(angles))
+		for motor, angle := range angles {
+			step := BodyStep{Plugin: "legs", Input: json.RawMessage(fmt.Sprintf(`{"motor_id":%d,"angle":%d}`, motor, angle))}
+			if motor == 0 {
+				step.DelayMs = delayMs
+			}
+			steps = append(steps, step)
+		}
+		return steps
+	}
+	sequence := func(parts ...[]BodyStep) []BodyStep {
+		var steps []BodyStep
+		for _, part := range parts {
+			steps = append(steps, part...)
+		}
+		return steps
+	}
+
+	return DispatchTable{
+		Emotions: map[string][]BodyStep{
+			"平静": face("Normal"),
+			"开心": face("Happy"),
+			"高兴": face("Happy"),
+			"得意": face("Glee"),
+			"调皮": face("Glee"),
+			"生气": face("Angry"),
+			"愤怒": face("Furious"),
+			"难过": face("Sad"),
+			"伤心": face("Sad"),
+			"担心": face("Worried"),
+			"专注": face("Focused"),
+			"烦躁": face("Annoyed"),
+			"惊讶": face("Surprised"),
+			"怀疑": face("Skeptic"),
+			"沮丧": face("Frustrated"),
+			"无语": face("Unimpressed"),
+			"困":  face("Sleepy"),
+			"害怕": face("Scared"),
+			"敬畏": face("Awe"),
+		},
+		Actions: map[string][]BodyStep{
+			"站立":  legs(0, 90, 90, 90, 90),
+			"坐下":  legs(0, 90, 90, 0, 0),
+			"趴下":  legs(0, 0, 0, 180, 180),
+			"鞠躬":  legs(0, 150, 150, 90, 90),
+			"伸懒腰": sequence(legs(0, 0, 0, 90, 90), legs(1000, 90, 90, 90, 90)),
+			"挥手":  sequence(legs(0, 0), legs(400, 90), legs(400, 0), legs(400, 90)),
+			"跳舞":  sequence(legs(0, 60, 120, 120, 60), legs(400, 120, 60, 60, 120), legs(400, 60, 120, 120, 60), legs(400, 90, 90, 90, 90)),
+		},
+		DefaultEmotion: "平静",
+	}
+}
+
+// Dispatcher 根据结构化回复中的emotion和action直接调用face、legs等插件
+// 表情和动作通过映射表确定，表中没有的动作才交给LLM助手处理
+type Dispatcher struct {
+	plugins  *plugins.PluginManager
+	table    DispatchTable
+	fallback *Xiao_wan // 处理未知动作的LLM助手，为nil时忽略未知动作
+}
+
+// NewDispatcher 创建Dispatcher，并加载指定目录中的插件
+func NewDispatcher(cfg config.Cfg, openaiClient *openai.Client, table DispatchTable, compiledDirs ...string) *Dispatcher {
+	pm := plugins.NewPluginManager(cfg, openaiClient)
+	for _, dir := range compiledDirs {
+		if err := pm.LoadPlugins(dir); err != nil {
+			fmt.Printf("Error loading plugins from %s: %v\n", dir, err)
+		}
+		if err := pm.LoadRegistered(cfg.AgentPlugins(dir)...); err != nil {
+			fmt.Printf("Error loading registered plugins for %s: %v\n", dir, err)
+		}
+	}
+	return &Dispatcher{plugins: pm, table: table}
+}
+
+// Plugins 返回调度器使用的插件管理器
+func (d *Dispatcher) Plugins() *plugins.PluginManager {
+	return d.plugins
+}
+
+// Close 按加载的相反顺序关闭调度器加载的插件
+func (d *Dispatcher) Close() error {
+	return d.plugins.Close()
+}
+
+// SetFallback 设置处理未知动作的LLM助手
+// 助手应使用WithPluginManager(d.Plugins())创建，避免同一插件被重复初始化
+func (d *Dispatcher) SetFallback(fallback *Xiao_wan) {
+	d.fallback = fallback
+}
+
+// Dispatch 依次执行每句台词的表情和动作，同一句的表情和动作同时执行
+func (d *Dispatcher) Dispatch(ctx context.Context, dialogue *Dialogue) error {
+	var errs []error
+	for _, line := range dialogue.Dialogue {
+		if err := d.DispatchLine(ctx, line); err != nil {
+			errs = append(errs, err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DispatchLine 执行一句台词的表情和动作
+func (d *Dispatcher) DispatchLine(ctx context.Context, line DialogueLine) error {
+	var wg sync.WaitGroup
+	var emotionErr, actionErr error
+
+	if steps, ok := d.emotionSteps(line.Emotion); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emotionErr = d.runSteps(ctx, steps)
+		}()
+	}
+
+	if action := strings.TrimSpace(line.Action); action != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if steps, ok := lookupSteps(d.table.Actions, action); ok {
+				actionErr = d.runSteps(ctx, steps)
+				return
+			}
+			if d.fallback == nil {
+				fmt.Printf("未知动作%s，已忽略\n", action)
+				return
+			}
+			// 表中没有的动作交给LLM助手
+			fmt.Printf("未知动作%s，交给动作管理助手处理\n", action)
+			_, actionErr = d.fallback.MessageOneContext(ctx, "action:"+action)
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(emotionErr, actionErr)
+}
+
+// emotionSteps 返回表情对应的插件调用，表中没有时使用默认表情
+func (d *Dispatcher) emotionSteps(emotion string) ([]BodyStep, bool) {
+	emotion = strings.TrimSpace(emotion)
+	if emotion == "" {
+		return nil, false
+	}
+	if steps, ok := lookupSteps(d.table.Emotions, emotion); ok {
+		return steps, true
+	}
+	if d.table.DefaultEmotion == "" {
+		return nil, false
+	}
+	return lookupSteps(d.table.Emotions, d.table.DefaultEmotion)
+}
+
+// runSteps 按顺序执行插件调用
+func (d *Dispatcher) runSteps(ctx context.Context, steps []BodyStep) error {
+	for _, step := range steps {
+		if step.DelayMs > 0 {
+			select {
+			case <-time.After(time.Duration(step.DelayMs) * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		jsonResponse, err := d.plugins.CallPluginContext(ctx, step.Plugin, string(step.Input))
+		if err != nil {
+			return err
+		}
+		var response plugins.PluginResponse
+		if err := json.Unmarshal([]byte(jsonResponse), &response); err != nil {
+			return err
+		}
+		if response.Error != "" {
+			return fmt.Errorf("plugin %s: %s", step.Plugin, response.Error)
+		}
+	}
+	return nil
+}
+
+// lookupSteps 在映射表中查找名称，精确匹配失败时忽略大小写再查找一次
+func lookupSteps(table map[string][]BodyStep, name string) ([]BodyStep, bool) {
+	if steps, ok := table[name]; ok {
+		return steps, true
+	}
+	for key, steps := range table {
+		if strings.EqualFold(key, name) {
+			return steps, true
+		}
+	}
+	return nil, false
+}
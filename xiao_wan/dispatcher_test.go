@@ -0,0 +1,136 @@
+package xiao_wan
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
+)
+
+// testDispatchTable 测试用的映射表
+func testDispatchTable() DispatchTable {
+	step := func(plugin, input string) BodyStep {
+		return BodyStep{Plugin: plugin, Input: json.RawMessage(input)}
+	}
+	return DispatchTable{
+		Emotions: map[string][]BodyStep{
+			"Happy":  {step("face", `{"emotion":"Happy"}`)},
+			"Normal": {step("face", `{"emotion":"Normal"}`)},
+		},
+		Actions: map[string][]BodyStep{
+			"wave": {step("legs", `{"motor_id":0,"angle":0}`), step("legs", `{"motor_id":0,"angle":90}`)},
+		},
+		DefaultEmotion: "Normal",
+	}
+}
+
+func TestEmotionSteps(t *testing.T) {
+	withoutDefault := testDispatchTable()
+	withoutDefault.DefaultEmotion = ""
+
+	tests := []struct {
+		name    string
+		table   DispatchTable
+		emotion string
+		want    string // 第一步的参数，为空表示没有表情
+	}{
+		{name: "exact", table: testDispatchTable(), emotion: "Happy", want: `{"emotion":"Happy"}`},
+		{name: "ignores case and spaces", table: testDispatchTable(), emotion: " happy ", want: `{"emotion":"Happy"}`},
+		{name: "unknown uses default", table: testDispatchTable(), emotion: "Bored", want: `{"emotion":"Normal"}`},
+		{name: "unknown without default", table: withoutDefault, emotion: "Bored"},
+		{name: "empty", table: testDispatchTable(), emotion: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dispatcher{table: tt.table}
+			steps, ok := d.emotionSteps(tt.emotion)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("steps = %+v, want none", steps)
+				}
+				return
+			}
+			if !ok || len(steps) == 0 || string(steps[0].Input) != tt.want {
+				t.Fatalf("steps = %+v, want first input %s", steps, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultDispatchTable(t *testing.T) {
+	table := DefaultDispatchTable()
+	if _, ok := table.Emotions[table.DefaultEmotion]; !ok {
+		t.Errorf("default emotion %q is not in the table", table.DefaultEmotion)
+	}
+	for name, steps := range table.Actions {
+		for _, step := range steps {
+			if step.Plugin != "legs" || !json.Valid(step.Input) {
+				t.Errorf("action %s has invalid step %+v", name, step)
+			}
+		}
+	}
+	for name, steps := range table.Emotions {
+		for _, step := range steps {
+			if step.Plugin != "face" || !json.Valid(step.Input) {
+				t.Errorf("emotion %s has invalid step %+v", name, step)
+			}
+		}
+	}
+}
+
+func TestDispatchLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         DialogueLine
+		fallback     bool
+		errPlugins   []string // 表中的调用都交给插件，插件未加载时错误中带有插件ID
+		fallbackCall string   // 交给动作管理助手的消息
+	}{
+		{name: "emotion goes to face", line: DialogueLine{Emotion: "Happy"}, errPlugins: []string{"face"}},
+		{name: "action goes to legs", line: DialogueLine{Action: "wave"}, errPlugins: []string{"legs"}},
+		{name: "emotion and action", line: DialogueLine{Emotion: "Happy", Action: "WAVE"}, errPlugins: []string{"face", "legs"}},
+		{name: "unknown action without fallback is ignored", line: DialogueLine{Action: "jump"}},
+		{name: "unknown action goes to fallback", line: DialogueLine{Action: "jump"}, fallback: true, fallbackCall: "action:jump"},
+		{name: "nothing to do", line: DialogueLine{Text: "你好"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := plugins.NewPluginManager(config.New(), nil)
+			d := &Dispatcher{plugins: pm, table: testDispatchTable()}
+			var fake *fakeOpenAI
+			if tt.fallback {
+				var client *openai.Client
+				fake, client = newFakeOpenAI(t, assistant("好的"))
+				d.SetFallback(StartOne(config.New(), client, LegsPrompt, "", WithPluginManager(pm)))
+			}
+
+			err := d.DispatchLine(context.Background(), tt.line)
+			if len(tt.errPlugins) == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, id := range tt.errPlugins {
+				if err == nil || !strings.Contains(err.Error(), "plugin "+id) {
+					t.Errorf("err = %v, want a call to plugin %s", err, id)
+				}
+			}
+
+			if !tt.fallback {
+				return
+			}
+			var got []string
+			for _, req := range fake.Requests() {
+				got = append(got, req.Messages[len(req.Messages)-1].Content)
+			}
+			if !reflect.DeepEqual(got, []string{tt.fallbackCall}) {
+				t.Errorf("fallback messages = %v, want [%s]", got, tt.fallbackCall)
+			}
+		})
+	}
+}
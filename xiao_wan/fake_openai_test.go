@@ -0,0 +1,110 @@
+package xiao_wan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeOpenAI 模拟chat completions接口，按顺序返回预设的回复，并记录收到的请求
+type fakeOpenAI struct {
+	mu       sync.Mutex
+	replies  []openai.ChatCompletionMessage
+	requests []openai.ChatCompletionRequest
+}
+
+// newFakeOpenAI 启动模拟服务并返回指向它的客户端，回复用完后重复最后一条，流式请求以SSE返回
+func newFakeOpenAI(t *testing.T, replies ...openai.ChatCompletionMessage) (*fakeOpenAI, *openai.Client) {
+	fake := &fakeOpenAI{replies: replies}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	config := openai.DefaultConfig("test")
+	config.BaseURL = server.URL + "/v1"
+	return fake, openai.NewClientWithConfig(config)
+}
+
+func (f *fakeOpenAI) serve(w http.ResponseWriter, r *http.Request) {
+	// response_format中的schema是接口类型，无法直接解码，单独保留原始JSON
+	var body struct {
+		openai.ChatCompletionRequest
+		ResponseFormat json.RawMessage `json:"response_format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := body.ChatCompletionRequest
+
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	reply := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	if len(f.replies) > 0 {
+		reply = f.replies[0]
+		if len(f.replies) > 1 {
+			f.replies = f.replies[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	finish := openai.FinishReasonStop
+	if len(reply.ToolCalls) > 0 {
+		finish = openai.FinishReasonToolCalls
+	}
+	if req.Stream {
+		f.stream(w, reply, finish)
+		return
+	}
+	json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+		Object:  "chat.completion",
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{Message: reply, FinishReason: finish}},
+	})
+}
+
+// stream 以SSE返回回复，文本每次发送几个字符，工具调用在一个片段中发送
+func (f *fakeOpenAI) stream(w http.ResponseWriter, reply openai.ChatCompletionMessage, finish openai.FinishReason) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	send := func(delta openai.ChatCompletionStreamChoiceDelta, finish openai.FinishReason) {
+		b, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+			Object:  "chat.completion.chunk",
+			Choices: []openai.ChatCompletionStreamChoice{{Delta: delta, FinishReason: finish}},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", b)
+	}
+
+	content := []rune(reply.Content)
+	for len(content) > 0 {
+		n := min(len(content), 3)
+		send(openai.ChatCompletionStreamChoiceDelta{Content: string(content[:n])}, "")
+		content = content[n:]
+	}
+	if len(reply.ToolCalls) > 0 {
+		calls := make([]openai.ToolCall, len(reply.ToolCalls))
+		for i, call := range reply.ToolCalls {
+			index := i
+			call.Index = &index
+			calls[i] = call
+		}
+		send(openai.ChatCompletionStreamChoiceDelta{ToolCalls: calls}, "")
+	}
+	send(openai.ChatCompletionStreamChoiceDelta{}, finish)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// Requests 返回收到的全部请求
+func (f *fakeOpenAI) Requests() []openai.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]openai.ChatCompletionRequest(nil), f.requests...)
+}
+
+// assistant 返回一条助手回复
+func assistant(content string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}
+}
@@ -0,0 +1,159 @@
+package xiao_wan
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// 短期记忆条数的默认上限，配置中未设置（<=0）时使用
+const defaultShortTermMemorySize = 20
+
+// MemoryEntry 短期记忆中的一条记录
+type MemoryEntry struct {
+	Role    string `json:"role"`
+	Message string `json:"message"`
+}
+
+// Session 表示一段独立的对话，包括发送给模型的完整对话历史和有限长度的短期记忆
+// Session的方法可以被多个goroutine同时调用，同一会话上的对话轮次会被串行化
+type Session struct {
+	id        string
+	createdAt time.Time
+
+	// turnMu 在一整轮对话期间持有，保证同一会话的对话轮次依次进行
+	turnMu sync.Mutex
+	// mu 保护下面的字段
+	mu              sync.Mutex
+	conversation    []openai.ChatCompletionMessage
+	shortTermMemory []MemoryEntry
+	maxShortTerm    int
+}
+
+// newSession 创建一个只包含系统提示的会话
+func newSession(id string, systemPrompt string, maxShortTerm int) *Session {
+	if maxShortTerm <= 0 {
+		maxShortTerm = defaultShortTermMemorySize
+	}
+	s := &Session{
+		id:           id,
+		createdAt:    time.Now(),
+		maxShortTerm: maxShortTerm,
+	}
+	s.conversation = initialConversation(systemPrompt)
+	return s
+}
+
+// initialConversation 返回只包含系统提示的对话
+func initialConversation(systemPrompt string) []openai.ChatCompletionMessage {
+	return []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: systemPrompt,
+			Name:    "",
+		},
+	}
+}
+
+// newSessionID 生成随机的会话ID
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ID 返回会话ID
+func (s *Session) ID() string {
+	return s.id
+}
+
+// CreatedAt 返回会话的创建时间
+func (s *Session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+// Conversation 返回对话历史的副本
+func (s *Session) Conversation() []openai.ChatCompletionMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.ChatCompletionMessage(nil), s.conversation...)
+}
+
+// ShortTermMemory 返回短期记忆的副本
+func (s *Session) ShortTermMemory() []MemoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MemoryEntry(nil), s.shortTermMemory...)
+}
+
+// Remember 向短期记忆追加一条记录，超过上限时丢弃最早的记录
+func (s *Session) Remember(role string, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shortTermMemory = append(s.shortTermMemory, MemoryEntry{Role: role, Message: message})
+	if over := len(s.shortTermMemory) - s.maxShortTerm; over > 0 {
+		s.shortTermMemory = append([]MemoryEntry(nil), s.shortTermMemory[over:]...)
+	}
+}
+
+// shortTermMemoryJSON 返回短期记忆的JSON编码
+func (s *Session) shortTermMemoryJSON() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logJSON, err := json.Marshal(s.shortTermMemory)
+	if err != nil {
+		return "", err
+	}
+	return string(logJSON), nil
+}
+
+// append 向对话历史追加消息
+func (s *Session) append(messages ...openai.ChatCompletionMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversation = append(s.conversation, messages...)
+}
+
+// replace 替换整个对话历史，用于上下文压缩和回滚失败的对话轮次
+func (s *Session) replace(conversation []openai.ChatCompletionMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversation = conversation
+}
+
+// replaceMemory 用entries替换短期记忆，用于本轮对话失败时撤销记录
+func (s *Session) replaceMemory(entries []MemoryEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shortTermMemory = entries
+}
+
+// reset 清空对话历史和短期记忆，只保留系统提示
+func (s *Session) reset(systemPrompt string) {
+	s.turnMu.Lock()
+	defer s.turnMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversation = initialConversation(systemPrompt)
+	s.shortTermMemory = nil
+}
+
+// fork 复制当前会话的对话历史和短期记忆，生成一个新ID的会话
+func (s *Session) fork(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &Session{
+		id:              id,
+		createdAt:       time.Now(),
+		conversation:    append([]openai.ChatCompletionMessage(nil), s.conversation...),
+		shortTermMemory: append([]MemoryEntry(nil), s.shortTermMemory...),
+		maxShortTerm:    s.maxShortTerm,
+	}
+}
@@ -0,0 +1,371 @@
+package xiao_wan
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ErrSessionNotFound 表示存储中不存在指定的会话
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionSnapshot 会话的可持久化状态，包括工具调用消息
+type SessionSnapshot struct {
+	ID              string
+	CreatedAt       time.Time
+	Conversation    []openai.ChatCompletionMessage
+	ShortTermMemory []MemoryEntry
+}
+
+// ConversationStore 定义会话的持久化存储
+type ConversationStore interface {
+	SaveSession(snapshot SessionSnapshot) error
+	LoadSession(id string) (SessionSnapshot, error)
+	ListSessions() ([]string, error)
+	DeleteSession(id string) error
+}
+
+// snapshot 返回会话当前状态的快照
+func (s *Session) snapshot() SessionSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SessionSnapshot{
+		ID:              s.id,
+		CreatedAt:       s.createdAt,
+		Conversation:    append([]openai.ChatCompletionMessage(nil), s.conversation...),
+		ShortTermMemory: append([]MemoryEntry(nil), s.shortTermMemory...),
+	}
+}
+
+// sessionFromSnapshot 从快照恢复会话，系统提示替换为当前使用的系统提示
+func sessionFromSnapshot(snapshot SessionSnapshot, systemPrompt string, maxShortTerm int) *Session {
+	s := newSession(snapshot.ID, systemPrompt, maxShortTerm)
+	if !snapshot.CreatedAt.IsZero() {
+		s.createdAt = snapshot.CreatedAt
+	}
+	conversation := snapshot.Conversation
+	if len(conversation) > 0 && conversation[0].Role == openai.ChatMessageRoleSystem && !isSummary(conversation[0]) {
+		conversation = conversation[1:]
+	}
+	s.conversation = append(s.conversation, conversation...)
+	s.shortTermMemory = snapshot.ShortTermMemory
+	if over := len(s.shortTermMemory) - s.maxShortTerm; over > 0 {
+		s.shortTermMemory = s.shortTermMemory[over:]
+	}
+	return s
+}
+
+// jsonlRecord JSON-lines文件中的一行
+type jsonlRecord struct {
+	Type      string                        `json:"type"` // "session", "message" 或 "memory"
+	ID        string                        `json:"id,omitempty"`
+	CreatedAt time.Time                     `json:"created_at,omitempty"`
+	Message   *openai.ChatCompletionMessage `json:"message,omitempty"`
+	Memory    *MemoryEntry                  `json:"memory,omitempty"`
+}
+
+// JSONLStore 将每个会话保存为目录下的一个JSON-lines文件
+// 文件第一行是会话信息，之后每行是一条消息或一条短期记忆
+type JSONLStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewJSONLStore 创建JSONLStore，目录不存在时自动创建
+func NewJSONLStore(dir string) (*JSONLStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JSONLStore{dir: dir}, nil
+}
+
+// path 返回会话文件的路径
+func (j *JSONLStore) path(id string) string {
+	return filepath.Join(j.dir, id+".jsonl")
+}
+
+// SaveSession 保存会话，先写入临时文件再重命名，避免写入中途崩溃损坏原文件
+func (j *JSONLStore) SaveSession(snapshot SessionSnapshot) error {
+	if err := validateSessionID(snapshot.ID); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	tmp, err := os.CreateTemp(j.dir, snapshot.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := []jsonlRecord{{Type: "session", ID: snapshot.ID, CreatedAt: snapshot.CreatedAt}}
+	for i := range snapshot.Conversation {
+		records = append(records, jsonlRecord{Type: "message", Message: &snapshot.Conversation[i]})
+	}
+	for i := range snapshot.ShortTermMemory {
+		records = append(records, jsonlRecord{Type: "memory", Memory: &snapshot.ShortTermMemory[i]})
+	}
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path(snapshot.ID))
+}
+
+// LoadSession 读取会话
+func (j *JSONLStore) LoadSession(id string) (SessionSnapshot, error) {
+	if err := validateSessionID(id); err != nil {
+		return SessionSnapshot{}, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path(id))
+	if os.IsNotExist(err) {
+		return SessionSnapshot{}, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	} else if err != nil {
+		return SessionSnapshot{}, err
+	}
+	defer file.Close()
+
+	snapshot := SessionSnapshot{ID: id}
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var record jsonlRecord
+		if err := dec.Decode(&record); err != nil {
+			return SessionSnapshot{}, fmt.Errorf("读取会话文件%s失败: %v", j.path(id), err)
+		}
+		switch record.Type {
+		case "session":
+			snapshot.CreatedAt = record.CreatedAt
+		case "message":
+			if record.Message != nil {
+				snapshot.Conversation = append(snapshot.Conversation, *record.Message)
+			}
+		case "memory":
+			if record.Memory != nil {
+				snapshot.ShortTermMemory = append(snapshot.ShortTermMemory, *record.Memory)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// ListSessions 返回所有已保存会话的ID
+func (j *JSONLStore) ListSessions() ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".jsonl" {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".jsonl"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// DeleteSession 删除会话文件
+func (j *JSONLStore) DeleteSession(id string) error {
+	if err := validateSessionID(id); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := os.Remove(j.path(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return err
+}
+
+// validateSessionID 检查会话ID能否安全地用作文件名
+func validateSessionID(id string) error {
+	if id == "" || id != filepath.Base(id) || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return fmt.Errorf("invalid session id %q", id)
+	}
+	return nil
+}
+
+// SQLStore 使用database/sql保存会话，表结构按SQLite编写
+// 调用方负责导入SQLite驱动（例如modernc.org/sqlite或github.com/mattn/go-sqlite3）并打开db
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore 创建SQLStore，并在表不存在时建表
+func NewSQLiteStore(db *sql.DB) (*SQLStore, error) {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS session_records (
+			session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+			seq INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			PRIMARY KEY (session_id, seq)
+		)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// SaveSession 在一个事务中替换会话的全部记录
+func (q *SQLStore) SaveSession(snapshot SessionSnapshot) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO sessions (id, created_at) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET created_at = excluded.created_at`,
+		snapshot.ID, snapshot.CreatedAt.Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM session_records WHERE session_id = ?`, snapshot.ID); err != nil {
+		return err
+	}
+
+	seq := 0
+	insert := func(recordType string, v interface{}) error {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO session_records (session_id, seq, type, payload) VALUES (?, ?, ?, ?)`,
+			snapshot.ID, seq, recordType, string(payload))
+		seq++
+		return err
+	}
+	for _, m := range snapshot.Conversation {
+		if err := insert("message", m); err != nil {
+			return err
+		}
+	}
+	for _, m := range snapshot.ShortTermMemory {
+		if err := insert("memory", m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadSession 读取会话
+func (q *SQLStore) LoadSession(id string) (SessionSnapshot, error) {
+	snapshot := SessionSnapshot{ID: id}
+
+	var createdAt string
+	err := q.db.QueryRow(`SELECT created_at FROM sessions WHERE id = ?`, id).Scan(&createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SessionSnapshot{}, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	} else if err != nil {
+		return SessionSnapshot{}, err
+	}
+	snapshot.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+
+	rows, err := q.db.Query(`SELECT type, payload FROM session_records WHERE session_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return SessionSnapshot{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recordType, payload string
+		if err := rows.Scan(&recordType, &payload); err != nil {
+			return SessionSnapshot{}, err
+		}
+		switch recordType {
+		case "message":
+			var m openai.ChatCompletionMessage
+			if err := json.Unmarshal([]byte(payload), &m); err != nil {
+				return SessionSnapshot{}, err
+			}
+			snapshot.Conversation = append(snapshot.Conversation, m)
+		case "memory":
+			var m MemoryEntry
+			if err := json.Unmarshal([]byte(payload), &m); err != nil {
+				return SessionSnapshot{}, err
+			}
+			snapshot.ShortTermMemory = append(snapshot.ShortTermMemory, m)
+		}
+	}
+	return snapshot, rows.Err()
+}
+
+// ListSessions 返回所有已保存会话的ID
+func (q *SQLStore) ListSessions() ([]string, error) {
+	rows, err := q.db.Query(`SELECT id FROM sessions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteSession 删除会话及其全部记录
+func (q *SQLStore) DeleteSession(id string) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM session_records WHERE session_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return tx.Commit()
+}
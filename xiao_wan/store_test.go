@@ -0,0 +1,139 @@
+package xiao_wan
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	_ "modernc.org/sqlite"
+)
+
+func TestJSONLStoreRoundTrip(t *testing.T) {
+	store, err := NewJSONLStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreRoundTrip(t, store)
+}
+
+func TestSQLStoreRoundTrip(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 表已存在时再次创建不报错
+	if _, err := NewSQLiteStore(db); err != nil {
+		t.Fatalf("create store twice: %v", err)
+	}
+	testStoreRoundTrip(t, store)
+
+	// 删除会话时一并删除它的记录
+	if err := store.DeleteSession("with_tools"); err != nil {
+		t.Fatal(err)
+	}
+	var records int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM session_records`).Scan(&records); err != nil || records != 0 {
+		t.Errorf("records left after deleting every session = %d, %v", records, err)
+	}
+}
+
+// testStoreRoundTrip 检查ConversationStore的保存、读取、列出、覆盖和删除
+func testStoreRoundTrip(t *testing.T, store ConversationStore) {
+	t.Helper()
+
+	snapshots := []SessionSnapshot{
+		{
+			ID:        "empty",
+			CreatedAt: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			ID:        "with_tools",
+			CreatedAt: time.Date(2024, 5, 2, 9, 30, 0, 0, time.UTC),
+			Conversation: []openai.ChatCompletionMessage{
+				message(openai.ChatMessageRoleSystem, "系统提示"),
+				message(openai.ChatMessageRoleUser, "北京天气怎么样？"),
+				{
+					Role:      openai.ChatMessageRoleAssistant,
+					ToolCalls: []openai.ToolCall{{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "weather", Arguments: `{"city":"北京"}`}}},
+				},
+				{Role: openai.ChatMessageRoleTool, Content: "晴，25度", ToolCallID: "call_1", Name: "weather"},
+				message(openai.ChatMessageRoleAssistant, "北京今天晴，25度。\n注意防晒"),
+			},
+			ShortTermMemory: []MemoryEntry{
+				{Role: "user", Message: "北京天气怎么样？"},
+				{Role: "assistant", Message: "北京今天晴，25度。"},
+			},
+		},
+	}
+
+	for _, want := range snapshots {
+		t.Run(want.ID, func(t *testing.T) {
+			if err := store.SaveSession(want); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			got, err := store.LoadSession(want.ID)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if !got.CreatedAt.Equal(want.CreatedAt) {
+				t.Errorf("created at = %v, want %v", got.CreatedAt, want.CreatedAt)
+			}
+			got.CreatedAt = want.CreatedAt
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("snapshot = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	ids, err := store.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"empty", "with_tools"}) {
+		t.Errorf("sessions = %v", ids)
+	}
+
+	// 再次保存会覆盖原来的内容
+	overwrite := SessionSnapshot{ID: "with_tools", ShortTermMemory: []MemoryEntry{{Role: "user", Message: "新的"}}}
+	if err := store.SaveSession(overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.LoadSession("with_tools"); err != nil || len(got.Conversation) != 0 || len(got.ShortTermMemory) != 1 {
+		t.Errorf("after overwrite: %+v, %v", got, err)
+	}
+
+	if err := store.DeleteSession("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LoadSession("empty"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("load deleted session: err = %v, want ErrSessionNotFound", err)
+	}
+	if err := store.DeleteSession("empty"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("delete twice: err = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestJSONLStoreRejectsUnsafeIDs(t *testing.T) {
+	store, err := NewJSONLStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", ".", "..", "../escape", "a/b", `a\b`} {
+		if err := store.SaveSession(SessionSnapshot{ID: id}); err == nil {
+			t.Errorf("SaveSession(%q) succeeded, want error", id)
+		}
+		if _, err := store.LoadSession(id); err == nil {
+			t.Errorf("LoadSession(%q) succeeded, want error", id)
+		}
+	}
+}
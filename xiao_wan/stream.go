@@ -0,0 +1,177 @@
+package xiao_wan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// StreamHandler 接收模型流式输出的文本片段
+// 回调在对话轮次内同步执行，不能在回调中向同一会话发送消息
+type StreamHandler func(delta string)
+
+// MessageStream函数与MessageContext相同，但以流式方式请求回复
+// 文本片段到达时立即交给onDelta，工具调用执行完毕后继续流式输出，返回值为完整回复
+// 启用WithDialogueSchema时onDelta只收到台词的文字，返回值仍是规范化后的JSON；
+// 回复经过修正后台词与已输出的文字不一致时，通过WithStreamCorrection设置的回调给出正确的台词
+func (xiao_wan *Xiao_wan) MessageStream(ctx context.Context, message string, onDelta StreamHandler) (string, error) {
+	if onDelta == nil {
+		onDelta = func(string) {}
+	}
+	return xiao_wan.messageWithMemory(ctx, xiao_wan.Session(), message, onDelta)
+}
+
+// MessageOneStream函数与MessageOneContext相同，但以流式方式请求回复
+func (xiao_wan *Xiao_wan) MessageOneStream(ctx context.Context, message string, onDelta StreamHandler) (string, error) {
+	if onDelta == nil {
+		onDelta = func(string) {}
+	}
+	s := xiao_wan.Session()
+	s.turnMu.Lock()
+	defer s.turnMu.Unlock()
+	defer xiao_wan.persist(s)
+
+	return xiao_wan.turn(ctx, s, message, onDelta)
+}
+
+// sendMessageStream函数流式请求回复，模型请求工具时执行工具后继续请求
+// 工具调用的轮数和重复次数与非流式请求一样受配置限制
+func (xiao_wan *Xiao_wan) sendMessageStream(ctx context.Context, s *Session, onDelta StreamHandler) (string, error) {
+	guard := newToolLoopGuard(xiao_wan.cfg.MaxToolRounds(), xiao_wan.cfg.MaxIdenticalToolCall())
+	for {
+		message, err := xiao_wan.streamRequestToOpenAI(ctx, s, onDelta)
+		if err != nil {
+			return "", err
+		}
+		if len(message.ToolCalls) == 0 {
+			return message.Content, nil
+		}
+
+		if err := guard.next(message.ToolCalls); err != nil {
+			fmt.Println("工具调用已终止:", err)
+			return "", err
+		}
+		if err := xiao_wan.runToolCalls(ctx, s, message); err != nil {
+			return "", err
+		}
+	}
+}
+
+// streamRequestToOpenAI函数发送一次流式请求，并把收到的片段拼接成完整的assistant消息
+func (xiao_wan *Xiao_wan) streamRequestToOpenAI(ctx context.Context, s *Session, onDelta StreamHandler) (openai.ChatCompletionMessage, error) {
+	// 超出上下文预算时先压缩较早的对话
+	tools := xiao_wan.toolList()
+	if err := xiao_wan.contextManager.compact(ctx, s, tools); err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+
+	stream, err := xiao_wan.Client.CreateChatCompletionStream(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model:          xiao_wan.model,
+			Messages:       s.Conversation(),
+			Tools:          tools,
+			ResponseFormat: xiao_wan.responseFormat(),
+			Stream:         true,
+		},
+	)
+	if err != nil {
+		xiao_wan.openaiError(err) // 处理OpenAI错误
+		return openai.ChatCompletionMessage{}, err
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	toolCalls := newToolCallAccumulator()
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+		if len(response.Choices) == 0 {
+			continue
+		}
+
+		delta := response.Choices[0].Delta
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			onDelta(delta.Content)
+		}
+		for _, fragment := range delta.ToolCalls {
+			toolCalls.add(fragment)
+		}
+	}
+
+	message := openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		Content:   content.String(),
+		ToolCalls: toolCalls.toolCalls(),
+	}
+	fmt.Println(message)
+	return message, nil
+}
+
+// toolCallAccumulator 拼接流式返回的工具调用片段
+// 同一个工具调用的ID、名称和参数分散在多个片段中，通过Index区分不同的工具调用
+type toolCallAccumulator struct {
+	calls map[int]*openai.ToolCall
+	last  int
+}
+
+// newToolCallAccumulator 创建toolCallAccumulator
+func newToolCallAccumulator() *toolCallAccumulator {
+	return &toolCallAccumulator{calls: make(map[int]*openai.ToolCall), last: -1}
+}
+
+// add 合并一个工具调用片段
+func (a *toolCallAccumulator) add(fragment openai.ToolCall) {
+	index := a.last
+	switch {
+	case fragment.Index != nil:
+		index = *fragment.Index
+	case fragment.ID != "" || index < 0:
+		// 部分兼容接口不返回Index，带ID的片段表示一个新的工具调用
+		index = len(a.calls)
+	}
+	a.last = index
+
+	call, ok := a.calls[index]
+	if !ok {
+		call = &openai.ToolCall{Type: openai.ToolTypeFunction}
+		a.calls[index] = call
+	}
+	if fragment.ID != "" {
+		call.ID = fragment.ID
+	}
+	if fragment.Type != "" {
+		call.Type = fragment.Type
+	}
+	call.Function.Name += fragment.Function.Name
+	call.Function.Arguments += fragment.Function.Arguments
+}
+
+// toolCalls 按Index顺序返回拼接好的工具调用
+func (a *toolCallAccumulator) toolCalls() []openai.ToolCall {
+	if len(a.calls) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(a.calls))
+	for index := range a.calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	toolCalls := make([]openai.ToolCall, 0, len(indexes))
+	for _, index := range indexes {
+		toolCalls = append(toolCalls, *a.calls[index])
+	}
+	return toolCalls
+}
@@ -0,0 +1,75 @@
+package xiao_wan
+
+import (
+	"reflect"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestToolCallAccumulator(t *testing.T) {
+	index := func(i int) *int { return &i }
+	fragment := func(i *int, id, name, arguments string) openai.ToolCall {
+		return openai.ToolCall{Index: i, ID: id, Function: openai.FunctionCall{Name: name, Arguments: arguments}}
+	}
+	call := func(id, name, arguments string) openai.ToolCall {
+		return openai.ToolCall{ID: id, Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: name, Arguments: arguments}}
+	}
+
+	tests := []struct {
+		name      string
+		fragments []openai.ToolCall
+		want      []openai.ToolCall
+	}{
+		{
+			name: "no tool calls",
+		},
+		{
+			name: "one call split into fragments",
+			fragments: []openai.ToolCall{
+				fragment(index(0), "call_1", "weather", ""),
+				fragment(index(0), "", "", `{"city":`),
+				fragment(index(0), "", "", `"北京"}`),
+			},
+			want: []openai.ToolCall{call("call_1", "weather", `{"city":"北京"}`)},
+		},
+		{
+			name: "interleaved calls ordered by index",
+			fragments: []openai.ToolCall{
+				fragment(index(1), "call_2", "time", ""),
+				fragment(index(0), "call_1", "weather", `{"city"`),
+				fragment(index(1), "", "", `{}`),
+				fragment(index(0), "", "", `:"上海"}`),
+			},
+			want: []openai.ToolCall{
+				call("call_1", "weather", `{"city":"上海"}`),
+				call("call_2", "time", `{}`),
+			},
+		},
+		{
+			name: "fragments without index",
+			fragments: []openai.ToolCall{
+				fragment(nil, "call_1", "weather", `{"city":`),
+				fragment(nil, "", "", `"北京"}`),
+				fragment(nil, "call_2", "time", ""),
+				fragment(nil, "", "", `{}`),
+			},
+			want: []openai.ToolCall{
+				call("call_1", "weather", `{"city":"北京"}`),
+				call("call_2", "time", `{}`),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newToolCallAccumulator()
+			for _, f := range tt.fragments {
+				a.add(f)
+			}
+			if got := a.toolCalls(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("toolCalls = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package xiao_wan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// 工具调用循环的默认上限，配置中未设置（<=0）时使用
+const (
+	defaultMaxToolRounds        = 8
+	defaultMaxIdenticalToolCall = 2
+)
+
+// ErrToolRoundsExceeded 表示一条用户消息触发的工具调用轮数超过了上限
+var ErrToolRoundsExceeded = errors.New("tool call rounds exceeded")
+
+// ErrRepeatedToolCall 表示模型以相同参数反复调用同一个工具
+var ErrRepeatedToolCall = errors.New("repeated identical tool call")
+
+// toolLoopGuard 记录一条用户消息内的工具调用情况，防止模型无限调用工具
+type toolLoopGuard struct {
+	maxRounds    int
+	maxIdentical int
+	rounds       int
+	seen         map[string]int // 工具调用签名 -> 已调用次数
+}
+
+// newToolLoopGuard 根据配置创建toolLoopGuard
+func newToolLoopGuard(maxRounds, maxIdentical int) *toolLoopGuard {
+	if maxRounds <= 0 {
+		maxRounds = defaultMaxToolRounds
+	}
+	if maxIdentical <= 0 {
+		maxIdentical = defaultMaxIdenticalToolCall
+	}
+	return &toolLoopGuard{
+		maxRounds:    maxRounds,
+		maxIdentical: maxIdentical,
+		seen:         make(map[string]int),
+	}
+}
+
+// next 在执行一轮工具调用之前调用，超出预算时返回终止错误
+func (g *toolLoopGuard) next(toolCalls []openai.ToolCall) error {
+	if g.rounds >= g.maxRounds {
+		return fmt.Errorf("%w: limit is %d rounds per message", ErrToolRoundsExceeded, g.maxRounds)
+	}
+	g.rounds++
+
+	for _, toolCall := range toolCalls {
+		signature := toolCallSignature(toolCall)
+		g.seen[signature]++
+		if g.seen[signature] > g.maxIdentical {
+			return fmt.Errorf("%w: %s called %d times with arguments %s",
+				ErrRepeatedToolCall, toolCall.Function.Name, g.seen[signature], toolCall.Function.Arguments)
+		}
+	}
+	return nil
+}
+
+// toolCallSignature 生成工具调用的签名，参数为合法JSON时按规范化后的内容比较
+func toolCallSignature(toolCall openai.ToolCall) string {
+	arguments := toolCall.Function.Arguments
+	var v interface{}
+	if err := json.Unmarshal([]byte(arguments), &v); err == nil {
+		if normalized, err := json.Marshal(v); err == nil {
+			arguments = string(normalized)
+		}
+	}
+	return toolCall.Function.Name + ":" + arguments
+}
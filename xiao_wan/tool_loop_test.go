@@ -0,0 +1,100 @@
+package xiao_wan
+
+import (
+	"errors"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func toolCall(name, arguments string) openai.ToolCall {
+	return openai.ToolCall{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: arguments},
+	}
+}
+
+func TestToolLoopGuard(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRounds    int
+		maxIdentical int
+		rounds       [][]openai.ToolCall
+		wantErr      error // 最后一轮的错误，之前的轮次都应通过
+	}{
+		{
+			name:      "within limits",
+			maxRounds: 3,
+			rounds: [][]openai.ToolCall{
+				{toolCall("time", `{}`)},
+				{toolCall("weather", `{"city":"北京"}`)},
+				{toolCall("weather", `{"city":"上海"}`)},
+			},
+		},
+		{
+			name:      "too many rounds",
+			maxRounds: 2,
+			rounds: [][]openai.ToolCall{
+				{toolCall("a", `{}`)},
+				{toolCall("b", `{}`)},
+				{toolCall("c", `{}`)},
+			},
+			wantErr: ErrToolRoundsExceeded,
+		},
+		{
+			name:         "identical calls",
+			maxIdentical: 2,
+			rounds: [][]openai.ToolCall{
+				{toolCall("weather", `{"city":"北京"}`)},
+				{toolCall("weather", `{"city":"北京"}`)},
+				{toolCall("weather", `{"city":"北京"}`)},
+			},
+			wantErr: ErrRepeatedToolCall,
+		},
+		{
+			name:         "identical after normalizing json",
+			maxIdentical: 1,
+			rounds: [][]openai.ToolCall{
+				{toolCall("move", `{"x":1,"y":2}`)},
+				{toolCall("move", `{ "y": 2, "x": 1 }`)},
+			},
+			wantErr: ErrRepeatedToolCall,
+		},
+		{
+			name:         "identical calls in one round",
+			maxIdentical: 1,
+			rounds: [][]openai.ToolCall{
+				{toolCall("time", `{}`), toolCall("time", `{}`)},
+			},
+			wantErr: ErrRepeatedToolCall,
+		},
+		{
+			name:      "defaults when unset",
+			maxRounds: 0,
+			rounds: [][]openai.ToolCall{
+				{toolCall("a", `{}`)}, {toolCall("b", `{}`)}, {toolCall("c", `{}`)},
+				{toolCall("d", `{}`)}, {toolCall("e", `{}`)}, {toolCall("f", `{}`)},
+				{toolCall("g", `{}`)}, {toolCall("h", `{}`)}, {toolCall("i", `{}`)},
+			},
+			wantErr: ErrToolRoundsExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newToolLoopGuard(tt.maxRounds, tt.maxIdentical)
+			for i, round := range tt.rounds {
+				err := guard.next(round)
+				if i < len(tt.rounds)-1 {
+					if err != nil {
+						t.Fatalf("round %d: unexpected error: %v", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("round %d: err = %v, want %v", i, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
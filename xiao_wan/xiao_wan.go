@@ -3,27 +3,46 @@ package xiao_wan
 // 导入所需的包
 import (
 	"context" // 用于控制请求、超时和取消
-	"encoding/json"
+	"errors"
 	"fmt" // 用于格式化输出
+	"sort"
+	"sync"
+	"time"
 
 	"regexp"  // 用于正则表达式
 	"strconv" // 用于字符串和其他类型的转换
 
 	// 用于控制屏幕输出
-	openai "github.com/sashabaranov/go-openai" // OpenAI GPT的Go客户端
+	openai "github.com/sashabaranov/go-openai"     // OpenAI GPT的Go客户端
+	"github.com/sashabaranov/go-openai/jsonschema" // 结构化输出的JSON Schema
 	// 聊天界面
 	config "github.com/wangergou2023/agi_modules_for_go/config"   // 配置
 	plugins "github.com/wangergou2023/agi_modules_for_go/plugins" // 插件系统
 )
 
 // 定义助手结构体，包括配置、OpenAI客户端、函数定义和聊天界面
+// 每个Xiao_wan实例拥有独立的会话，需要以指针形式使用
 type Xiao_wan struct {
-	cfg          config.Cfg
-	Client       *openai.Client
-	tools        []openai.Tool
-	conversation []openai.ChatCompletionMessage
-	model        string
-	plugins      *plugins.PluginManager
+	cfg            config.Cfg
+	Client         *openai.Client
+	tools          []openai.Tool
+	model          string
+	plugins        *plugins.PluginManager
+	systemPrompt   string
+	contextManager *contextManager // 控制发送给模型的上下文长度
+	store          ConversationStore
+	startSessionID string
+	dialogueSchema *jsonschema.Definition  // 不为nil时要求模型按Dialogue格式回复
+	onCorrection   StreamCorrectionHandler // 流式输出的台词在校验后发生变化时调用
+	watchInterval  time.Duration           // 大于0时监视插件目录，热加载插件
+	stopWatch      func()
+	ownsPlugins    bool              // 插件管理器由Start或StartOne创建，Close时一并关闭
+	confirmer      plugins.Confirmer // 需要确认的工具调用使用的Confirmer
+
+	mu           sync.Mutex // 保护sessions、current、tools和toolsVersion
+	sessions     map[string]*Session
+	current      *Session
+	toolsVersion uint64 // 生成tools时插件管理器的版本号
 }
 
 // 定义系统提示信息，指导如何使用AI助手
@@ -88,7 +107,8 @@ var DuolaamengPrompt = `
 
 1. **分析问题类型**：
    - 判断问题属于哪一类（例如：查询天气、获取时间、计算等）。
-   - 根据问题类型选择最合适的工具或插件来执行操作。
+   - 先用qa_store的get按问题类型查找已记录的解决方法，get按相似度查找，返回的question是匹配到的已记录问题；如果它与当前问题属于同一类，直接使用返回的command和solution。
+   - 没有找到已记录的方法时，根据问题类型选择最合适的工具或插件来执行操作。
 
 2. **执行操作**：
    - 使用适当的命令、API请求或函数调用来解决问题。
@@ -99,86 +119,134 @@ var DuolaamengPrompt = `
    - 记录解决该类型问题的通用方法，而不是特定实例。例如，查询天气的方法应记录为“使用curl命令行工具请求wttr.in网站并指定查询参数，如：curl -s 'http://wttr.in/{城市名}?format=3'”。
 
 4. **记录成功操作**：
-   - 仅在操作成功时，将以下信息存储到一个JSON文件中：
-     - 工具名称或插件名称（如curl）。
-     - 使用的方法或命令（如curl -s 'http://wttr.in/{城市名}?format=3'）。
-     - 输入参数（通用的查询方法描述）。
-     - 输出结果（对方法的简要描述，如：“使用此方法可以查询任何城市的当前天气信息。”）。
-     - 操作时间戳。
+   - 仅在操作成功时，调用qa_store的add记录以下信息，时间戳由插件自动记录：
+     - question：问题类型（如“如何查询天气”），而不是具体的问题。
+     - plugin_name：使用的工具名称或插件名称（如command）。
+     - command：使用的方法或命令（如curl -s 'http://wttr.in/{城市名}?format=3'）。
+     - solution：通用的解决方法和对方法的简要描述（如：“使用curl请求wttr.in，可以查询任何城市的当前天气信息。”）。
+   - 已记录的方法不再适用时，用update更新。
 
 5. **避免存储失败操作**：
    - 如果操作失败（如API调用失败或命令执行失败），不要进行存储。
+   - command插件返回JSON结果：success为true且stdout包含所需信息才算成功；exit_code不为0、timed_out为true或被signal终止都算失败，可以根据stderr判断原因并换一种方法重试。
 
 6. **回答用户问题**：
    - 说明使用了哪个工具或插件，并简要描述获取结果的方法。
    - 如果已有相同的解决方法记录，直接返回已有的答案，而不重复存储。
 `
 
-// 定义一个全局变量用于存储对话信息
-var conversationLog []map[string]string
-
-// SaveConversationToJSON函数用于将对话信息保存到JSON中
-func (xiao_wan Xiao_wan) SaveConversationToJSON(role string, message string) {
-	conversationLog = append(conversationLog, map[string]string{
-		"role":    role,
-		"message": message,
-	})
+// SaveConversationToJSON函数用于将对话信息保存到当前会话的短期记忆中
+func (xiao_wan *Xiao_wan) SaveConversationToJSON(role string, message string) {
+	s := xiao_wan.Session()
+	s.Remember(role, message)
+	xiao_wan.persist(s)
 }
 
 // Message函数用于处理用户消息
-func (xiao_wan Xiao_wan) Message(message string) (string, error) {
-	xiao_wan.SaveConversationToJSON("user", message) // 将用户消息保存到JSON
-	// 导入短期记忆
-	logJSON, err := json.Marshal(conversationLog)
-	if err != nil {
-		return "", err
-	}
-	message = "短期记忆:" + string(logJSON) + message
+func (xiao_wan *Xiao_wan) Message(message string) (string, error) {
+	return xiao_wan.MessageContext(context.Background(), message)
+}
 
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: message,
-		Name:    "",
-	})
+// MessageContext函数用于处理用户消息，ctx被取消时本轮对话（包括插件执行）随之终止
+func (xiao_wan *Xiao_wan) MessageContext(ctx context.Context, message string) (string, error) {
+	return xiao_wan.messageWithMemory(ctx, xiao_wan.Session(), message, nil)
+}
+
+// MessageInSession函数在指定会话中处理用户消息
+func (xiao_wan *Xiao_wan) MessageInSession(ctx context.Context, sessionID string, message string) (string, error) {
+	s, ok := xiao_wan.GetSession(sessionID)
+	if !ok {
+		return "", fmt.Errorf("session %s not found", sessionID)
+	}
+	return xiao_wan.messageWithMemory(ctx, s, message, nil)
+}
 
-	response, err := xiao_wan.sendMessage() // 发送消息到OpenAI并获取回复
+// messageWithMemory函数处理用户消息，并在消息前附带会话的短期记忆
+// onDelta不为nil时以流式方式请求回复
+func (xiao_wan *Xiao_wan) messageWithMemory(ctx context.Context, s *Session, message string, onDelta StreamHandler) (string, error) {
+	s.turnMu.Lock()
+	defer s.turnMu.Unlock()
+	defer xiao_wan.persist(s)
 
+	// 本轮失败时撤销用户消息，避免短期记忆中留下没有回答的问题
+	memory := s.ShortTermMemory()
+	s.Remember("user", message) // 将用户消息保存到短期记忆
+	// 导入短期记忆
+	logJSON, err := s.shortTermMemoryJSON()
 	if err != nil {
+		s.replaceMemory(memory)
 		return "", err
 	}
+	message = "短期记忆:" + logJSON + message
 
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleAssistant,
-		Content: response,
-		Name:    "",
-	})
-
-	xiao_wan.SaveConversationToJSON("assistant", response) // 将助手回复保存到JSON
-
-	// 打印conversationLog的内容
-	logJSON, err = json.Marshal(conversationLog)
+	response, err := xiao_wan.turn(ctx, s, message, onDelta)
 	if err != nil {
+		s.replaceMemory(memory)
 		return "", err
 	}
-	// fmt.Printf("Conversation Log: %s\r\n", string(logJSON))
+
+	s.Remember("assistant", response) // 将助手回复保存到短期记忆
 
 	return response, nil
 }
-func (xiao_wan Xiao_wan) MessageOne(message string) (string, error) {
 
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
+// MessageOne函数用于处理用户消息，不附带短期记忆
+func (xiao_wan *Xiao_wan) MessageOne(message string) (string, error) {
+	return xiao_wan.MessageOneContext(context.Background(), message)
+}
+
+// MessageOneContext函数与MessageOne相同，但本轮对话受ctx控制
+func (xiao_wan *Xiao_wan) MessageOneContext(ctx context.Context, message string) (string, error) {
+	s := xiao_wan.Session()
+	s.turnMu.Lock()
+	defer s.turnMu.Unlock()
+	defer xiao_wan.persist(s)
+
+	return xiao_wan.turn(ctx, s, message, nil)
+}
+
+// turn函数完成一轮对话：追加用户消息、请求回复并追加助手回复
+// 调用方需持有s.turnMu；本轮失败时对话回滚到本轮开始之前，避免留下不完整的消息
+// onDelta不为nil时以流式方式请求回复，文本片段到达时立即回调
+func (xiao_wan *Xiao_wan) turn(ctx context.Context, s *Session, message string, onDelta StreamHandler) (string, error) {
+	// 插件在两轮对话之间发生变化时更新工具列表，同一轮内保持不变
+	xiao_wan.refreshTools()
+	rollback := s.Conversation()
+
+	s.append(openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
 		Content: message,
 		Name:    "",
 	})
 
-	response, err := xiao_wan.sendMessage() // 发送消息到OpenAI并获取回复
+	// 启用Dialogue格式时只把台词的文字流式交给onDelta，不转发JSON本身
+	stream := onDelta
+	var text *dialogueTextStream
+	if stream != nil && xiao_wan.dialogueSchema != nil {
+		text = newDialogueTextStream(onDelta)
+		stream = text.write
+	}
+
+	var response string
+	var err error
+	if stream != nil {
+		response, err = xiao_wan.sendMessageStream(ctx, s, stream) // 流式获取回复
+	} else {
+		response, err = xiao_wan.sendMessage(ctx, s) // 发送消息到OpenAI并获取回复
+	}
+	if err == nil && xiao_wan.dialogueSchema != nil {
+		response, err = xiao_wan.repairDialogue(ctx, s, response) // 校验结构化回复
+	}
 
 	if err != nil {
+		s.replace(rollback)
 		return "", err
 	}
+	if text != nil {
+		xiao_wan.finishDialogueStream(text, response)
+	}
 
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
+	s.append(openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleAssistant,
 		Content: response,
 		Name:    "",
@@ -187,9 +255,185 @@ func (xiao_wan Xiao_wan) MessageOne(message string) (string, error) {
 	return response, nil
 }
 
+// Session函数返回当前会话
+func (xiao_wan *Xiao_wan) Session() *Session {
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	return xiao_wan.current
+}
+
+// GetSession函数通过ID获取会话
+func (xiao_wan *Xiao_wan) GetSession(id string) (*Session, bool) {
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	s, ok := xiao_wan.sessions[id]
+	return s, ok
+}
+
+// Sessions函数按创建时间返回所有会话
+func (xiao_wan *Xiao_wan) Sessions() []*Session {
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	sessions := make([]*Session, 0, len(xiao_wan.sessions))
+	for _, s := range xiao_wan.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].createdAt.Before(sessions[j].createdAt)
+	})
+	return sessions
+}
+
+// NewSession函数创建一个新会话并切换为当前会话
+func (xiao_wan *Xiao_wan) NewSession() *Session {
+	s := newSession(newSessionID(), xiao_wan.systemPrompt, xiao_wan.cfg.ShortTermMemorySize())
+	xiao_wan.mu.Lock()
+	xiao_wan.sessions[s.id] = s
+	xiao_wan.current = s
+	xiao_wan.mu.Unlock()
+
+	xiao_wan.persist(s)
+	return s
+}
+
+// OpenSession函数打开指定ID的会话并切换为当前会话
+// 会话已在内存中时直接切换；存储中存在时从存储恢复；否则以该ID新建会话
+func (xiao_wan *Xiao_wan) OpenSession(id string) (*Session, error) {
+	if s, ok := xiao_wan.GetSession(id); ok {
+		return s, xiao_wan.SwitchSession(id)
+	}
+
+	var s *Session
+	if xiao_wan.store != nil {
+		snapshot, err := xiao_wan.store.LoadSession(id)
+		switch {
+		case err == nil:
+			s = sessionFromSnapshot(snapshot, xiao_wan.systemPrompt, xiao_wan.cfg.ShortTermMemorySize())
+			fmt.Printf("会话%s已从存储恢复，共%d条消息\n", id, len(snapshot.Conversation))
+		case !errors.Is(err, ErrSessionNotFound):
+			return nil, err
+		}
+	}
+	if s == nil {
+		s = newSession(id, xiao_wan.systemPrompt, xiao_wan.cfg.ShortTermMemorySize())
+	}
+
+	xiao_wan.mu.Lock()
+	xiao_wan.sessions[s.id] = s
+	xiao_wan.current = s
+	xiao_wan.mu.Unlock()
+
+	xiao_wan.persist(s)
+	return s, nil
+}
+
+// StoredSessions函数返回存储中所有会话的ID，未设置存储时返回空
+func (xiao_wan *Xiao_wan) StoredSessions() ([]string, error) {
+	if xiao_wan.store == nil {
+		return nil, nil
+	}
+	return xiao_wan.store.ListSessions()
+}
+
+// persist函数将会话保存到存储，保存失败只记录日志，不影响对话
+func (xiao_wan *Xiao_wan) persist(s *Session) {
+	if xiao_wan.store == nil || s == nil {
+		return
+	}
+	if err := xiao_wan.store.SaveSession(s.snapshot()); err != nil {
+		fmt.Printf("保存会话%s失败: %v\n", s.id, err)
+	}
+}
+
+// openInitialSession函数创建启动时的会话，指定了会话ID时优先从存储恢复
+func (xiao_wan *Xiao_wan) openInitialSession() {
+	if xiao_wan.startSessionID == "" {
+		xiao_wan.NewSession()
+		return
+	}
+	if _, err := xiao_wan.OpenSession(xiao_wan.startSessionID); err != nil {
+		fmt.Printf("Error opening session %s: %v\n", xiao_wan.startSessionID, err)
+		xiao_wan.NewSession()
+	}
+}
+
+// SwitchSession函数将指定会话切换为当前会话
+func (xiao_wan *Xiao_wan) SwitchSession(id string) error {
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	s, ok := xiao_wan.sessions[id]
+	if !ok {
+		return fmt.Errorf("session %s not found", id)
+	}
+	xiao_wan.current = s
+	return nil
+}
+
+// ForkSession函数复制指定会话的历史和短期记忆，生成一个新会话，当前会话保持不变
+func (xiao_wan *Xiao_wan) ForkSession(id string) (*Session, error) {
+	s, ok := xiao_wan.GetSession(id)
+	if !ok {
+		return nil, fmt.Errorf("session %s not found", id)
+	}
+	forked := s.fork(newSessionID())
+	xiao_wan.mu.Lock()
+	xiao_wan.sessions[forked.id] = forked
+	xiao_wan.mu.Unlock()
+
+	xiao_wan.persist(forked)
+	return forked, nil
+}
+
+// ResetSession函数清空指定会话的历史和短期记忆，只保留系统提示
+func (xiao_wan *Xiao_wan) ResetSession(id string) error {
+	s, ok := xiao_wan.GetSession(id)
+	if !ok {
+		return fmt.Errorf("session %s not found", id)
+	}
+	s.reset(xiao_wan.systemPrompt)
+	xiao_wan.persist(s)
+	return nil
+}
+
+// refreshTools函数在插件加载或卸载后重新生成工具列表
+func (xiao_wan *Xiao_wan) refreshTools() {
+	version := xiao_wan.plugins.Version()
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	if xiao_wan.tools != nil && version == xiao_wan.toolsVersion {
+		return
+	}
+	xiao_wan.tools = xiao_wan.plugins.GenerateOpenAItoolsDefinition()
+	xiao_wan.toolsVersion = version
+}
+
+// toolList函数返回当前的工具列表
+func (xiao_wan *Xiao_wan) toolList() []openai.Tool {
+	xiao_wan.mu.Lock()
+	defer xiao_wan.mu.Unlock()
+	return xiao_wan.tools
+}
+
+// StopPluginWatch函数停止监视插件目录
+func (xiao_wan *Xiao_wan) StopPluginWatch() {
+	if xiao_wan.stopWatch != nil {
+		xiao_wan.stopWatch()
+	}
+}
+
+// Close函数停止监视插件目录，并按加载的相反顺序关闭自己创建的插件
+// 通过WithPluginManager传入的插件管理器由调用方负责关闭
+func (xiao_wan *Xiao_wan) Close() error {
+	xiao_wan.StopPluginWatch()
+	if !xiao_wan.ownsPlugins {
+		return nil
+	}
+	return xiao_wan.plugins.Close()
+}
+
 // sendMessage函数用于向OpenAI发送请求并获取回复
-func (xiao_wan Xiao_wan) sendMessage() (string, error) {
-	resp, err := xiao_wan.sendRequestToOpenAI() // 发送请求到OpenAI
+func (xiao_wan *Xiao_wan) sendMessage(ctx context.Context, s *Session) (string, error) {
+	resp, err := xiao_wan.sendRequestToOpenAI(ctx, s) // 发送请求到OpenAI
 
 	if err != nil {
 		return "", err
@@ -199,7 +443,7 @@ func (xiao_wan Xiao_wan) sendMessage() (string, error) {
 
 	// 如果有工具调用，需要处理工具调用
 	if resp.Choices[0].FinishReason == openai.FinishReasonToolCalls {
-		responseContent, err := xiao_wan.handleFunctionCall(resp) // 处理函数调用
+		responseContent, err := xiao_wan.handleFunctionCall(ctx, s, resp) // 处理函数调用
 		if err != nil {
 			return "", err
 		}
@@ -210,68 +454,103 @@ func (xiao_wan Xiao_wan) sendMessage() (string, error) {
 }
 
 // handleFunctionCall函数用于处理OpenAI回复中的函数调用
-func (xiao_wan Xiao_wan) handleFunctionCall(resp *openai.ChatCompletionResponse) (string, error) {
-	toolCall := resp.Choices[0].Message.ToolCalls[0]
-	funcName := toolCall.Function.Name // 获取函数名称
-	fmt.Println("获取函数名称", funcName)
+// 模型在同一轮中请求的所有工具都会被执行，结果按请求顺序写回对话
+// 模型继续请求工具时循环处理，轮数和重复调用次数受配置限制
+func (xiao_wan *Xiao_wan) handleFunctionCall(ctx context.Context, s *Session, resp *openai.ChatCompletionResponse) (string, error) {
+	guard := newToolLoopGuard(xiao_wan.cfg.MaxToolRounds(), xiao_wan.cfg.MaxIdenticalToolCall())
+	for resp.Choices[0].FinishReason == openai.FinishReasonToolCalls {
+		if err := guard.next(resp.Choices[0].Message.ToolCalls); err != nil {
+			fmt.Println("工具调用已终止:", err)
+			return "", err
+		}
 
-	// 检查是否加载了相应插件
-	if !xiao_wan.plugins.IsPluginLoaded(funcName) {
-		return "", fmt.Errorf("no plugin loaded with name %v", funcName)
-	}
+		if err := xiao_wan.runToolCalls(ctx, s, resp.Choices[0].Message); err != nil {
+			return "", err
+		}
 
-	// 调用插件
-	jsonResponse, err := xiao_wan.plugins.CallPlugin(funcName, toolCall.Function.Arguments)
-	if err != nil {
-		return "", err
+		var err error
+
+		// 再次发送请求到OpenAI，获取下一个回复
+		resp, err = xiao_wan.sendRequestToOpenAI(ctx, s)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Println(resp.Choices[0])
 	}
 
-	// 构造工具调用请求的消息，使用ToolCalls字段
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleAssistant,
-		ToolCalls: []openai.ToolCall{ // 使用ToolCalls切片
-			{
-				ID:   toolCall.ID,
-				Type: toolCall.Type, // 假设ToolCall有Type字段，表示调用类型
-				Function: openai.FunctionCall{
-					Name:      toolCall.Function.Name,
-					Arguments: toolCall.Function.Arguments,
-				},
-			},
-		},
-	})
+	return resp.Choices[0].Message.Content, nil
+}
 
-	// 构造工具调用结果的消息
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role:       openai.ChatMessageRoleTool,
-		Content:    jsonResponse,
-		ToolCallID: toolCall.ID, // 保持与工具调用一致
-	})
+// runToolCalls函数执行一轮工具调用，并将调用请求和调用结果追加到会话中
+func (xiao_wan *Xiao_wan) runToolCalls(ctx context.Context, s *Session, message openai.ChatCompletionMessage) error {
+	calls := make([]plugins.PluginCall, 0, len(message.ToolCalls))
+	for _, toolCall := range message.ToolCalls {
+		funcName := toolCall.Function.Name // 获取函数名称
+		fmt.Println("获取函数名称", funcName)
 
-	// 再次发送请求到OpenAI，获取下一个回复
-	resp, err = xiao_wan.sendRequestToOpenAI()
+		// 没有插件提供该工具时不中断本轮对话，CallPluginsContext为这个调用返回错误信息，模型可以据此改用其他工具
+		if !xiao_wan.plugins.HasTool(funcName) {
+			fmt.Println("没有插件提供工具", funcName)
+		}
+		calls = append(calls, plugins.PluginCall{ID: funcName, Input: toolCall.Function.Arguments})
+	}
+
+	// 调用插件，不同插件之间并发执行
+	// Confirmer随ctx传入，多个助手共用PluginManager时各自的确认互不影响
+	if xiao_wan.confirmer != nil {
+		ctx = plugins.WithConfirmer(ctx, xiao_wan.confirmer)
+	}
+	jsonResponses, err := xiao_wan.plugins.CallPluginsContext(ctx, calls)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	fmt.Println(resp.Choices[0])
+	// 构造工具调用请求的消息，一条assistant消息包含本轮全部ToolCalls
+	toolCalls := make([]openai.ToolCall, 0, len(message.ToolCalls))
+	for _, toolCall := range message.ToolCalls {
+		toolCalls = append(toolCalls, openai.ToolCall{
+			ID:   toolCall.ID,
+			Type: toolCall.Type,
+			Function: openai.FunctionCall{
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			},
+		})
+	}
+	s.append(openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		Content:   message.Content,
+		ToolCalls: toolCalls,
+	})
 
-	// 如果再一次触发工具调用，可能需要递归处理
-	if resp.Choices[0].FinishReason == openai.FinishReasonToolCalls {
-		return xiao_wan.handleFunctionCall(resp) // 递归处理函数调用
+	// 构造工具调用结果的消息，每个工具调用对应一条tool消息
+	for i, toolCall := range message.ToolCalls {
+		s.append(openai.ChatCompletionMessage{
+			Role:       openai.ChatMessageRoleTool,
+			Content:    jsonResponses[i],
+			ToolCallID: toolCall.ID, // 保持与工具调用一致
+		})
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	return nil
 }
 
 // sendRequestToOpenAI函数用于向OpenAI发送请求
-func (xiao_wan Xiao_wan) sendRequestToOpenAI() (*openai.ChatCompletionResponse, error) {
+func (xiao_wan *Xiao_wan) sendRequestToOpenAI(ctx context.Context, s *Session) (*openai.ChatCompletionResponse, error) {
+	// 超出上下文预算时先压缩较早的对话
+	tools := xiao_wan.toolList()
+	if err := xiao_wan.contextManager.compact(ctx, s, tools); err != nil {
+		return nil, err
+	}
+
 	resp, err := xiao_wan.Client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
-			Model:    xiao_wan.model,
-			Messages: xiao_wan.conversation,
-			Tools:    xiao_wan.tools,
+			Model:          xiao_wan.model,
+			Messages:       s.Conversation(),
+			Tools:          tools,
+			ResponseFormat: xiao_wan.responseFormat(),
 		},
 	)
 
@@ -282,71 +561,136 @@ func (xiao_wan Xiao_wan) sendRequestToOpenAI() (*openai.ChatCompletionResponse,
 	return &resp, nil
 }
 
-// Start函数用于启动助手
-func Start(cfg config.Cfg, openaiClient *openai.Client) Xiao_wan {
-	xiao_wan := Xiao_wan{
-		cfg:    cfg,
-		Client: openaiClient,
-		model:  openai.GPT4oMini,
+// StartOption用于定制Start和StartOne创建的助手
+type StartOption func(*Xiao_wan)
+
+// WithStore设置会话的持久化存储，每轮对话结束后保存当前会话
+func WithStore(store ConversationStore) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.store = store
+	}
+}
+
+// WithSessionID指定启动时使用的会话ID，存储中已有该会话时从存储恢复
+func WithSessionID(id string) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.startSessionID = id
+	}
+}
+
+// WithPluginManager使用已有的插件管理器，Start和StartOne不再从目录加载插件
+// 用于让多个助手共用同一组已初始化的插件
+func WithPluginManager(pm *plugins.PluginManager) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.plugins = pm
+	}
+}
+
+// WithPluginWatch每隔interval扫描一次插件目录，加载新增的插件并卸载已删除的插件
+// 工具列表在下一轮对话开始时更新
+func WithPluginWatch(interval time.Duration) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.watchInterval = interval
 	}
+}
 
-	// 创建一个新的 PluginManager 实例
-	xiao_wan.plugins = plugins.NewPluginManager(cfg, openaiClient)
+// WithConfirmer设置需要确认的工具调用（例如执行命令）使用的Confirmer
+// 只作用于该助手发起的工具调用，共用同一PluginManager的其他助手不受影响
+// 未设置时使用PluginManager的SetConfirmer设置的Confirmer，都没有时按权限规则需要确认的工具调用都会被拒绝
+func WithConfirmer(c plugins.Confirmer) StartOption {
+	return func(xiao_wan *Xiao_wan) {
+		xiao_wan.confirmer = c
+	}
+}
 
-	// 加载插件目录中的所有插件
-	err := xiao_wan.plugins.LoadPlugins("for_chat")
+// loadPlugins函数加载插件目录中的插件和配置中选择的编译期注册插件
+// 单个插件加载失败不影响其他插件，每个插件的结果都会输出，必需插件失败时单独报告
+func (xiao_wan *Xiao_wan) loadPlugins(compiledDir string) {
+	// 工具权限规则按插件目录区分助手
+	xiao_wan.plugins.SetPolicy(xiao_wan.cfg.AgentToolPolicy(compiledDir))
+	report, err := xiao_wan.plugins.LoadPluginsReport(compiledDir)
 	if err != nil {
 		fmt.Printf("Error loading plugins: %v\n", err)
 	}
-	fmt.Println("Plugins loaded successfully")
-	xiao_wan.tools = xiao_wan.plugins.GenerateOpenAItoolsDefinition()
+	registered := xiao_wan.plugins.LoadRegisteredReport(xiao_wan.cfg.AgentPlugins(compiledDir)...)
+	report.Results = append(report.Results, registered.Results...)
+
+	fmt.Print(report)
+	if err := report.RequiredErr(); err != nil {
+		fmt.Printf("Error loading required plugins: %v\n", err)
+	} else {
+		fmt.Printf("Plugins loaded: %d succeeded, %d failed\n", len(report.Loaded()), len(report.Failed()))
+	}
 
-	// 重置对话
-	xiao_wan.conversation = []openai.ChatCompletionMessage{}
-	// 添加系统提示到对话
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: SystemPrompt,
-		Name:    "",
-	})
+	if xiao_wan.watchInterval > 0 {
+		xiao_wan.stopWatch = xiao_wan.plugins.Watch(compiledDir, xiao_wan.watchInterval)
+	}
+}
+
+// PluginStatus函数返回助手所用插件的加载状态
+func (xiao_wan *Xiao_wan) PluginStatus() []plugins.PluginStatus {
+	return xiao_wan.plugins.Status()
+}
+
+// Start函数用于启动助手
+func Start(cfg config.Cfg, openaiClient *openai.Client, opts ...StartOption) *Xiao_wan {
+	xiao_wan := &Xiao_wan{
+		cfg:          cfg,
+		Client:       openaiClient,
+		model:        openai.GPT4oMini,
+		systemPrompt: SystemPrompt,
+		sessions:     make(map[string]*Session),
+	}
+	xiao_wan.contextManager = newContextManager(openaiClient, xiao_wan.model, cfg.ContextTokenBudget(), cfg.ContextSummarize())
+	for _, opt := range opts {
+		opt(xiao_wan)
+	}
+
+	if xiao_wan.plugins == nil {
+		// 创建一个新的 PluginManager 实例
+		xiao_wan.plugins = plugins.NewPluginManager(cfg, openaiClient)
+		xiao_wan.ownsPlugins = true
+		xiao_wan.loadPlugins("for_chat")
+	}
+	xiao_wan.refreshTools()
+
+	// 创建或恢复初始会话，会话中已包含系统提示
+	xiao_wan.openInitialSession()
 
 	fmt.Println("xiao wan chat is ready!")
 	return xiao_wan
 }
 
-func StartOne(cfg config.Cfg, openaiClient *openai.Client, systemPrompt string, compiledDir string) Xiao_wan {
-	xiao_wan := Xiao_wan{
-		cfg:    cfg,
-		Client: openaiClient,
-		model:  openai.GPT4oMini,
+func StartOne(cfg config.Cfg, openaiClient *openai.Client, systemPrompt string, compiledDir string, opts ...StartOption) *Xiao_wan {
+	xiao_wan := &Xiao_wan{
+		cfg:          cfg,
+		Client:       openaiClient,
+		model:        openai.GPT4oMini,
+		systemPrompt: systemPrompt,
+		sessions:     make(map[string]*Session),
+	}
+	xiao_wan.contextManager = newContextManager(openaiClient, xiao_wan.model, cfg.ContextTokenBudget(), cfg.ContextSummarize())
+	for _, opt := range opts {
+		opt(xiao_wan)
 	}
 
-	// 创建一个新的 PluginManager 实例
-	xiao_wan.plugins = plugins.NewPluginManager(cfg, openaiClient)
-
-	// 加载插件目录中的所有插件
-	err := xiao_wan.plugins.LoadPlugins(compiledDir)
-	if err != nil {
-		fmt.Printf("Error loading plugins: %v\n", err)
+	if xiao_wan.plugins == nil {
+		// 创建一个新的 PluginManager 实例
+		xiao_wan.plugins = plugins.NewPluginManager(cfg, openaiClient)
+		xiao_wan.ownsPlugins = true
+		xiao_wan.loadPlugins(compiledDir)
 	}
-	fmt.Println("Plugins loaded successfully")
-	xiao_wan.tools = xiao_wan.plugins.GenerateOpenAItoolsDefinition()
+	xiao_wan.refreshTools()
 
-	// 重置对话
-	xiao_wan.conversation = []openai.ChatCompletionMessage{}
-	// 添加系统提示到对话
-	xiao_wan.conversation = append(xiao_wan.conversation, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleSystem,
-		Content: systemPrompt,
-		Name:    "",
-	})
+	// 创建或恢复初始会话，会话中已包含系统提示
+	xiao_wan.openInitialSession()
 
 	fmt.Println("xiao wan one chat is ready!")
 	return xiao_wan
 }
 
-func StartStt(cfg config.Cfg, openaiClient *openai.Client) Xiao_wan {
-	xiao_wan := Xiao_wan{
+func StartStt(cfg config.Cfg, openaiClient *openai.Client) *Xiao_wan {
+	xiao_wan := &Xiao_wan{
 		cfg:    cfg,
 		Client: openaiClient,
 		model:  openai.Whisper1,
@@ -355,7 +699,7 @@ func StartStt(cfg config.Cfg, openaiClient *openai.Client) Xiao_wan {
 	return xiao_wan
 }
 
-func (xiao_wan Xiao_wan) Stt() string {
+func (xiao_wan *Xiao_wan) Stt() string {
 
 	req := openai.AudioRequest{
 		Model:    xiao_wan.model,
@@ -390,7 +734,7 @@ func parseOpenAIError(err error) *OpenAIError {
 }
 
 // 处理OpenAI错误
-func (xiao_wan Xiao_wan) openaiError(err error) {
+func (xiao_wan *Xiao_wan) openaiError(err error) {
 	parsedError := parseOpenAIError(err)
 
 	switch parsedError.StatusCode {
@@ -0,0 +1,111 @@
+package xiao_wan
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	config "github.com/wangergou2023/agi_modules_for_go/config"
+	plugins "github.com/wangergou2023/agi_modules_for_go/plugins"
+)
+
+// dangerousPlugin 需要确认才能执行的测试插件
+type dangerousPlugin struct{ id string }
+
+func (p *dangerousPlugin) Init(cfg config.Cfg, openaiClient *openai.Client) error { return nil }
+func (p *dangerousPlugin) ID() string                                             { return p.id }
+func (p *dangerousPlugin) Description() string                                    { return "测试插件" }
+func (p *dangerousPlugin) FunctionDefinition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{Name: p.id, Parameters: map[string]interface{}{"type": "object"}}
+}
+func (p *dangerousPlugin) Execute(string) (string, error)        { return "已执行", nil }
+func (p *dangerousPlugin) ToolRisk(tool string) plugins.ToolRisk { return plugins.RiskDangerous }
+
+func init() {
+	plugins.Register("xiao_wan_test_rm", func() plugins.Plugin { return &dangerousPlugin{id: "xiao_wan_test_rm"} })
+}
+
+// lastToolResult 返回会话中最后一条tool消息的内容
+func lastToolResult(x *Xiao_wan) string {
+	conversation := x.Session().Conversation()
+	for i := len(conversation) - 1; i >= 0; i-- {
+		if conversation[i].Role == openai.ChatMessageRoleTool {
+			return conversation[i].Content
+		}
+	}
+	return ""
+}
+
+func TestSharedPluginManagerConfirmers(t *testing.T) {
+	pm := plugins.NewPluginManager(config.New(), nil)
+	if err := pm.LoadRegistered("xiao_wan_test_rm"); err != nil {
+		t.Fatal(err)
+	}
+	call := openai.ChatCompletionMessage{
+		Role:      openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "xiao_wan_test_rm", Arguments: `{}`}}},
+	}
+	start := func(approved bool) *Xiao_wan {
+		_, client := newFakeOpenAI(t, call, assistant("好的"))
+		confirmer := plugins.ConfirmFunc(func(ctx context.Context, req plugins.ToolRequest) (bool, error) { return approved, nil })
+		return StartOne(config.New(), client, "", "", WithPluginManager(pm), WithConfirmer(confirmer))
+	}
+
+	// 后创建的助手不会替换先创建的助手的Confirmer
+	approving := start(true)
+	rejecting := start(false)
+	for _, tt := range []struct {
+		name string
+		x    *Xiao_wan
+		want string
+	}{
+		{name: "approving", x: approving, want: "已执行"},
+		{name: "rejecting", x: rejecting, want: "rejected"},
+	} {
+		if _, err := tt.x.MessageOneContext(context.Background(), "删除文件"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := lastToolResult(tt.x); !strings.Contains(got, tt.want) {
+			t.Errorf("%s: tool result = %s, want it to contain %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownToolCall(t *testing.T) {
+	call := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleAssistant,
+		ToolCalls: []openai.ToolCall{
+			{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "no_such_tool", Arguments: `{}`}},
+			{ID: "call_2", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "xiao_wan_test_rm", Arguments: `{}`}},
+		},
+	}
+	fake, client := newFakeOpenAI(t, call, assistant("没有这个工具"))
+	pm := plugins.NewPluginManager(config.New(), nil)
+	if err := pm.LoadRegistered("xiao_wan_test_rm"); err != nil {
+		t.Fatal(err)
+	}
+	approve := plugins.ConfirmFunc(func(ctx context.Context, req plugins.ToolRequest) (bool, error) { return true, nil })
+	x := StartOne(config.New(), client, "", "", WithPluginManager(pm), WithConfirmer(approve))
+
+	// 未知的工具作为该调用的错误结果返回给模型，同一轮的其他调用照常执行
+	got, err := x.MessageOneContext(context.Background(), "你好")
+	if err != nil || got != "没有这个工具" {
+		t.Fatalf("MessageOneContext = %q, %v", got, err)
+	}
+	results := make(map[string]string)
+	for _, m := range x.Session().Conversation() {
+		if m.Role == openai.ChatMessageRoleTool {
+			results[m.ToolCallID] = m.Content
+		}
+	}
+	if !strings.Contains(results["call_1"], `"error"`) || !strings.Contains(results["call_1"], "no_such_tool") {
+		t.Errorf("result of unknown tool = %s", results["call_1"])
+	}
+	if !strings.Contains(results["call_2"], "已执行") {
+		t.Errorf("result of known tool = %s", results["call_2"])
+	}
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("got %d requests, want the tool results sent back to the model", n)
+	}
+}